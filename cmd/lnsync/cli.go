@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	daemon "github.com/sevlyar/go-daemon"
+	"github.com/svagner/lnsync/pkg/lnsync"
+)
+
+var source string
+var distanation string
+var alsoDest stringList
+var legacySignal string
+var pidf string
+var logf string
+var recursive bool
+var watchParent bool
+var linkMode string
+var include stringList
+var exclude stringList
+var foreground bool
+var container bool
+var collision string
+var linkStyle string
+var mirrorTree bool
+var debounce time.Duration
+var settle time.Duration
+var workers int
+var queueSize int
+var retries int
+var retryDelay time.Duration
+var opTimeout time.Duration
+var shutdownTimeout time.Duration
+var overflow string
+var resyncInterval time.Duration
+var sweepInterval time.Duration
+var globInterval time.Duration
+var waitMount time.Duration
+var statef string
+var deadLetterFile string
+var umask = fileMode(027)
+var pidFileMode = fileMode(0644)
+var logFileMode = fileMode(0640)
+var runUser string
+var runGroup string
+var chroot string
+var workDir string
+var adoptExisting bool
+var backend string
+var pollInterval time.Duration
+var kqueueBudget int
+var tamper string
+var existing string
+var durable bool
+var createDest bool
+var destMode string
+var destOwner string
+var linkOwner string
+var destPerms string
+var normalize string
+var skipHidden bool
+var linkTempFiles bool
+var ignoreFile string
+var extensions string
+var minSize lnsync.Size
+var maxSize lnsync.Size
+var contentTypes stringList
+var linkSpecial bool
+var linkDirs bool
+var sourceLinks string
+var brokenLinks string
+var sourceRemoved string
+var quarantineDir string
+var reattach time.Duration
+var nameTemplate string
+var renames renameList
+var lowercase bool
+var sourceSubdirs bool
+var layout string
+var layoutGroups groupMap
+var shardChars int
+var contentNames string
+var manifest string
+var httpAddr string
+var pprofAddr string
+var otlpEndpoint string
+var statsdAddr string
+var statsdPrefix string
+var dogstatsd bool
+var otlpInsecure bool
+var traceSample float64
+var pprofPublic bool
+var apiAddr string
+var apiPublic bool
+var grpcAddr string
+var grpcPublic bool
+var grpcCert string
+var grpcKey string
+var statsFile string
+var logLevel string
+var logTarget string
+var syslogFacility string
+var syslogTag string
+var logFormat string
+var controlPath string
+var statusJSON bool
+var configf string
+
+// stringList is a repeatable command line flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// fileMode is a permission flag written in octal, e.g. 0640
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(*m))
+}
+
+func (m *fileMode) Set(value string) error {
+	perm, err := lnsync.ParseFileMode(value)
+	if err != nil {
+		return err
+	}
+	*m = fileMode(perm)
+	return nil
+}
+
+// renameList collects -rename rules written as "regexp=>replacement"
+type renameList []lnsync.RenameRule
+
+func (l *renameList) String() string {
+	rules := make([]string, 0, len(*l))
+	for _, rule := range *l {
+		rules = append(rules, rule.Match+"=>"+rule.Replace)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (l *renameList) Set(value string) error {
+	match, replace, ok := strings.Cut(value, "=>")
+	if !ok {
+		return errors.New("rename rule " + value + " lacks =>")
+	}
+	*l = append(*l, lnsync.RenameRule{Match: match, Replace: replace})
+	return nil
+}
+
+// groupMap collects -layout-group values written as "dir=ext,ext"
+type groupMap map[string][]string
+
+func (g *groupMap) String() string {
+	groups := make([]string, 0, len(*g))
+	for dir, exts := range *g {
+		groups = append(groups, dir+"="+strings.Join(exts, ","))
+	}
+	return strings.Join(groups, " ")
+}
+
+func (g *groupMap) Set(value string) error {
+	dir, exts, ok := strings.Cut(value, "=")
+	if !ok {
+		return errors.New("layout group " + value + " lacks =")
+	}
+	if *g == nil {
+		*g = make(groupMap)
+	}
+	(*g)[dir] = append((*g)[dir], splitList(exts)...)
+	return nil
+}
+
+// commands lists the subcommands with their one line description
+var commands = []struct{ name, help string }{
+	{"start", "watch the sources and maintain the links (default)"},
+	{"stop", "terminate the running daemon"},
+	{"reload", "make the running daemon re-read its configuration"},
+	{"status", "print the state of the running daemon (-json for scripts)"},
+	{"rescan", "make the running daemon reconcile every mapping, or the one given"},
+	{"ctl", "send pause, resume, rescan, stats, health or list-links to the daemon"},
+	{"healthcheck", "exit 0 if the running daemon is healthy and 1 otherwise, for Docker and Nomad"},
+	{"once", "create missing links, remove dangling ones and exit"},
+	{"verify", "report links out of sync without changing anything"},
+}
+
+// mappingFlags registers the flags describing what to link where
+func mappingFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configf, "config", "", "Config file with source/destination mappings (absolute path)")
+	fs.StringVar(&source, "s", "", "Source path")
+	fs.StringVar(&distanation, "d", "", "Distanation path")
+	fs.Var(&alsoDest, "also-dest", "Keep a further destination in sync with the same links (repeatable)")
+	fs.BoolVar(&recursive, "r", false, "Watch source directories recursively")
+	fs.BoolVar(&watchParent, "watch-parent", false, "Treat every subdirectory of the sources as a source, following them as they are created and removed")
+	fs.StringVar(&linkMode, "link-mode", lnsync.LinkSymbolic, "Link type: symlink, hard or copy")
+	fs.Var(&include, "include", "Link only files matching the glob pattern (repeatable)")
+	fs.Var(&exclude, "exclude", "Skip files matching the glob pattern (repeatable)")
+	fs.StringVar(&extensions, "extensions", "", "Link only files with these comma separated extensions, e.g. log,gz,csv")
+	fs.StringVar(&collision, "collision", lnsync.CollisionFirst,
+		"Policy for equally named files in several sources: fail, first-wins, newest-mtime-wins, priority or prefix-with-source-name")
+	fs.StringVar(&linkStyle, "link-style", lnsync.LinkAbsolute, "Symlink target style: absolute or relative")
+	fs.BoolVar(&skipHidden, "skip-hidden", false, "Skip hidden files and directories")
+	fs.BoolVar(&linkTempFiles, "link-temp-files", false, "Also link editor swap files and partial transfers, skipped by default")
+	fs.StringVar(&ignoreFile, "ignore-file", "", "Gitignore style file applied to every source, besides their own .lnsyncignore")
+	fs.TextVar(&minSize, "min-size", lnsync.Size(0), "Link only files of at least this size, e.g. 1 to skip empty files or 10M")
+	fs.TextVar(&maxSize, "max-size", lnsync.Size(0), "Link only files of at most this size, 0 for no limit")
+	fs.Var(&contentTypes, "content-type", "Link only files whose detected content type matches, e.g. application/x-gzip or image/* (repeatable)")
+	fs.BoolVar(&linkSpecial, "link-special", false, "Also link sockets, FIFOs and device nodes")
+	fs.BoolVar(&linkDirs, "link-dirs", false, "Also symlink the subdirectories of a source, not recursive")
+	fs.StringVar(&sourceLinks, "source-symlinks", lnsync.SourceLinksKeep,
+		"Symlinks in a source: link to the symlink itself, or resolve to its final target")
+	fs.StringVar(&brokenLinks, "broken-symlinks", lnsync.BrokenSkip,
+		"Source symlinks without a target: skip, mirror them anyway, or recheck and link them once the target appears")
+	fs.StringVar(&sourceRemoved, "source-removed", lnsync.SourceRemovedRemove,
+		"Links of a source directory which is removed or renamed away: remove, quarantine or keep them")
+	fs.StringVar(&quarantineDir, "quarantine-dir", "", "Directory links are moved to by -source-removed=quarantine")
+	fs.DurationVar(&reattach, "reattach-interval", 5*time.Second,
+		"Look for a missing source directory this often and watch it again once it is back, negative to give it up")
+	fs.StringVar(&nameTemplate, "name-template", "", "Template of link names, e.g. '{{.SourceBase}}_{{.Name}}' or '{{.Date}}/{{.Name}}'")
+	fs.Var(&renames, "rename", "Rewrite link names matching a regular expression, as 'regexp=>replacement' (repeatable)")
+	fs.BoolVar(&lowercase, "lowercase", false, "Lowercase link names")
+	fs.BoolVar(&sourceSubdirs, "source-subdirs", false, "Place the links of every source in a subdirectory of the destination named after it")
+	fs.StringVar(&layout, "layout", lnsync.LayoutFlat, "Destination layout: flat, date for YYYY/MM/DD subdirectories by modification time, extension, or hash")
+	fs.IntVar(&shardChars, "shard-chars", 0, "Hex digits of the name hash the hash layout shards by, in levels of two (default 4)")
+	fs.StringVar(&contentNames, "content-names", "", "Name links by the SHA-256 of their contents: hash, hash-ext or hash-name")
+	fs.Var(&layoutGroups, "layout-group", "Subdirectory of the extension layout and its extensions, e.g. images=jpg,png (repeatable)")
+	fs.StringVar(&manifest, "manifest", "", "Maintain a manifest of the links in the destination: json or tsv")
+	fs.BoolVar(&mirrorTree, "mirror-tree", false, "Recreate the source subdirectory layout in the destination (implies -r)")
+	fs.DurationVar(&debounce, "debounce", 0, "Coalesce events for the same file within this window, e.g. 200ms")
+	fs.BoolVar(&adoptExisting, "adopt-existing", false, "Take over destination entries not created by lnsync")
+	fs.StringVar(&backend, "backend", lnsync.DefaultBackend, "Change detection: inotify, fanotify for very large trees, fsevents on macOS, kqueue on BSD, or poll for NFS, CIFS and FUSE mounts")
+	fs.DurationVar(&settle, "settle", 0, "Link a new file only once it was not written to for this long, e.g. 5s")
+	fs.DurationVar(&pollInterval, "poll-interval", 10*time.Second, "Scan interval of the poll backend")
+	fs.IntVar(&kqueueBudget, "kqueue-budget", 0, "Descriptors the kqueue backend may hold per source, 1024 by default; beyond them directories are scanned every -poll-interval")
+	fs.StringVar(&existing, "existing", lnsync.ExistingSkip,
+		"Policy for destination entries not created by lnsync in the way of a link: skip, overwrite, backup or fail")
+	fs.BoolVar(&durable, "durable", false, "Fsync the destination directory after every change, and copies before they are renamed into place")
+	fs.BoolVar(&createDest, "create-dest", false, "Create the destination directory when it is missing, at startup and at runtime")
+	fs.StringVar(&destMode, "dest-mode", "0755", "Mode of a created destination directory")
+	fs.StringVar(&destOwner, "dest-owner", "", "Owner of a created destination directory, user[:group]")
+	fs.StringVar(&destPerms, "dest-perms", "",
+		"Check the destination against -dest-mode and -dest-owner at startup and every minute: repair, alert, or refuse to link into it")
+	fs.StringVar(&linkOwner, "link-owner", "", "Owner of created symlinks and copies, user[:group] or source for that of the source file")
+	fs.StringVar(&normalize, "normalize", "", "Unicode normalization of link names: nfc or nfd, none by default")
+	fs.StringVar(&tamper, "tamper", "", "Watch the destination for links changed by others and repair or alert")
+}
+
+// logFlags registers the logging flags
+func logFlags(fs *flag.FlagSet) {
+	fs.StringVar(&logf, "log", defaultLogFile, "log file")
+	fs.Var(&logFileMode, "log-mode", "Permissions of the log file")
+	fs.StringVar(&logLevel, "log-level", "info", "Minimum log level: debug, info, warn or error")
+	fs.StringVar(&logTarget, "log-target", LogTargetFile, "Log destination: file (stderr in foreground), syslog or journald")
+	fs.StringVar(&syslogFacility, "syslog-facility", "daemon", "Syslog facility: daemon, user or local0-local7")
+	fs.StringVar(&syslogTag, "syslog-tag", "lnsync", "Syslog tag, also the journal SYSLOG_IDENTIFIER")
+	fs.StringVar(&logFormat, "log-format", "text", "Log record format: text or json")
+}
+
+// daemonFlags registers the flags of the long running daemon
+func daemonFlags(fs *flag.FlagSet) {
+	fs.StringVar(&pidf, "pid", defaultPidFile, "pid file")
+	fs.Var(&pidFileMode, "pid-mode", "Permissions of the pid file")
+	fs.Var(&umask, "umask", "Umask of the daemon, applied to the pid file, log file and created directories and copies")
+	fs.BoolVar(&foreground, "foreground", false, "Run in foreground without daemonization, log to stderr")
+	fs.BoolVar(&container, "container", false, "Run as a container entrypoint: foreground, JSON logs to stdout, reaping orphans as PID 1; detected when not given")
+	fs.IntVar(&workers, "workers", 4, "Number of link workers")
+	fs.IntVar(&queueSize, "queue-size", 1024, "Pending updates per link worker, and pending events")
+	fs.StringVar(&overflow, "overflow", lnsync.OverflowBlock, "Policy for a full event queue: block, drop-oldest or rescan")
+	fs.IntVar(&retries, "retries", 5, "Retries of a failed link operation")
+	fs.DurationVar(&retryDelay, "retry-delay", time.Second, "Delay before the first retry, doubled every attempt")
+	fs.DurationVar(&opTimeout, "op-timeout", 0, "Deadline of a single link operation, e.g. 30s for large copies")
+	fs.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to finish received updates on SIGTERM before exiting")
+	fs.DurationVar(&resyncInterval, "resync-interval", 0, "Periodically reconcile sources and destinations, e.g. 1h")
+	fs.DurationVar(&sweepInterval, "sweep-interval", 0, "Periodically remove dangling links from the destinations, e.g. 10m")
+	fs.DurationVar(&globInterval, "glob-interval", 30*time.Second, "Look for new directories matching source patterns this often, 0 to only expand them at startup")
+	fs.DurationVar(&waitMount, "wait-mount", 0, "Wait up to this long for the sources and destinations to be mounted before starting, e.g. 2m")
+	fs.StringVar(&statef, "state", "", "State file recording the links created by lnsync")
+	fs.StringVar(&deadLetterFile, "dead-letter", "", "Append updates still failing after all retries to this file as JSON lines")
+	fs.StringVar(&runUser, "user", "", "Switch to this user, by name or uid, once started as root")
+	fs.StringVar(&chroot, "chroot", "", "Confine the daemon to this directory once started as root; paths are then seen from inside it")
+	fs.StringVar(&workDir, "workdir", "", "Working directory of the daemon, / when daemonized or confined")
+	fs.StringVar(&runGroup, "group", "", "Switch to this group, by name or gid, once started as root; the primary group of -user by default")
+	fs.StringVar(&httpAddr, "http", "", "Listen address of the HTTP endpoint serving /metrics, /healthz and /readyz, e.g. 127.0.0.1:9101")
+	fs.StringVar(&pprofAddr, "pprof", "", "Listen address of the pprof profiles under /debug/pprof/, e.g. :6060 for loopback port 6060")
+	fs.BoolVar(&pprofPublic, "pprof-public", false, "Allow -pprof on other than loopback addresses")
+	fs.StringVar(&otlpEndpoint, "otlp-endpoint", "", "Export OpenTelemetry traces of the event pipeline over OTLP/gRPC to this collector, e.g. localhost:4317")
+	fs.BoolVar(&otlpInsecure, "otlp-insecure", false, "Connect to the OTLP collector without TLS")
+	fs.StringVar(&statsdAddr, "statsd", "", "Send metrics every 10s to this StatsD server, e.g. 127.0.0.1:8125; overrides [statsd] of the config file")
+	fs.StringVar(&statsdPrefix, "statsd-prefix", "lnsync", "Prefix of the StatsD metric names")
+	fs.BoolVar(&dogstatsd, "dogstatsd", false, "Tag StatsD metrics with their mapping, DogStatsD style")
+	fs.Float64Var(&traceSample, "trace-sample", 1, "Fraction of events traced")
+	fs.StringVar(&controlPath, "control", defaultControl, "Control socket of the daemon, empty to disable")
+	fs.StringVar(&apiAddr, "api", "", "Listen address of the admin HTTP API managing mappings at runtime, e.g. :9102 for loopback port 9102")
+	fs.BoolVar(&apiPublic, "api-public", false, "Allow -api on other than loopback addresses")
+	fs.StringVar(&statsFile, "stats-file", "", "Write the statistics dumped on SIGUSR1 to this file instead of the log")
+	fs.StringVar(&grpcAddr, "grpc", "", "Listen address of the gRPC management and event streaming API, e.g. :9103 for loopback port 9103")
+	fs.BoolVar(&grpcPublic, "grpc-public", false, "Allow -grpc on other than loopback addresses")
+	fs.StringVar(&grpcCert, "grpc-cert", "", "TLS certificate of the gRPC API, PEM encoded, with -grpc-key")
+	fs.StringVar(&grpcKey, "grpc-key", "", "TLS private key of the gRPC API, PEM encoded")
+}
+
+func usage(fs *flag.FlagSet, command string) {
+	out := fs.Output()
+	if command == "rescan" {
+		io.WriteString(out, "Usage: lnsync rescan [options] [mapping]\n\n")
+		fs.PrintDefaults()
+		return
+	}
+	if command == "ctl" {
+		io.WriteString(out, "Usage: lnsync ctl [options] pause|resume|stats|health|rescan [mapping]|list-links [mapping]\n\n")
+		fs.PrintDefaults()
+		return
+	}
+	if len(command) != 0 {
+		io.WriteString(out, "Usage: lnsync "+command+" [options]\n\n")
+		fs.PrintDefaults()
+		return
+	}
+	io.WriteString(out, "Usage: lnsync [command] [options]\n\n")
+	for _, cmd := range commands {
+		io.WriteString(out, "  "+cmd.name+"\t"+cmd.help+"\n")
+	}
+	io.WriteString(out, "\nRun 'lnsync <command> -h' for the options of a command. Without a\n"+
+		"command lnsync starts the daemon and accepts -signal term|reload as\n"+
+		"an alias of stop and reload.\n\n")
+	fs.PrintDefaults()
+}
+
+// sendSignal delivers sig to the daemon owning the pid file and returns
+// the process exit status
+func sendSignal(pidfile string, sig syscall.Signal) int {
+	dmn := &daemon.Context{PidFileName: pidfile}
+	proc, err := dmn.Search()
+	if err != nil || proc == nil {
+		slog.Error("unable to find running daemon", "pid_file", pidfile, "error", err)
+		return 1
+	}
+	if err = proc.Signal(sig); err != nil {
+		slog.Error("unable to send signal", "pid", proc.Pid, "error", err)
+		return 1
+	}
+	return 0
+}
+
+// runOnce performs a single reconciliation of every mapping and returns
+// the process exit status
+func runOnce(conf *lnsync.Config) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	status := 0
+	for idx := range conf.Mappings {
+		mapping := &conf.Mappings[idx]
+		if err := lnsync.Reconcile(ctx, mapping); err != nil {
+			slog.Error("sync failed", "mapping", mapping.Name, "error", err)
+			status = 1
+		}
+	}
+	if err := linkState.Save(); err != nil {
+		slog.Error("save state failed", "error", err)
+		status = 1
+	}
+	return status
+}
+
+// runVerify compares every destination with its sources without touching
+// either and returns 1 when a link is missing, dangling or stale
+func runVerify(conf *lnsync.Config) int {
+	status := 0
+	for idx := range conf.Mappings {
+		mapping := &conf.Mappings[idx]
+		drift, err := lnsync.Verify(mapping)
+		if err != nil {
+			slog.Error("verify failed", "mapping", mapping.Name, "error", err)
+			status = 1
+		}
+		for _, line := range drift {
+			io.WriteString(os.Stdout, mapping.Name+": "+line+"\n")
+		}
+		if len(drift) != 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+func readConfig() (*lnsync.Config, error) {
+	conf, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(statsdAddr) != 0 {
+		conf.Statsd = &lnsync.Statsd{Address: statsdAddr, Prefix: statsdPrefix, DogStatsD: dogstatsd}
+	}
+	return conf, nil
+}
+
+// loadConfig reads the config file, or builds the single mapping of the
+// flags
+func loadConfig() (*lnsync.Config, error) {
+	if len(configf) != 0 {
+		return lnsync.LoadConfig(configf)
+	}
+	return configFromFlags(source, lnsync.Mapping{
+		Name:          "default",
+		Destination:   distanation,
+		Destinations:  append([]string{distanation}, alsoDest...),
+		WatchParent:   watchParent,
+		Recursive:     recursive,
+		LinkMode:      linkMode,
+		Include:       include,
+		Exclude:       exclude,
+		Collision:     collision,
+		LinkStyle:     linkStyle,
+		MirrorTree:    mirrorTree,
+		Debounce:      lnsync.Duration{Duration: debounce},
+		Settle:        lnsync.Duration{Duration: settle},
+		AdoptExisting: adoptExisting,
+		Backend:       backend,
+		PollInterval:  lnsync.Duration{Duration: pollInterval},
+		KqueueBudget:  kqueueBudget,
+		Tamper:        tamper,
+		Existing:      existing,
+		Durable:       durable,
+		CreateDest:    createDest,
+		DestMode:      destMode,
+		DestOwner:     destOwner,
+		LinkOwner:     linkOwner,
+		DestPerms:     destPerms,
+		Normalize:     normalize,
+		SkipHidden:    skipHidden,
+		LinkTempFiles: linkTempFiles,
+		IgnoreFile:    ignoreFile,
+		Extensions:    splitList(extensions),
+		MinSize:       minSize,
+		MaxSize:       maxSize,
+		ContentTypes:  contentTypes,
+		LinkSpecial:   linkSpecial,
+		LinkDirs:      linkDirs,
+		SourceLinks:   sourceLinks,
+		BrokenLinks:   brokenLinks,
+		SourceRemoved: sourceRemoved,
+		QuarantineDir: quarantineDir,
+		Reattach:      lnsync.Duration{Duration: reattach},
+		NameTemplate:  nameTemplate,
+		Rename:        renames,
+		Lowercase:     lowercase,
+		SourceSubdirs: sourceSubdirs,
+		Layout:        layout,
+		LayoutGroups:  layoutGroups,
+		ShardChars:    shardChars,
+		ContentNames:  contentNames,
+		Manifest:      manifest,
+	})
+}
+
+// flagGiven reports whether the flag was set on the command line, which
+// then takes precedence over the config file
+func flagGiven(fs *flag.FlagSet, name string) bool {
+	given := false
+	fs.Visit(func(f *flag.Flag) {
+		given = given || f.Name == name
+	})
+	return given
+}
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' })
+}
+
+// configFromFlags builds a single mapping from the -s/-d pair
+func configFromFlags(sources string, m lnsync.Mapping) (*lnsync.Config, error) {
+	for _, src := range strings.Split(sources, ",") {
+		if len(src) != 0 {
+			m.Sources = append(m.Sources, src)
+		}
+	}
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
+	return &lnsync.Config{Mappings: []lnsync.Mapping{m}}, nil
+}
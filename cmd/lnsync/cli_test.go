@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestFileModeSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		valid bool
+	}{
+		{"0640", "0640", true},
+		{"600", "0600", true},
+		{"027", "0027", true},
+		{"01077", "", false},
+		{"2640", "", false},
+		{"0x1ff", "", false},
+	}
+	for _, tt := range tests {
+		m := fileMode(0644)
+		err := m.Set(tt.value)
+		if (err == nil) != tt.valid {
+			t.Errorf("Set(%q) error = %v, want valid %v", tt.value, err, tt.valid)
+			continue
+		}
+		if tt.valid && m.String() != tt.want {
+			t.Errorf("Set(%q) = %s, want %s", tt.value, m.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// initChildEnv marks the daemon started by runInit
+const initChildEnv = "LNSYNC_INIT_CHILD"
+
+// inContainer reports whether lnsync runs in a container: as PID 1, or
+// with the markers Docker, Podman and systemd-nspawn leave
+func inContainer() bool {
+	if os.Getpid() == 1 || len(os.Getenv("container")) != 0 || len(os.Getenv(initChildEnv)) != 0 {
+		return true
+	}
+	for _, marker := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(marker); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// runInit is PID 1 of a container. It runs the daemon as its child,
+// forwards signals to it and reaps every process orphaned in the
+// container, the grandchildren of hooks for instance, which the kernel
+// hands to PID 1. The daemon does not reap them itself, it would take the
+// exit status of its own hook commands. runInit exits with the status of
+// the daemon.
+func runInit() {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2,
+		syscall.SIGCHLD)
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   append(os.Environ(), initChildEnv+"=1"),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		fatal("starting the daemon failed", "error", err)
+	}
+	for sig := range signals {
+		if sig != syscall.SIGCHLD {
+			proc.Signal(sig)
+			continue
+		}
+		for {
+			var status syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if err != nil || pid <= 0 {
+				break
+			}
+			if pid != proc.Pid {
+				continue
+			}
+			if status.Signaled() {
+				os.Exit(128 + int(status.Signal()))
+			}
+			os.Exit(status.ExitStatus())
+		}
+	}
+}
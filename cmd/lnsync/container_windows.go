@@ -0,0 +1,8 @@
+package main
+
+// inContainer is false, container mode is for Linux containers
+func inContainer() bool {
+	return false
+}
+
+func runInit() {}
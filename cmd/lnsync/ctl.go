@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/svagner/lnsync/pkg/lnsync"
+)
+
+// runControl sends a command line to the daemon, prints the JSON reply and
+// returns the process exit status
+func runControl(path string, args []string) int {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: lnsync ctl [-control path] command [mapping]")
+		return 2
+	}
+	var reply json.RawMessage
+	if err := lnsync.ControlRequest(path, strings.Join(args, " "), &reply); err != nil {
+		fmt.Fprintln(os.Stderr, "lnsync ctl:", err)
+		return 1
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, reply, "", "  "); err != nil {
+		out.Write(reply)
+	}
+	out.WriteByte('\n')
+	out.WriteTo(os.Stdout)
+	return 0
+}
+
+// runHealthcheck asks the running daemon for its health: watchers
+// running, destinations writable, event queue moving and the initial
+// reconciliation done. It prints the problems found and returns 0 if there
+// are none, 1 otherwise, also when the daemon does not answer.
+func runHealthcheck(control string) int {
+	var health struct {
+		Problems []string `json:"problems"`
+	}
+	if err := lnsync.ControlRequest(control, "health", &health); err != nil {
+		fmt.Fprintln(os.Stderr, "lnsync healthcheck:", err)
+		return 1
+	}
+	if len(health.Problems) == 0 {
+		fmt.Println("ok")
+		return 0
+	}
+	for _, problem := range health.Problems {
+		fmt.Println(problem)
+	}
+	return 1
+}
+
+// runStatus prints the status of the running daemon and returns the
+// process exit status
+func runStatus(control string, asJSON bool) int {
+	var st lnsync.Status
+	if err := lnsync.ControlRequest(control, "status", &st); err != nil {
+		fmt.Fprintln(os.Stderr, "lnsync status:", err)
+		return 1
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(&st)
+		return 0
+	}
+	printStatus(os.Stdout, &st)
+	return 0
+}
+
+func printStatus(w io.Writer, st *lnsync.Status) {
+	fmt.Fprintf(w, "pid:         %d\n", st.Pid)
+	fmt.Fprintf(w, "uptime:      %s (since %s)\n", st.Uptime, st.Started.Format(time.RFC3339))
+	fmt.Fprintf(w, "queue depth: %d events, %d updates (retrying %d)\n", st.EventQueue, st.QueueDepth, st.RetryDepth)
+	if st.Paused {
+		fmt.Fprintf(w, "paused:      %d updates held back\n", st.Held)
+	}
+	if st.LastErrorAt != nil {
+		fmt.Fprintf(w, "last error:  %s (%s)\n", st.LastError, st.LastErrorAt.Format(time.RFC3339))
+	} else {
+		fmt.Fprintln(w, "last error:  none")
+	}
+	for _, ms := range st.Mappings {
+		fmt.Fprintf(w, "\nmapping %s -> %s, %d links", ms.Name, ms.Destination, ms.Links)
+		if ms.Degraded {
+			fmt.Fprint(w, ", DEGRADED")
+		}
+		if ms.Errors != 0 {
+			fmt.Fprintf(w, ", %d errors (last: %s)", ms.Errors, ms.LastError)
+		}
+		fmt.Fprintln(w)
+		for _, src := range ms.Sources {
+			mark := "active"
+			if !src.Active {
+				mark = "INACTIVE"
+			}
+			fmt.Fprintf(w, "  %-8s %s: %d files, %d watched directories, %d events",
+				mark, src.Path, src.Files, src.Watched, src.Events)
+			if src.Scanned != 0 {
+				fmt.Fprintf(w, ", %d SCANNED directories", src.Scanned)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// journalSocket is where systemd-journald receives native protocol messages
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalHandler sends every record as a native journal entry: MESSAGE,
+// PRIORITY and one LNSYNC_<KEY> field per attribute, e.g. LNSYNC_SOURCE
+type journalHandler struct {
+	conn   *net.UnixConn
+	level  slog.Leveler
+	tag    string
+	prefix string
+	attrs  []slog.Attr
+}
+
+func newJournalHandler(tag string, level slog.Leveler) (slog.Handler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn, level: level, tag: tag, prefix: "LNSYNC_"}, nil
+}
+
+func (h *journalHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journalHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	journalField(&buf, "MESSAGE", r.Message)
+	journalField(&buf, "PRIORITY", strconv.Itoa(journalPriority(r.Level)))
+	journalField(&buf, "SYSLOG_IDENTIFIER", h.tag)
+	for _, a := range h.attrs {
+		journalAttr(&buf, "LNSYNC_", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		journalAttr(&buf, h.prefix, a)
+		return true
+	})
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		// keep the group prefix the attribute was added under
+		h2.attrs = append(h2.attrs, slog.Attr{Key: strings.TrimPrefix(h.prefix, "LNSYNC_") + a.Key, Value: a.Value})
+	}
+	return &h2
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.prefix = h.prefix + journalKey(name) + "_"
+	return &h2
+}
+
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+func journalAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			journalAttr(buf, prefix+journalKey(a.Key)+"_", ga)
+		}
+		return
+	}
+	value := a.Value.String()
+	if a.Value.Kind() == slog.KindDuration {
+		value = a.Value.Duration().String()
+	} else if a.Value.Kind() == slog.KindTime {
+		value = a.Value.Time().Format(time.RFC3339Nano)
+	}
+	journalField(buf, prefix+journalKey(a.Key), value)
+}
+
+// journalKey turns an attribute key into a valid journal field name:
+// upper case letters, digits and underscores
+func journalKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// journalField appends a field in the native protocol format; values with
+// newlines use the binary length-prefixed form
+func journalField(buf *bytes.Buffer, key, value string) {
+	if !strings.ContainsRune(value, '\n') {
+		buf.WriteString(key + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(key + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+)
+
+// defaultLogFile is where daemons log on macOS, shown by Console
+const defaultLogFile = "/Library/Logs/lnsync.log"
+
+// launchdJob reports whether launchd started the daemon. A launchd job
+// must not fork into the background, launchd would take it for exited;
+// it runs in foreground and logs to the StandardErrorPath of its plist.
+func launchdJob() bool {
+	return os.Getppid() == 1 && len(os.Getenv("XPC_SERVICE_NAME")) != 0
+}
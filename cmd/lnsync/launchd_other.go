@@ -0,0 +1,11 @@
+//go:build !darwin && !windows
+
+package main
+
+// defaultLogFile is the log file of the daemon unless -log is given
+const defaultLogFile = "/var/log/lnsync.log"
+
+// launchdJob is false, there is no launchd
+func launchdJob() bool {
+	return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// logOutput receives the log records: stderr, or the log file in daemon
+// mode, which is reopened on SIGHUP so logrotate can move it away
+var logOutput = &reopenWriter{w: os.Stderr}
+
+type reopenWriter struct {
+	lock sync.Mutex
+	file string
+	perm os.FileMode
+	w    io.Writer
+}
+
+func (r *reopenWriter) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.w.Write(p)
+}
+
+// Open switches the output to the file
+func (r *reopenWriter) Open(file string, perm os.FileMode) error {
+	r.lock.Lock()
+	r.file, r.perm = file, perm
+	r.lock.Unlock()
+	return r.Reopen()
+}
+
+// Reopen opens the log file again, picking up a new file after rotation
+func (r *reopenWriter) Reopen() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.file) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(r.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, r.perm)
+	if err != nil {
+		return err
+	}
+	if old, ok := r.w.(*os.File); ok && old != os.Stderr {
+		old.Close()
+	}
+	r.w = f
+	return nil
+}
+
+// Log targets
+const (
+	LogTargetFile    = "file"
+	LogTargetSyslog  = "syslog"
+	LogTargetJournal = "journald"
+)
+
+// formatter creates the text or JSON handler writing records to w
+type formatter func(w io.Writer, opts *slog.HandlerOptions) slog.Handler
+
+// setupLogging installs the default logger writing text or JSON records of
+// at least the given level to the target: logOutput, or the local syslog
+// daemon with the given facility and tag, or the systemd journal.
+// Single link operations and raw watcher events are logged at debug level.
+func setupLogging(target, format, level, facility, tag string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	var newHandler formatter
+	switch format {
+	case "text":
+		newHandler = func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+			return slog.NewTextHandler(w, opts)
+		}
+	case "json":
+		newHandler = func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+			return slog.NewJSONHandler(w, opts)
+		}
+	default:
+		return errors.New("unknown log format " + format)
+	}
+
+	var handler slog.Handler
+	switch target {
+	case LogTargetFile:
+		handler = newHandler(logOutput, &slog.HandlerOptions{Level: lvl})
+	case LogTargetSyslog:
+		var err error
+		if handler, err = newSyslogHandler(facility, tag, lvl, newHandler); err != nil {
+			return err
+		}
+	case LogTargetJournal:
+		var err error
+		if handler, err = newJournalHandler(tag, lvl); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown log target " + target)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs an error record and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"log/slog"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	daemon "github.com/sevlyar/go-daemon"
+	"github.com/svagner/lnsync/pkg/lnsync"
+)
+
+// linkState records the links created by lnsync when -state is given
+var linkState *lnsync.State
+
+func main() {
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("lnsync "+command, flag.ExitOnError)
+	fs.Usage = func() { usage(fs, command) }
+	switch command {
+	case "":
+		// legacy flat interface: start, or -signal term/reload
+		mappingFlags(fs)
+		logFlags(fs)
+		daemonFlags(fs)
+		fs.StringVar(&legacySignal, "signal", "", "Send signal to daemon: term or reload (alias of stop and reload)")
+	case "start", "install":
+		mappingFlags(fs)
+		logFlags(fs)
+		daemonFlags(fs)
+	case "once", "verify":
+		mappingFlags(fs)
+		logFlags(fs)
+		fs.StringVar(&statef, "state", "", "State file recording the links created by lnsync")
+	case "uninstall":
+	case "stop", "reload":
+		fs.StringVar(&pidf, "pid", defaultPidFile, "Pid file")
+	case "status":
+		fs.StringVar(&controlPath, "control", defaultControl, "Control socket of the daemon")
+		fs.BoolVar(&statusJSON, "json", false, "Print status as JSON")
+	case "ctl", "rescan", "healthcheck":
+		fs.StringVar(&controlPath, "control", defaultControl, "Control socket of the daemon")
+	default:
+		usage(fs, "")
+		os.Exit(2)
+	}
+	fs.Parse(args)
+	if launchdJob() {
+		// launchd supervises the process itself
+		foreground = true
+	}
+	if (command == "" || command == "start") && !flagGiven(fs, "container") && inContainer() {
+		container = true
+	}
+	if container {
+		foreground = true
+		logOutput.w = os.Stdout
+		if !flagGiven(fs, "log-format") {
+			logFormat = "json"
+		}
+	}
+
+	switch {
+	case command == "stop" || (command == "" && legacySignal == "term"):
+		os.Exit(stopDaemon(pidf))
+	case command == "reload" || (command == "" && legacySignal == "reload"):
+		os.Exit(reloadDaemon(pidf))
+	case command == "" && len(legacySignal) != 0:
+		fs.Usage()
+		os.Exit(2)
+	case command == "status":
+		os.Exit(runStatus(controlPath, statusJSON))
+	case command == "ctl":
+		os.Exit(runControl(controlPath, fs.Args()))
+	case command == "healthcheck":
+		os.Exit(runHealthcheck(controlPath))
+	case command == "rescan":
+		os.Exit(runControl(controlPath, append([]string{"rescan"}, fs.Args()...)))
+	case command == "uninstall":
+		os.Exit(removeService())
+	}
+
+	if err := setupLogging(logTarget, logFormat, logLevel, syslogFacility, syslogTag); err != nil {
+		fatal("logging setup failed", "error", err)
+	}
+	conf, err := readConfig()
+	if err != nil {
+		slog.Error("configuration error", "error", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+	if conf.Workers != 0 && !flagGiven(fs, "workers") {
+		workers = conf.Workers
+	}
+	for flagName, mode := range map[string]string{"umask": conf.Umask, "pid-mode": conf.PidFileMode,
+		"log-mode": conf.LogFileMode} {
+		if len(mode) != 0 && !flagGiven(fs, flagName) {
+			if err := fs.Set(flagName, mode); err != nil {
+				fatal("configuration error", "flag", flagName, "error", err)
+			}
+		}
+	}
+	if command == "once" || command == "verify" {
+		if len(statef) != 0 {
+			if linkState, err = lnsync.LoadState(statef); err != nil {
+				fatal("unable to load state", "file", statef, "error", err)
+			}
+			lnsync.SetState(linkState)
+		}
+	}
+	switch command {
+	case "install":
+		os.Exit(installService(args))
+	case "once":
+		os.Exit(runOnce(conf))
+	case "verify":
+		os.Exit(runVerify(conf))
+	}
+	runDaemon(conf)
+}
+
+// runDaemon watches the sources of conf until terminated
+func runDaemon(conf *lnsync.Config) {
+	if container && os.Getpid() == 1 {
+		runInit()
+	}
+	var manager *lnsync.Manager
+	syncer := lnsync.NewSyncer(conf)
+
+	handler := func(sig os.Signal) error {
+		slog.Info("signal received", "signal", sig.String())
+		if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+			sdNotify("STOPPING=1")
+			if err := syncer.Shutdown(shutdownTimeout); err != nil {
+				slog.Error("graceful shutdown failed", "error", err)
+			}
+			if err := linkState.Save(); err != nil {
+				slog.Error("save state failed", "error", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := stopTracing(ctx); err != nil {
+				slog.Error("flushing traces failed", "error", err)
+			}
+			slog.Info("stopped")
+			return daemon.ErrStop
+		}
+		if sig == syscall.SIGHUP {
+			sdNotify("RELOADING=1")
+			defer sdNotify("READY=1")
+			if err := logOutput.Reopen(); err != nil {
+				slog.Error("reopen log file failed", "error", err)
+			}
+			conf, err := readConfig()
+			if err != nil {
+				slog.Error("reload failed, configuration error", "error", err)
+				return nil
+			}
+			if err = syncer.Reload(conf); err != nil {
+				slog.Error("reload finished with errors", "error", err)
+			}
+		}
+		return nil
+	}
+	daemon.SetSigHandler(handler, syscall.SIGTERM, syscall.SIGHUP)
+	userSignals(func() {
+		if manager == nil {
+			return
+		}
+		if paused, _ := manager.Paused(); paused {
+			manager.Resume()
+		} else {
+			manager.Pause()
+		}
+	}, func() {
+		if manager != nil {
+			lnsync.DumpStats(manager, statsFile)
+		}
+	})
+
+	logfile := logf
+	if logTarget != LogTargetFile {
+		logfile = ""
+	}
+	dir := "/"
+	if len(workDir) != 0 && len(chroot) == 0 {
+		dir = workDir
+	}
+	dmn := &daemon.Context{
+		PidFileName: pidf,
+		PidFilePerm: os.FileMode(pidFileMode),
+		LogFileName: logfile,
+		LogFilePerm: os.FileMode(logFileMode),
+		WorkDir:     dir,
+		Umask:       int(umask),
+	}
+
+	switch {
+	case foreground:
+		setUmask(int(umask))
+		daemon.SetSigHandler(handler, syscall.SIGINT)
+	case !canDaemonize:
+		// a Windows service has no console, it logs to the log file
+		daemon.SetSigHandler(handler, syscall.SIGINT)
+		if len(logfile) != 0 {
+			if err := logOutput.Open(logfile, dmn.LogFilePerm); err != nil {
+				fatal("open log file failed", "file", logfile, "error", err)
+			}
+		}
+	default:
+		child, _ := dmn.Reborn()
+
+		if child != nil {
+			return
+		}
+		defer dmn.Release()
+		if len(logfile) != 0 {
+			if err := logOutput.Open(logfile, dmn.LogFilePerm); err != nil {
+				fatal("open log file failed", "file", logfile, "error", err)
+			}
+		}
+	}
+	// the TLS key of the gRPC API is read while still privileged
+	grpcConf, err := grpcTLS(grpcCert, grpcKey)
+	if err != nil {
+		fatal("loading the gRPC certificate failed", "error", err)
+	}
+	// the pid file and log file are written, sources and destinations not
+	// touched yet
+	cred, err := lookupCredentials(runUser, runGroup)
+	if err != nil {
+		fatal("dropping privileges failed", "error", err)
+	}
+	if err := confine(chroot, workDir); err != nil {
+		fatal("confinement failed", "error", err)
+	}
+	if err := dropPrivileges(cred); err != nil {
+		fatal("dropping privileges failed", "error", err)
+	}
+	// start loads the state and runs the initial reconciliation, which
+	// takes a while on large trees. A Windows service reports itself as
+	// starting meanwhile.
+	start := func() {
+		if len(statef) != 0 {
+			var err error
+			if linkState, err = lnsync.LoadState(statef); err != nil {
+				fatal("unable to load state", "file", statef, "error", err)
+			}
+			lnsync.SetState(linkState)
+			go linkState.FlushLoop()
+		}
+		lnsync.SetDeadLetter(deadLetterFile)
+		if waitMount > 0 {
+			sdNotify("STATUS=waiting for mounts")
+			if err := lnsync.WaitForMounts(context.Background(), conf, waitMount); err != nil {
+				fatal("startup failed", "error", err)
+			}
+		}
+		if len(otlpEndpoint) != 0 {
+			if err := setupTracing(otlpEndpoint, otlpInsecure, traceSample); err != nil {
+				fatal("tracing setup failed", "endpoint", otlpEndpoint, "error", err)
+			}
+		}
+		syncer.Workers = workers
+		syncer.QueueSize = queueSize
+		syncer.Retries = retries
+		syncer.RetryDelay = retryDelay
+		syncer.OpTimeout = opTimeout
+		syncer.Overflow = overflow
+		syncer.ResyncInterval = resyncInterval
+		syncer.SweepInterval = sweepInterval
+		syncer.GlobInterval = globInterval
+		if err := syncer.Start(context.Background()); err != nil {
+			fatal("startup failed", "error", err)
+		}
+		manager = syncer.Manager()
+		if err := sdNotify("READY=1"); err != nil {
+			slog.Error("notify service manager failed", "error", err)
+		}
+		go watchdog(manager)
+		if len(controlPath) != 0 {
+			go func() {
+				fatal("control socket failed", "path", controlPath, "error", lnsync.ServeControl(controlPath, manager))
+			}()
+		}
+		if len(httpAddr) != 0 {
+			go func() {
+				fatal("HTTP endpoint failed", "address", httpAddr, "error", lnsync.ServeHTTP(httpAddr, manager))
+			}()
+		}
+		if len(pprofAddr) != 0 {
+			go func() {
+				fatal("pprof endpoint failed", "address", pprofAddr, "error", servePprof(pprofAddr, pprofPublic))
+			}()
+		}
+		if len(apiAddr) != 0 {
+			go func() {
+				fatal("admin API failed", "address", apiAddr, "error", lnsync.ServeAPI(apiAddr, apiPublic, manager))
+			}()
+		}
+		if len(grpcAddr) != 0 {
+			go func() {
+				fatal("gRPC API failed", "address", grpcAddr, "error", lnsync.ServeGRPC(grpcAddr, grpcPublic, grpcConf, manager))
+			}()
+		}
+	}
+
+	err = serveSignals(handler, start)
+	if err != nil {
+		slog.Error("serve signals failed", "error", err)
+	}
+}
+
+// grpcTLS loads the certificate and key of the gRPC API, nil without them
+func grpcTLS(cert, key string) (*tls.Config, error) {
+	if len(cert) == 0 && len(key) == 0 {
+		return nil, nil
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}, nil
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	daemon "github.com/sevlyar/go-daemon"
+)
+
+// canDaemonize tells whether the daemon forks itself into the background
+const canDaemonize = true
+
+// Default paths of the pid file and control socket
+const (
+	defaultPidFile = "/var/run/lnsync.pid"
+	defaultControl = "/var/run/lnsync.sock"
+)
+
+func setUmask(mask int) {
+	syscall.Umask(mask)
+}
+
+// userSignals toggles pausing on SIGUSR2 and dumps statistics on SIGUSR1
+func userSignals(toggle, dump func()) {
+	daemon.SetSigHandler(func(sig os.Signal) error {
+		toggle()
+		return nil
+	}, syscall.SIGUSR2)
+	daemon.SetSigHandler(func(sig os.Signal) error {
+		dump()
+		return nil
+	}, syscall.SIGUSR1)
+}
+
+// serveSignals runs start, then dispatches signals to their handlers until
+// one stops the daemon
+func serveSignals(handler daemon.SignalHandlerFunc, start func()) error {
+	start()
+	return daemon.ServeSignals()
+}
+
+func stopDaemon(pidfile string) int {
+	return sendSignal(pidfile, syscall.SIGTERM)
+}
+
+func reloadDaemon(pidfile string) int {
+	return sendSignal(pidfile, syscall.SIGHUP)
+}
+
+func installService(args []string) int {
+	fmt.Fprintln(os.Stderr, "lnsync install: Windows only, use the systemd unit or an init script")
+	return 2
+}
+
+func removeService() int {
+	fmt.Fprintln(os.Stderr, "lnsync uninstall: Windows only")
+	return 2
+}
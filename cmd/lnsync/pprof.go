@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/svagner/lnsync/pkg/lnsync"
+)
+
+// servePprof serves the net/http/pprof profiles under /debug/pprof/. An
+// address without host listens on loopback, and other than loopback
+// addresses are refused unless public is set: profiles reveal paths and
+// memory contents of the daemon.
+func servePprof(addr string, public bool) error {
+	addr, err := lnsync.LoopbackAddr(addr, public, "-pprof-public")
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return http.ListenAndServe(addr, mux)
+}
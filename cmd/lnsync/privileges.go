@@ -0,0 +1,103 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// credentials are the ids the daemon switches to, -1 where unchanged
+type credentials struct {
+	uid, gid int
+	groups   []int
+}
+
+// lookupCredentials resolves the given user and group, either of which
+// may be empty, while the user database is still reachable. The group
+// defaults to the primary group of the user, and the supplementary groups
+// are those of the user. It returns nil without user and group.
+func lookupCredentials(name, group string) (*credentials, error) {
+	if len(name) == 0 && len(group) == 0 {
+		return nil, nil
+	}
+	uid, gid := -1, -1
+	groups := make([]int, 0)
+	if len(name) != 0 {
+		u, err := user.Lookup(name)
+		if err != nil {
+			if u, err = user.LookupId(name); err != nil {
+				return nil, errors.New("unknown user " + name)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+		ids, _ := u.GroupIds()
+		for _, id := range ids {
+			if n, err := strconv.Atoi(id); err == nil {
+				groups = append(groups, n)
+			}
+		}
+	}
+	if len(group) != 0 {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return nil, errors.New("unknown group " + group)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return &credentials{uid: uid, gid: gid, groups: groups}, nil
+}
+
+// dropPrivileges switches the daemon to the credentials, if any
+func dropPrivileges(cred *credentials) error {
+	if cred == nil {
+		return nil
+	}
+	uid, gid, groups := cred.uid, cred.gid, cred.groups
+	if os.Geteuid() != 0 {
+		return errors.New("dropping privileges requires starting as root")
+	}
+	// supplementary groups and the group go first, the user can no longer
+	// change them
+	if len(groups) == 0 {
+		groups = append(groups, gid)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return errors.New("setgroups: " + err.Error())
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return errors.New("setgid: " + err.Error())
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return errors.New("setuid: " + err.Error())
+		}
+	}
+	slog.Info("privileges dropped", "uid", os.Getuid(), "gid", os.Getgid())
+	return nil
+}
+
+// confine changes the root directory of the daemon to jail, if given, and
+// its working directory to workDir within it
+func confine(jail, workDir string) error {
+	if len(jail) != 0 {
+		if err := syscall.Chroot(jail); err != nil {
+			return errors.New("chroot " + jail + ": " + err.Error())
+		}
+		if len(workDir) == 0 {
+			workDir = "/"
+		}
+		slog.Info("confined to jail", "path", jail)
+	}
+	if len(workDir) == 0 {
+		return nil
+	}
+	return os.Chdir(workDir)
+}
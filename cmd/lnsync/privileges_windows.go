@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// credentials are not switched on Windows, run the service as the
+// account it should act as instead
+type credentials struct{}
+
+func lookupCredentials(name, group string) (*credentials, error) {
+	if len(name) != 0 || len(group) != 0 {
+		return nil, errors.New("-user and -group: " + errWindows.Error() + ", set the account of the service instead")
+	}
+	return nil, nil
+}
+
+func dropPrivileges(cred *credentials) error {
+	return nil
+}
+
+// confine changes the working directory to workDir, if given. There is
+// no chroot on Windows.
+func confine(jail, workDir string) error {
+	if len(jail) != 0 {
+		return errors.New("-chroot: " + errWindows.Error())
+	}
+	if len(workDir) == 0 {
+		return nil
+	}
+	return os.Chdir(workDir)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	daemon "github.com/sevlyar/go-daemon"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// canDaemonize tells whether the daemon forks itself into the background.
+// On Windows it runs as a service instead.
+const canDaemonize = false
+
+// errWindows is returned by the Unix only options
+var errWindows = errors.New("not supported on Windows")
+
+// serviceName is the name lnsync is installed under as a Windows service
+const serviceName = "lnsync"
+
+// Default paths of the pid file, log file and control socket
+var (
+	defaultPidFile = filepath.Join(programData(), "lnsync", "lnsync.pid")
+	defaultLogFile = filepath.Join(programData(), "lnsync", "lnsync.log")
+	defaultControl = filepath.Join(programData(), "lnsync", "lnsync.sock")
+)
+
+func init() {
+	commands = append(commands,
+		struct{ name, help string }{"install", "install lnsync as a Windows service started with the given options"},
+		struct{ name, help string }{"uninstall", "remove the Windows service"})
+}
+
+func programData() string {
+	if dir := os.Getenv("ProgramData"); len(dir) != 0 {
+		return dir
+	}
+	return `C:\ProgramData`
+}
+
+// launchdJob is false, there is no launchd on Windows
+func launchdJob() bool {
+	return false
+}
+
+// setUmask does nothing, Windows has no umask
+func setUmask(mask int) {}
+
+// userSignals does nothing, Windows has no SIGUSR1 and SIGUSR2: pause,
+// resume and stats are available through lnsync ctl
+func userSignals(toggle, dump func()) {}
+
+// serveSignals runs the service control loop when started by the service
+// control manager, and dispatches console signals otherwise. A service
+// reports itself as starting before start runs: the service control
+// manager gives up on a service not answering within 30 seconds, and the
+// initial reconciliation of a large tree takes longer.
+func serveSignals(handler daemon.SignalHandlerFunc, start func()) error {
+	if isService, err := svc.IsWindowsService(); err != nil || !isService {
+		start()
+		return daemon.ServeSignals()
+	}
+	return svc.Run(serviceName, &service{handler: handler, start: start})
+}
+
+// startHint is how long the service control manager is told to wait for
+// the next progress report while the service starts
+const startHint = 30 * time.Second
+
+// service translates service control requests into the signals the
+// daemon handles: stop and shutdown into SIGTERM, a parameter change into
+// SIGHUP
+type service struct {
+	handler daemon.SignalHandlerFunc
+	start   func()
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending, WaitHint: uint32(startHint / time.Millisecond)}
+	started := make(chan bool)
+	go func() {
+		s.start()
+		close(started)
+	}()
+	progress := time.NewTicker(startHint / 3)
+	for checkpoint := uint32(1); started != nil; checkpoint++ {
+		select {
+		case <-started:
+			started = nil
+		case <-progress.C:
+			status <- svc.Status{State: svc.StartPending, CheckPoint: checkpoint,
+				WaitHint: uint32(startHint / time.Millisecond)}
+		case req := <-requests:
+			if req.Cmd == svc.Interrogate {
+				status <- req.CurrentStatus
+			}
+		}
+	}
+	progress.Stop()
+
+	accepts := svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.ParamChange:
+			s.handler(syscall.SIGHUP)
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32(shutdownTimeout / time.Millisecond)}
+			s.handler(syscall.SIGTERM)
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// controlService sends a control request to the installed service
+func controlService(cmd svc.Cmd) int {
+	m, err := mgr.Connect()
+	if err != nil {
+		slog.Error("unable to connect to the service manager", "error", err)
+		return 1
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		slog.Error("unable to find the service", "service", serviceName, "error", err)
+		return 1
+	}
+	defer s.Close()
+	if _, err := s.Control(cmd); err != nil {
+		slog.Error("unable to control the service", "service", serviceName, "error", err)
+		return 1
+	}
+	return 0
+}
+
+func stopDaemon(pidfile string) int {
+	return controlService(svc.Stop)
+}
+
+func reloadDaemon(pidfile string) int {
+	return controlService(svc.ParamChange)
+}
+
+// installService registers lnsync as an automatically started service
+// running the daemon with args, and starts it
+func installService(args []string) int {
+	exe, err := os.Executable()
+	if err != nil {
+		slog.Error("unable to locate lnsync", "error", err)
+		return 1
+	}
+	if err := os.MkdirAll(filepath.Dir(defaultPidFile), 0755); err != nil {
+		slog.Error("unable to create the data directory", "error", err)
+		return 1
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		slog.Error("unable to connect to the service manager", "error", err)
+		return 1
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		slog.Error("service already installed", "service", serviceName)
+		return 1
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "lnsync",
+		Description: "Maintains link farms of the configured source directories",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"start"}, args...)...)
+	if err != nil {
+		slog.Error("unable to install the service", "service", serviceName, "error", err)
+		return 1
+	}
+	defer s.Close()
+	if err := s.Start(); err != nil {
+		slog.Error("service installed but not started", "service", serviceName, "error", err)
+		return 1
+	}
+	return 0
+}
+
+// removeService stops and deletes the service
+func removeService() int {
+	m, err := mgr.Connect()
+	if err != nil {
+		slog.Error("unable to connect to the service manager", "error", err)
+		return 1
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		slog.Error("unable to find the service", "service", serviceName, "error", err)
+		return 1
+	}
+	defer s.Close()
+	s.Control(svc.Stop)
+	if err := s.Delete(); err != nil {
+		slog.Error("unable to remove the service", "service", serviceName, "error", err)
+		return 1
+	}
+	return 0
+}
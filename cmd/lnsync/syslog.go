@@ -0,0 +1,92 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"log/syslog"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"daemon": syslog.LOG_DAEMON,
+	"user":   syslog.LOG_USER,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// syslogHandler formats every record without its time, which syslog adds
+// itself, and sends it with the severity matching the record level
+type syslogHandler struct {
+	w          *syslog.Writer
+	level      slog.Leveler
+	newHandler formatter
+	with       []func(slog.Handler) slog.Handler
+}
+
+func newSyslogHandler(facility, tag string, level slog.Leveler, newHandler formatter) (slog.Handler, error) {
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, errors.New("unknown syslog facility " + facility)
+	}
+	w, err := syslog.New(priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogHandler{w: w, level: level, newHandler: newHandler}, nil
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	handler := h.newHandler(&buf, &slog.HandlerOptions{
+		Level: h.level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	for _, with := range h.with {
+		handler = with(handler)
+	}
+	if err := handler.Handle(ctx, r); err != nil {
+		return err
+	}
+	line := buf.String()
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.w.Err(line)
+	case r.Level >= slog.LevelWarn:
+		return h.w.Warning(line)
+	case r.Level >= slog.LevelInfo:
+		return h.w.Info(line)
+	}
+	return h.w.Debug(line)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.extend(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return h.extend(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+func (h *syslogHandler) extend(with func(slog.Handler) slog.Handler) slog.Handler {
+	h2 := *h
+	h2.with = append(append([]func(slog.Handler) slog.Handler{}, h.with...), with)
+	return &h2
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+func newSyslogHandler(facility, tag string, level slog.Leveler, newHandler formatter) (slog.Handler, error) {
+	return nil, errors.New("syslog: " + errWindows.Error() + ", log to a file")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/svagner/lnsync/pkg/lnsync"
+)
+
+// sdNotify sends a state update such as READY=1 to the service manager.
+// It does nothing unless started by systemd with NOTIFY_SOCKET set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdog feeds the systemd watchdog configured with WatchdogSec= at half
+// its interval, but only while the event loop answers and all watchers
+// are healthy, so systemd restarts a stuck daemon
+func watchdog(m *lnsync.Manager) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) != 0 && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	for range time.Tick(interval) {
+		if !m.Ping(interval) {
+			slog.Warn("event loop not responding, skipping watchdog notification")
+			continue
+		}
+		if problems := m.Health(); len(problems) != 0 {
+			slog.Warn("unhealthy, skipping watchdog notification", "problems", problems)
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// stopTracing flushes the spans not exported yet, once tracing is set up
+var stopTracing = func(ctx context.Context) error { return nil }
+
+// setupTracing exports the spans of the event pipeline over OTLP/gRPC to
+// endpoint, for the given fraction of events
+func setupTracing(endpoint string, insecure bool, sample float64) error {
+	if sample < 0 || sample > 1 {
+		return errors.New("-trace-sample must be between 0 and 1")
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "lnsync"))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sample))),
+	)
+	otel.SetTracerProvider(provider)
+	stopTracing = provider.Shutdown
+	return nil
+}
@@ -0,0 +1,170 @@
+package lnsync
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// alertInterval is how often the alert thresholds are checked
+const alertInterval = 10 * time.Second
+
+// defaultErrorWindow is the window failed updates are counted in
+const defaultErrorWindow = 5 * time.Minute
+
+// Alert holds the thresholds which make the daemon degraded: more than
+// Errors failed updates within ErrorWindow, or updates waiting longer
+// than QueueAge in the queue. Crossing one is reported by Ready and sent
+// to the notifiers.
+type Alert struct {
+	Errors      int      `toml:"errors" json:"errors"`
+	ErrorWindow Duration `toml:"error_window" json:"error_window"`
+	QueueAge    Duration `toml:"queue_age" json:"queue_age"`
+}
+
+func (a *Alert) check() error {
+	if a.Errors < 0 {
+		return errors.New("alert: errors must not be negative")
+	}
+	if a.QueueAge.Duration < 0 {
+		return errors.New("alert: queue_age must not be negative")
+	}
+	if a.Errors == 0 && a.QueueAge.Duration == 0 {
+		return errors.New("alert: no errors or queue_age defined")
+	}
+	if a.ErrorWindow.Duration <= 0 {
+		a.ErrorWindow.Duration = defaultErrorWindow
+	}
+	return nil
+}
+
+// alertProblem is a crossed threshold: subject names it, detail gives the
+// numbers
+type alertProblem struct {
+	subject string
+	detail  string
+}
+
+// alerter checks the thresholds of one manager
+type alerter struct {
+	conf     *Alert
+	manager  *Manager
+	quit     chan bool
+	lock     sync.Mutex
+	failures []time.Time
+}
+
+var (
+	alertLock    sync.Mutex
+	alertRunning *alerter
+)
+
+// StartAlerts replaces the running alerter by one checking the thresholds
+// of conf on m, none when conf is nil
+func StartAlerts(m *Manager, conf *Alert) {
+	alertLock.Lock()
+	defer alertLock.Unlock()
+	if alertRunning != nil {
+		close(alertRunning.quit)
+		alertRunning = nil
+	}
+	if conf == nil || m == nil {
+		return
+	}
+	a := &alerter{conf: conf, manager: m, quit: make(chan bool)}
+	alertRunning = a
+	go a.run()
+}
+
+func runningAlerter() *alerter {
+	alertLock.Lock()
+	defer alertLock.Unlock()
+	return alertRunning
+}
+
+// observeFailure counts a failed update against the errors threshold
+func observeFailure() {
+	a := runningAlerter()
+	if a == nil || a.conf.Errors == 0 {
+		return
+	}
+	now := time.Now()
+	a.lock.Lock()
+	// only the newest Errors+1 failures decide whether there were too many
+	if len(a.failures) > a.conf.Errors {
+		a.failures = a.failures[1:]
+	}
+	a.failures = append(a.failures, now)
+	a.lock.Unlock()
+}
+
+// problems lists the thresholds crossed now
+func (a *alerter) problems() []alertProblem {
+	problems := make([]alertProblem, 0)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.conf.Errors != 0 {
+		window := a.conf.ErrorWindow.Duration
+		since := time.Now().Add(-window)
+		n := 0
+		for _, at := range a.failures {
+			if at.After(since) {
+				n++
+			}
+		}
+		if n > a.conf.Errors {
+			problems = append(problems, alertProblem{"too many failed updates",
+				"more than " + strconv.Itoa(a.conf.Errors) + " failed updates in the last " + window.String()})
+		}
+	}
+	if age := a.manager.QueueAge(); a.conf.QueueAge.Duration != 0 && age > a.conf.QueueAge.Duration {
+		problems = append(problems, alertProblem{"event queue behind",
+			"updates wait " + age.Round(time.Second).String() + " in the queue, more than " +
+				a.conf.QueueAge.Duration.String()})
+	}
+	return problems
+}
+
+// alertHealth lists the thresholds crossed by m for Ready
+func (m *Manager) alertHealth() []string {
+	a := runningAlerter()
+	if a == nil || a.manager != m {
+		return nil
+	}
+	problems := make([]string, 0)
+	for _, p := range a.problems() {
+		problems = append(problems, "degraded: "+p.detail)
+	}
+	return problems
+}
+
+// run checks the thresholds until quit is closed, logging and notifying
+// when one is crossed and logging when it is back below
+func (a *alerter) run() {
+	ticker := time.NewTicker(alertInterval)
+	defer ticker.Stop()
+	crossed := make(map[string]bool)
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.quit:
+			return
+		}
+		current := make(map[string]bool)
+		for _, p := range a.problems() {
+			current[p.subject] = true
+			if !crossed[p.subject] {
+				slog.Warn("alert threshold crossed", "alert", p.subject, "detail", p.detail)
+				notify(p.subject, p.detail)
+			}
+		}
+		for subject := range crossed {
+			if !current[subject] {
+				slog.Info("alert cleared", "alert", subject)
+			}
+		}
+		crossed = current
+	}
+}
@@ -0,0 +1,388 @@
+package lnsync
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// errNotFound marks edits of a mapping or source which does not exist
+var errNotFound = errors.New("not found")
+
+// errBadToken and errNoToken refuse requests to the admin and gRPC APIs
+// without the api_token of the config file
+var (
+	errBadToken = errors.New("missing or wrong api token")
+	errNoToken  = errors.New("no api_token configured, changes are refused")
+)
+
+// ServeAPI runs the admin HTTP API, which changes the mappings of the
+// running daemon. Changes last until the next reload re-reads the
+// configuration.
+//
+//	GET    /v1/mappings                   list mappings
+//	POST   /v1/mappings                   add a mapping
+//	GET    /v1/mappings/<name>            show a mapping
+//	DELETE /v1/mappings/<name>            remove a mapping
+//	POST   /v1/mappings/<name>/sources    add a source, {"path": "..."}
+//	DELETE /v1/mappings/<name>/sources    remove a source, ?path=...
+//	POST   /v1/rescan                     reconcile, ?mapping=... for one
+//	POST   /v1/pause                      hold back changes
+//	POST   /v1/resume                     apply the held back changes
+//	GET    /v1/status                     daemon status
+//	GET    /v1/links                      managed links, ?mapping=... for one
+//
+// An address without host listens on loopback, and other than loopback
+// addresses are refused unless public is set. Requests changing anything
+// must carry the api_token of the config file as bearer token, and once
+// a token is configured every other request as well.
+func ServeAPI(addr string, public bool, m *Manager) error {
+	addr, err := LoopbackAddr(addr, public, "-api-public")
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/mappings", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, m.Config().Mappings)
+		case http.MethodPost:
+			// policies such as the link mode or what happens to entries
+			// in the way stay with the config file, a mapping added here
+			// takes their defaults
+			var req struct {
+				Name        string   `json:"name"`
+				Sources     []string `json:"sources"`
+				Destination string   `json:"destination"`
+			}
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			mapping := Mapping{Name: req.Name, Sources: req.Sources, Destination: req.Destination}
+			if err := m.AddMapping(mapping); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, m.mapping(mapping.Name))
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+	})
+	mux.HandleFunc("/v1/mappings/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/v1/mappings/")
+		sources := false
+		if strings.HasSuffix(name, "/sources") {
+			name, sources = strings.TrimSuffix(name, "/sources"), true
+		}
+		var err error
+		switch {
+		case !sources && r.Method == http.MethodGet:
+			if mapping := m.mapping(name); mapping != nil {
+				writeJSON(w, http.StatusOK, mapping)
+				return
+			}
+			err = errNotFound
+		case !sources && r.Method == http.MethodDelete:
+			err = m.RemoveMapping(name)
+		case sources && r.Method == http.MethodPost:
+			var req struct {
+				Path string `json:"path"`
+			}
+			if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+				err = m.AddSource(name, req.Path)
+			}
+		case sources && r.Method == http.MethodDelete:
+			err = m.RemoveSource(name, r.URL.Query().Get("path"))
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		if err != nil {
+			writeError(w, apiStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, m.mapping(name))
+	})
+	mux.HandleFunc("/v1/rescan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		if err := m.Rescan(r.URL.Query().Get("mapping")); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"rescanned": true})
+	})
+	mux.HandleFunc("/v1/pause", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		m.Pause()
+		writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+	})
+	mux.HandleFunc("/v1/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"applied": m.Resume()})
+	})
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.Status())
+	})
+	mux.HandleFunc("/v1/links", func(w http.ResponseWriter, r *http.Request) {
+		links, err := m.Links(r.URL.Query().Get("mapping"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, links)
+	})
+	return http.ListenAndServe(addr, m.requireToken(mux))
+}
+
+// LoopbackAddr resolves the listen address of an endpoint which must not
+// be reachable from the network by accident: an address without host
+// listens on loopback, and other than loopback addresses are refused
+// unless public is set. flag names the option allowing them.
+func LoopbackAddr(addr string, public bool, flag string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if len(host) == 0 {
+		host = "127.0.0.1"
+	}
+	if !public && !isLoopback(host) {
+		return "", errors.New("not a loopback address, add " + flag + " to allow it")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireToken passes on the requests carrying the api token as bearer
+// token, and without a token configured those only reading
+func (m *Manager) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			token = ""
+		}
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if err := m.checkToken(token, readOnly); err != nil {
+			code := http.StatusUnauthorized
+			if errors.Is(err, errNoToken) {
+				code = http.StatusForbidden
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lnsync"`)
+			writeError(w, code, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkToken compares the token presented by a client with the api_token
+// of the configuration being served. Without one only reads are allowed.
+func (m *Manager) checkToken(token string, readOnly bool) error {
+	m.lock.Lock()
+	want := ""
+	if m.conf != nil {
+		want = m.conf.APIToken
+	}
+	m.lock.Unlock()
+	if len(want) == 0 {
+		if readOnly {
+			return nil
+		}
+		return errNoToken
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		return errBadToken
+	}
+	return nil
+}
+
+func apiStatus(err error) int {
+	if errors.Is(err, errNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// Config returns a copy of the configuration being served
+func (m *Manager) Config() *Config {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return copyConfig(m.conf)
+}
+
+func (m *Manager) mapping(name string) *Mapping {
+	return findMapping(m.Config(), name)
+}
+
+// AddMapping starts serving a new mapping
+func (m *Manager) AddMapping(mapping Mapping) error {
+	if len(mapping.Name) == 0 {
+		return errors.New("mapping has no name")
+	}
+	return m.edit(func(conf *Config) error {
+		for _, other := range conf.Mappings {
+			if other.Name == mapping.Name {
+				return errors.New("mapping <" + mapping.Name + "> already exists")
+			}
+		}
+		if err := mapping.Check(); err != nil {
+			return err
+		}
+		conf.Mappings = append(conf.Mappings, mapping)
+		slog.Info("mapping added", "mapping", mapping.Name, "destination", mapping.Destination)
+		return nil
+	})
+}
+
+// RemoveMapping stops serving a mapping. Its links are left in place.
+func (m *Manager) RemoveMapping(name string) error {
+	return m.edit(func(conf *Config) error {
+		for idx := range conf.Mappings {
+			if conf.Mappings[idx].Name == name {
+				conf.Mappings = append(conf.Mappings[:idx], conf.Mappings[idx+1:]...)
+				slog.Info("mapping removed", "mapping", name)
+				return nil
+			}
+		}
+		return errNotFound
+	})
+}
+
+// AddSource adds a source directory to a mapping
+func (m *Manager) AddSource(name, src string) error {
+	if len(src) == 0 {
+		return errors.New("no source path given")
+	}
+	return m.edit(func(conf *Config) error {
+		mapping := findMapping(conf, name)
+		if mapping == nil {
+			return errNotFound
+		}
+		for _, other := range mapping.Sources {
+			if samePath(other, src) {
+				return errors.New("mapping <" + name + ">: source " + src + " already exists")
+			}
+		}
+		mapping.Sources = append(mapping.Sources, src)
+		if err := mapping.Check(); err != nil {
+			return err
+		}
+		slog.Info("source added", "mapping", name, "source", src)
+		return nil
+	})
+}
+
+// RemoveSource removes a source directory from a mapping. Links to its
+// files are left in place.
+func (m *Manager) RemoveSource(name, src string) error {
+	return m.edit(func(conf *Config) error {
+		mapping := findMapping(conf, name)
+		if mapping == nil {
+			return errNotFound
+		}
+		for idx, other := range mapping.Sources {
+			if samePath(other, src) {
+				if len(mapping.Sources) == 1 {
+					return errors.New("mapping <" + name + ">: cannot remove the last source")
+				}
+				mapping.Sources = append(mapping.Sources[:idx], mapping.Sources[idx+1:]...)
+				slog.Info("source removed", "mapping", name, "source", src)
+				return nil
+			}
+		}
+		return errNotFound
+	})
+}
+
+// edit applies a change to a copy of the configuration being served
+func (m *Manager) edit(change func(conf *Config) error) error {
+	m.applyLock.Lock()
+	defer m.applyLock.Unlock()
+	conf := m.Config()
+	if err := change(conf); err != nil {
+		return err
+	}
+	if err := conf.CheckLoops(); err != nil {
+		return err
+	}
+	return m.apply(conf)
+}
+
+func findMapping(conf *Config, name string) *Mapping {
+	for idx := range conf.Mappings {
+		if conf.Mappings[idx].Name == name {
+			return &conf.Mappings[idx]
+		}
+	}
+	return nil
+}
+
+// copyConfig returns a copy of conf sharing none of its slices, maps and
+// tables
+func copyConfig(conf *Config) *Config {
+	if conf == nil {
+		return &Config{Mappings: make([]Mapping, 0)}
+	}
+	c := *conf
+	c.Mappings = make([]Mapping, 0, len(conf.Mappings))
+	for _, mapping := range conf.Mappings {
+		c.Mappings = append(c.Mappings, mapping.clone())
+	}
+	c.Webhooks = slices.Clone(conf.Webhooks)
+	for idx := range c.Webhooks {
+		c.Webhooks[idx].Mappings = slices.Clone(c.Webhooks[idx].Mappings)
+	}
+	c.Hooks = slices.Clone(conf.Hooks)
+	for idx := range c.Hooks {
+		c.Hooks[idx].Mappings = slices.Clone(c.Hooks[idx].Mappings)
+	}
+	if conf.Statsd != nil {
+		statsd := *conf.Statsd
+		statsd.Tags = maps.Clone(statsd.Tags)
+		c.Statsd = &statsd
+	}
+	c.Notifiers = slices.Clone(conf.Notifiers)
+	for idx := range c.Notifiers {
+		c.Notifiers[idx].To = slices.Clone(c.Notifiers[idx].To)
+	}
+	if conf.Alert != nil {
+		alert := *conf.Alert
+		c.Alert = &alert
+	}
+	return &c
+}
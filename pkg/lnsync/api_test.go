@@ -0,0 +1,70 @@
+package lnsync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+		want   string
+		valid  bool
+	}{
+		{":9102", false, "127.0.0.1:9102", true},
+		{"127.0.0.1:9102", false, "127.0.0.1:9102", true},
+		{"localhost:9102", false, "localhost:9102", true},
+		{"[::1]:9102", false, "[::1]:9102", true},
+		{"0.0.0.0:9102", false, "", false},
+		{"192.0.2.1:9102", false, "", false},
+		{"0.0.0.0:9102", true, "0.0.0.0:9102", true},
+		{"9102", false, "", false},
+	}
+	for _, tt := range tests {
+		got, err := LoopbackAddr(tt.addr, tt.public, "-api-public")
+		if (err == nil) != tt.valid {
+			t.Errorf("LoopbackAddr(%q, %v) error = %v, want valid %v", tt.addr, tt.public, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("LoopbackAddr(%q, %v) = %q, want %q", tt.addr, tt.public, got, tt.want)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		auth   string
+		want   int
+	}{
+		{"read without token configured", "", http.MethodGet, "", http.StatusOK},
+		{"change without token configured", "", http.MethodPost, "Bearer x", http.StatusForbidden},
+		{"read without bearer", "s3cret", http.MethodGet, "", http.StatusUnauthorized},
+		{"read with token", "s3cret", http.MethodGet, "Bearer s3cret", http.StatusOK},
+		{"change without bearer", "s3cret", http.MethodDelete, "", http.StatusUnauthorized},
+		{"change with wrong token", "s3cret", http.MethodPost, "Bearer s3cre", http.StatusUnauthorized},
+		{"change with token", "s3cret", http.MethodPost, "Bearer s3cret", http.StatusOK},
+		{"token without scheme", "s3cret", http.MethodPost, "s3cret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Manager{conf: &Config{APIToken: tt.token}}
+			handler := m.requireToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(tt.method, "/v1/mappings", strings.NewReader("{}"))
+			if len(tt.auth) != 0 {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s with %q = %d, want %d", tt.method, tt.auth, rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+//go:build dragonfly || freebsd || netbsd || openbsd || (darwin && !cgo)
+
+package lnsync
+
+// DefaultBackend is the backend of mappings which do not choose one:
+// kqueue within a descriptor budget, on macOS when built without the cgo
+// FSEvents needs
+const DefaultBackend = BackendKqueue
@@ -0,0 +1,6 @@
+//go:build !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package lnsync
+
+// DefaultBackend is the backend of mappings which do not choose one
+const DefaultBackend = BackendInotify
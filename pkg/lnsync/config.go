@@ -0,0 +1,554 @@
+package lnsync
+
+import (
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Link types created in the destination
+const (
+	LinkSymbolic = "symlink"
+	LinkHard     = "hard"
+	LinkCopy     = "copy"
+)
+
+// Symlink target styles
+const (
+	LinkAbsolute = "absolute"
+	LinkRelative = "relative"
+)
+
+// Policies for equally named files in several sources of a mapping
+const (
+	CollisionFail     = "fail"
+	CollisionFirst    = "first-wins"
+	CollisionNewest   = "newest-mtime-wins"
+	CollisionPriority = "priority"
+	CollisionPrefix   = "prefix-with-source-name"
+)
+
+// Backends noticing changes in the sources
+const (
+	BackendInotify  = "inotify"
+	BackendPoll     = "poll"
+	BackendFanotify = "fanotify"
+	BackendFSEvents = "fsevents"
+	BackendKqueue   = "kqueue"
+)
+
+// backendUnsupported returns why the backend does not run on this
+// platform, nil when it does
+func backendUnsupported(backend string) error {
+	switch backend {
+	case BackendFanotify:
+		return errNoFanotify
+	case BackendFSEvents:
+		return errNoFSEvents
+	case BackendKqueue:
+		return errNoKqueue
+	}
+	return nil
+}
+
+// Layouts of the destination, grouping links in subdirectories
+const (
+	LayoutFlat      = "flat"
+	LayoutDate      = "date"
+	LayoutExtension = "extension"
+	LayoutHash      = "hash"
+)
+
+// Content addressed link names, the hash alone or followed by the
+// extension or the name of the file
+const (
+	ContentNamesHash = "hash"
+	ContentNamesExt  = "hash-ext"
+	ContentNamesName = "hash-name"
+)
+
+// Unicode normalization forms of link names
+const (
+	NormalizeNFC = "nfc"
+	NormalizeNFD = "nfd"
+)
+
+// Config describes every link farm served by one daemon
+type Config struct {
+	Workers     int        `toml:"workers"`
+	Umask       string     `toml:"umask"`
+	PidFileMode string     `toml:"pid_file_mode"`
+	LogFileMode string     `toml:"log_file_mode"`
+	APIToken    string     `toml:"api_token"`
+	Mappings    []Mapping  `toml:"mapping"`
+	Webhooks    []Webhook  `toml:"webhook"`
+	Hooks       []Hook     `toml:"hook"`
+	Statsd      *Statsd    `toml:"statsd"`
+	Notifiers   []Notifier `toml:"notify"`
+	Alert       *Alert     `toml:"alert"`
+}
+
+// configFile is the config file as written: every mapping starts out as
+// the [defaults] table and overrides what it sets itself
+type configFile struct {
+	Workers     int              `toml:"workers"`
+	Umask       string           `toml:"umask"`
+	PidFileMode string           `toml:"pid_file_mode"`
+	LogFileMode string           `toml:"log_file_mode"`
+	APIToken    string           `toml:"api_token"`
+	Defaults    Mapping          `toml:"defaults"`
+	Mappings    []toml.Primitive `toml:"mapping"`
+	Webhooks    []Webhook        `toml:"webhook"`
+	Hooks       []Hook           `toml:"hook"`
+	Statsd      *Statsd          `toml:"statsd"`
+	Notifiers   []Notifier       `toml:"notify"`
+	Alert       *Alert           `toml:"alert"`
+}
+
+// Mapping is a single set of source directories aggregated into one
+// destination directory
+type Mapping struct {
+	Name          string              `toml:"name" json:"name"`
+	Sources       []string            `toml:"sources" json:"sources"`
+	Destination   string              `toml:"destination" json:"destination"`
+	Destinations  []string            `toml:"destinations" json:"destinations,omitempty"`
+	WatchParent   bool                `toml:"watch_parent" json:"watch_parent"`
+	Recursive     bool                `toml:"recursive" json:"recursive"`
+	LinkMode      string              `toml:"link_mode" json:"link_mode"`
+	Include       []string            `toml:"include" json:"include,omitempty"`
+	Exclude       []string            `toml:"exclude" json:"exclude,omitempty"`
+	Collision     string              `toml:"collision" json:"collision"`
+	LinkStyle     string              `toml:"link_style" json:"link_style"`
+	MirrorTree    bool                `toml:"mirror_tree" json:"mirror_tree"`
+	Debounce      Duration            `toml:"debounce" json:"debounce"`
+	Settle        Duration            `toml:"settle" json:"settle"`
+	AdoptExisting bool                `toml:"adopt_existing" json:"adopt_existing"`
+	Backend       string              `toml:"backend" json:"backend"`
+	PollInterval  Duration            `toml:"poll_interval" json:"poll_interval"`
+	KqueueBudget  int                 `toml:"kqueue_budget" json:"kqueue_budget"`
+	StatsdTags    map[string]string   `toml:"statsd_tags" json:"statsd_tags,omitempty"`
+	Tamper        string              `toml:"tamper" json:"tamper,omitempty"`
+	Existing      string              `toml:"existing" json:"existing"`
+	Durable       bool                `toml:"durable" json:"durable"`
+	CreateDest    bool                `toml:"create_destination" json:"create_destination"`
+	DestMode      string              `toml:"destination_mode" json:"destination_mode,omitempty"`
+	DestOwner     string              `toml:"destination_owner" json:"destination_owner,omitempty"`
+	LinkOwner     string              `toml:"link_owner" json:"link_owner,omitempty"`
+	DestPerms     string              `toml:"destination_permissions" json:"destination_permissions,omitempty"`
+	Normalize     string              `toml:"normalize" json:"normalize,omitempty"`
+	SkipHidden    bool                `toml:"skip_hidden" json:"skip_hidden"`
+	LinkTempFiles bool                `toml:"link_temp_files" json:"link_temp_files"`
+	IgnoreFile    string              `toml:"ignore_file" json:"ignore_file,omitempty"`
+	Extensions    []string            `toml:"extensions" json:"extensions,omitempty"`
+	MinSize       Size                `toml:"min_size" json:"min_size"`
+	MaxSize       Size                `toml:"max_size" json:"max_size"`
+	ContentTypes  []string            `toml:"content_types" json:"content_types,omitempty"`
+	LinkSpecial   bool                `toml:"link_special" json:"link_special"`
+	LinkDirs      bool                `toml:"link_dirs" json:"link_dirs"`
+	SourceLinks   string              `toml:"source_symlinks" json:"source_symlinks"`
+	BrokenLinks   string              `toml:"broken_symlinks" json:"broken_symlinks"`
+	SourceRemoved string              `toml:"source_removed" json:"source_removed"`
+	QuarantineDir string              `toml:"quarantine_dir" json:"quarantine_dir,omitempty"`
+	Reattach      Duration            `toml:"reattach_interval" json:"reattach_interval"`
+	NameTemplate  string              `toml:"name_template" json:"name_template,omitempty"`
+	Rename        []RenameRule        `toml:"rename" json:"rename,omitempty"`
+	Lowercase     bool                `toml:"lowercase" json:"lowercase"`
+	SourceSubdirs bool                `toml:"source_subdirs" json:"source_subdirs"`
+	Layout        string              `toml:"layout" json:"layout"`
+	LayoutGroups  map[string][]string `toml:"layout_groups" json:"layout_groups,omitempty"`
+	ShardChars    int                 `toml:"shard_chars" json:"shard_chars,omitempty"`
+	ContentNames  string              `toml:"content_names" json:"content_names,omitempty"`
+	Manifest      string              `toml:"manifest" json:"manifest,omitempty"`
+	Workers       int                 `toml:"workers" json:"workers,omitempty"`
+}
+
+// Duration is a time.Duration written as "200ms" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Size is a file size written as "512", "10K" or "1.5G" in the config
+// file, in powers of 1024
+type Size int64
+
+var sizeUnits = map[byte]float64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+
+func (s *Size) UnmarshalText(text []byte) error {
+	value := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(string(text))), "B")
+	unit := 1.0
+	if len(value) != 0 {
+		if mult, ok := sizeUnits[value[len(value)-1]]; ok {
+			unit, value = mult, value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return errors.New("invalid size " + string(text))
+	}
+	*s = Size(n * unit)
+	return nil
+}
+
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(s), 10)), nil
+}
+
+// ParseFileMode parses the permissions of the umask, the pid file or the
+// log file, written in octal, e.g. 0640. Set-id and sticky bits are
+// refused.
+func ParseFileMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, errors.New("invalid mode " + mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// LoadConfig reads and validates a TOML config file
+func LoadConfig(file string) (*Config, error) {
+	var raw configFile
+	md, err := toml.DecodeFile(file, &raw)
+	if err != nil {
+		return nil, err
+	}
+	conf := Config{Workers: raw.Workers, Umask: raw.Umask, PidFileMode: raw.PidFileMode, LogFileMode: raw.LogFileMode,
+		APIToken: raw.APIToken, Webhooks: raw.Webhooks, Hooks: raw.Hooks, Statsd: raw.Statsd, Notifiers: raw.Notifiers, Alert: raw.Alert}
+	for _, prim := range raw.Mappings {
+		m := raw.Defaults.defaults()
+		if err := md.PrimitiveDecode(prim, &m); err != nil {
+			return nil, err
+		}
+		conf.Mappings = append(conf.Mappings, m)
+	}
+	if conf.Workers < 0 {
+		return nil, errors.New("workers must not be negative in " + file)
+	}
+	for key, mode := range map[string]string{"umask": conf.Umask, "pid_file_mode": conf.PidFileMode,
+		"log_file_mode": conf.LogFileMode} {
+		if len(mode) == 0 {
+			continue
+		}
+		if _, err := ParseFileMode(mode); err != nil {
+			return nil, errors.New(key + ": " + err.Error() + " in " + file)
+		}
+	}
+	if len(conf.Mappings) == 0 {
+		return nil, errors.New("no mappings defined in " + file)
+	}
+	for idx := range conf.Mappings {
+		if err := conf.Mappings[idx].Check(); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.CheckLoops(); err != nil {
+		return nil, err
+	}
+	for idx := range conf.Webhooks {
+		if err := conf.Webhooks[idx].check(); err != nil {
+			return nil, err
+		}
+	}
+	for idx := range conf.Hooks {
+		if err := conf.Hooks[idx].check(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Statsd != nil {
+		if err := conf.Statsd.check(); err != nil {
+			return nil, err
+		}
+	}
+	for idx := range conf.Notifiers {
+		if err := conf.Notifiers[idx].check(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Alert != nil {
+		if err := conf.Alert.check(); err != nil {
+			return nil, err
+		}
+	}
+	return &conf, nil
+}
+
+// clone returns a copy of the mapping sharing none of its slices and maps
+func (m Mapping) clone() Mapping {
+	m.Sources = slices.Clone(m.Sources)
+	m.Destinations = slices.Clone(m.Destinations)
+	m.Include = slices.Clone(m.Include)
+	m.Exclude = slices.Clone(m.Exclude)
+	m.Extensions = slices.Clone(m.Extensions)
+	m.ContentTypes = slices.Clone(m.ContentTypes)
+	m.Rename = slices.Clone(m.Rename)
+	if m.LayoutGroups != nil {
+		groups := make(map[string][]string, len(m.LayoutGroups))
+		for dir, exts := range m.LayoutGroups {
+			groups[dir] = slices.Clone(exts)
+		}
+		m.LayoutGroups = groups
+	}
+	m.StatsdTags = maps.Clone(m.StatsdTags)
+	return m
+}
+
+// defaults returns a copy of the mapping to start a mapping of the config
+// file from. What names a mapping and where it links is never inherited,
+// and nothing is shared, as decoding fills slices and maps in place.
+func (m Mapping) defaults() Mapping {
+	m = m.clone()
+	m.Name, m.Sources, m.Destination, m.Destinations = "", nil, "", nil
+	return m
+}
+
+// Check fills in the defaults of the mapping and validates it
+func (m *Mapping) Check() error {
+	if len(m.Destination) == 0 && len(m.Destinations) != 0 {
+		m.Destination = m.Destinations[0]
+	}
+	if len(m.Name) == 0 {
+		m.Name = m.Destination
+	}
+	if len(m.Sources) == 0 {
+		return errors.New("mapping <" + m.Name + ">: no sources defined")
+	}
+	if len(m.Destination) == 0 {
+		return errors.New("mapping <" + m.Name + ">: no destination defined")
+	}
+	if m.MirrorTree {
+		m.Recursive = true
+	}
+	switch m.LinkMode {
+	case "":
+		m.LinkMode = LinkSymbolic
+	case LinkSymbolic, LinkHard, LinkCopy:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown link mode " + m.LinkMode)
+	}
+	if m.LinkDirs && m.Recursive {
+		return errors.New("mapping <" + m.Name + ">: link_dirs links the subdirectories of a source, not their files, and excludes recursive")
+	}
+	if m.LinkDirs && m.LinkMode != LinkSymbolic {
+		return errors.New("mapping <" + m.Name + ">: link_dirs requires symlinks")
+	}
+	switch m.LinkStyle {
+	case "":
+		m.LinkStyle = LinkAbsolute
+	case LinkAbsolute, LinkRelative:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown link style " + m.LinkStyle)
+	}
+	switch m.Collision {
+	case "":
+		m.Collision = CollisionFirst
+	case CollisionFail, CollisionFirst, CollisionNewest, CollisionPriority, CollisionPrefix:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown collision policy " + m.Collision)
+	}
+	switch m.Backend {
+	case "":
+		m.Backend = DefaultBackend
+	case BackendInotify, BackendPoll:
+	case BackendFanotify, BackendFSEvents, BackendKqueue:
+		// the watcher of an unsupported backend would only fail and restart
+		if err := backendUnsupported(m.Backend); err != nil {
+			return errors.New("mapping <" + m.Name + ">: " + err.Error())
+		}
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown backend " + m.Backend)
+	}
+	switch m.Existing {
+	case "":
+		m.Existing = ExistingSkip
+	case ExistingSkip, ExistingOverwrite, ExistingBackup, ExistingFail:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown existing entry policy " + m.Existing)
+	}
+	switch m.SourceLinks {
+	case "":
+		m.SourceLinks = SourceLinksKeep
+	case SourceLinksKeep, SourceLinksResolve:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown source symlink treatment " + m.SourceLinks)
+	}
+	switch m.Layout {
+	case "":
+		m.Layout = LayoutFlat
+	case LayoutFlat, LayoutDate, LayoutExtension, LayoutHash:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown layout " + m.Layout)
+	}
+	if m.Layout == LayoutHash {
+		if m.ShardChars == 0 {
+			m.ShardChars = defaultShardChars
+		}
+		if m.ShardChars < 1 || m.ShardChars > 16 {
+			return errors.New("mapping <" + m.Name + ">: shard_chars must be between 1 and 16")
+		}
+	}
+	if m.Workers < 0 {
+		return errors.New("mapping <" + m.Name + ">: workers must not be negative")
+	}
+	if m.KqueueBudget < 0 {
+		return errors.New("mapping <" + m.Name + ">: kqueue budget must not be negative")
+	}
+	for group, exts := range m.LayoutGroups {
+		if len(group) == 0 || strings.ContainsAny(group, "/") || group == "." || group == ".." {
+			return errors.New("mapping <" + m.Name + ">: invalid layout group " + group)
+		}
+		for idx, ext := range exts {
+			exts[idx] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+			if len(exts[idx]) == 0 || strings.Contains(exts[idx], "/") {
+				return errors.New("mapping <" + m.Name + ">: invalid extension " + ext + " in layout group " + group)
+			}
+		}
+	}
+	switch m.ContentNames {
+	case "", ContentNamesHash, ContentNamesExt, ContentNamesName:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown content name mode " + m.ContentNames)
+	}
+	switch m.Manifest {
+	case "", ManifestJSON, ManifestTSV:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown manifest format " + m.Manifest)
+	}
+	switch m.BrokenLinks {
+	case "":
+		m.BrokenLinks = BrokenSkip
+	case BrokenSkip, BrokenMirror, BrokenRecheck:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown broken symlink policy " + m.BrokenLinks)
+	}
+	if m.Reattach.Duration == 0 {
+		m.Reattach.Duration = defaultReattachInterval
+	}
+	switch m.SourceRemoved {
+	case "":
+		m.SourceRemoved = SourceRemovedRemove
+	case SourceRemovedRemove, SourceRemovedKeep:
+	case SourceRemovedQuarantine:
+		if len(m.QuarantineDir) == 0 {
+			return errors.New("mapping <" + m.Name + ">: source_removed = quarantine needs a quarantine_dir")
+		}
+		m.QuarantineDir = filepath.Clean(m.QuarantineDir)
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown removed source policy " + m.SourceRemoved)
+	}
+	switch m.Normalize {
+	case "", NormalizeNFC, NormalizeNFD:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown normalization form " + m.Normalize)
+	}
+	switch m.Tamper {
+	case "", TamperRepair, TamperAlert:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown tamper policy " + m.Tamper)
+	}
+	for idx, ext := range m.Extensions {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if len(ext) == 0 || strings.Contains(ext, "/") {
+			return errors.New("mapping <" + m.Name + ">: invalid extension " + m.Extensions[idx])
+		}
+		m.Extensions[idx] = ext
+	}
+	if m.MaxSize != 0 && m.MaxSize < m.MinSize {
+		return errors.New("mapping <" + m.Name + ">: max_size is below min_size")
+	}
+	for _, rule := range m.Rename {
+		if _, err := compileRename(rule.Match); err != nil {
+			return errors.New("mapping <" + m.Name + ">: rename: " + err.Error())
+		}
+	}
+	if len(m.NameTemplate) != 0 {
+		if err := checkNameTemplate(m.NameTemplate); err != nil {
+			return errors.New("mapping <" + m.Name + ">: name_template: " + err.Error())
+		}
+	}
+	if err := checkPatterns(m.ContentTypes); err != nil {
+		return errors.New("mapping <" + m.Name + ">: content_types: " + err.Error())
+	}
+	if err := checkPatterns(m.Include); err != nil {
+		return errors.New("mapping <" + m.Name + ">: include: " + err.Error())
+	}
+	if err := checkPatterns(m.Exclude); err != nil {
+		return errors.New("mapping <" + m.Name + ">: exclude: " + err.Error())
+	}
+	if len(m.IgnoreFile) != 0 {
+		if _, err := readIgnore(m.IgnoreFile); err != nil {
+			return errors.New("mapping <" + m.Name + ">: ignore_file: " + err.Error())
+		}
+	}
+	if _, err := destMode(m.DestMode); err != nil {
+		return errors.New("mapping <" + m.Name + ">: destination_mode: " + err.Error())
+	}
+	if len(m.DestOwner) != 0 {
+		if _, _, err := lookupOwner(m.DestOwner); err != nil {
+			return errors.New("mapping <" + m.Name + ">: destination_owner: " + err.Error())
+		}
+	}
+	switch m.DestPerms {
+	case "", DestPermsRepair, DestPermsAlert, DestPermsRefuse:
+	default:
+		return errors.New("mapping <" + m.Name + ">: unknown destination permission policy " + m.DestPerms)
+	}
+	if len(m.LinkOwner) != 0 && m.LinkOwner != LinkOwnerSource {
+		if _, _, err := lookupOwner(m.LinkOwner); err != nil {
+			return errors.New("mapping <" + m.Name + ">: link_owner: " + err.Error())
+		}
+	}
+	m.Destination = filepath.Clean(m.Destination)
+	// Destinations lists every destination, Destination first, or is left
+	// empty if there is only the one
+	dests := []string{m.Destination}
+	for _, dest := range m.Destinations {
+		dest = filepath.Clean(dest)
+		if len(dest) != 0 && !slices.Contains(dests, dest) {
+			dests = append(dests, dest)
+		}
+	}
+	m.Destinations = nil
+	if len(dests) > 1 {
+		m.Destinations = dests
+	}
+	for idx, src := range m.Sources {
+		m.Sources[idx] = filepath.Clean(src)
+		if _, err := filepath.Match(m.Sources[idx], ""); err != nil {
+			return errors.New("mapping <" + m.Name + ">: invalid source pattern " + src)
+		}
+	}
+	for _, dest := range dests {
+		// a destination yet to be created ends up on the filesystem of its
+		// closest existing parent
+		device := dest
+		for m.CreateDest && device != filepath.Dir(device) {
+			if _, err := os.Stat(device); err == nil {
+				break
+			}
+			device = filepath.Dir(device)
+		}
+		for _, src := range m.Sources {
+			if m.LinkMode == LinkHard && !sameDevice(globBase(src), device) {
+				slog.Warn("hardlinks require the same filesystem, symlinks will be created instead",
+					"mapping", m.Name, "source", src, "destination", dest)
+			}
+		}
+	}
+	return m.checkNesting()
+}
@@ -0,0 +1,98 @@
+package lnsync
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		mode  string
+		want  os.FileMode
+		valid bool
+	}{
+		{"0640", 0640, true},
+		{"640", 0640, true},
+		{"027", 027, true},
+		{"0", 0, true},
+		{"0777", 0777, true},
+		{"01077", 0, false},
+		{"2640", 0, false},
+		{"0800", 0, false},
+		{"rw-r-----", 0, false},
+		{"-1", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseFileMode(tt.mode)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseFileMode(%q) error = %v, want valid %v", tt.mode, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseFileMode(%q) = %04o, want %04o", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigModes(t *testing.T) {
+	tests := []struct {
+		name  string
+		modes string
+		valid bool
+	}{
+		{"unset", "", true},
+		{"all set", "umask = \"077\"\npid_file_mode = \"0600\"\nlog_file_mode = \"0600\"\n", true},
+		{"sticky umask", "umask = \"01077\"\n", false},
+		{"setgid pid file", "pid_file_mode = \"2640\"\n", false},
+		{"not octal", "log_file_mode = \"0648\"\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+			for _, d := range []string{src, dest} {
+				if err := os.Mkdir(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			file := filepath.Join(dir, "lnsync.toml")
+			conf := tt.modes + "\n[[mapping]]\nsources = [\"" + src + "\"]\ndestination = \"" + dest + "\"\n"
+			if err := os.WriteFile(file, []byte(conf), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConfig(file)
+			if (err == nil) != tt.valid {
+				t.Fatalf("LoadConfig() = %v, want valid %v", err, tt.valid)
+			}
+			if err != nil && !strings.Contains(err.Error(), "invalid mode") {
+				t.Errorf("LoadConfig() = %v, want an invalid mode error", err)
+			}
+		})
+	}
+}
+
+func TestCheckBackend(t *testing.T) {
+	bsd := map[string]bool{"darwin": true, "dragonfly": true, "freebsd": true, "netbsd": true, "openbsd": true}
+	tests := []struct {
+		backend string
+		valid   bool
+	}{
+		{"", true},
+		{BackendInotify, true},
+		{BackendPoll, true},
+		{BackendFanotify, runtime.GOOS == "linux"},
+		{BackendFSEvents, runtime.GOOS == "darwin" && errNoFSEvents == nil},
+		{BackendKqueue, bsd[runtime.GOOS]},
+		{"dnotify", false},
+	}
+	for _, tt := range tests {
+		m := &Mapping{Name: "test", Sources: []string{t.TempDir()}, Destination: t.TempDir(), Backend: tt.backend}
+		if err := m.Check(); (err == nil) != tt.valid {
+			t.Errorf("Check() with backend %q = %v, want valid %v", tt.backend, err, tt.valid)
+		}
+	}
+}
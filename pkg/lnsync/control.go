@@ -0,0 +1,107 @@
+package lnsync
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// controlTimeout bounds a single request on the control socket
+const controlTimeout = 10 * time.Second
+
+// ServeControl answers requests on the local control socket. A request is
+// a single command line, the reply a JSON document.
+func ServeControl(path string, m *Manager) error {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return err
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go handleControl(conn, m)
+	}
+}
+
+func handleControl(conn net.Conn, m *Manager) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	command, arg := strings.TrimSpace(line), ""
+	if idx := strings.IndexByte(command, ' '); idx >= 0 {
+		command, arg = command[:idx], strings.TrimSpace(command[idx+1:])
+	}
+	reply, err := controlCommand(m, command, arg)
+	if err != nil {
+		reply = map[string]string{"error": err.Error()}
+	}
+	if err := json.NewEncoder(conn).Encode(reply); err != nil {
+		slog.Warn("control reply failed", "command", command, "error", err)
+	}
+}
+
+// controlCommand runs a control command with its optional argument, the
+// name of a mapping for rescan and list-links
+func controlCommand(m *Manager, command, arg string) (interface{}, error) {
+	switch command {
+	case "status":
+		return m.Status(), nil
+	case "stats":
+		return m.Snapshot(), nil
+	case "health":
+		return map[string][]string{"problems": append(m.Health(), m.Unwritable()...)}, nil
+	case "pause":
+		m.Pause()
+		return map[string]bool{"paused": true}, nil
+	case "resume":
+		return map[string]int{"applied": m.Resume()}, nil
+	case "rescan":
+		slog.Info("rescan requested", "mapping", arg)
+		if err := m.StartRescan(arg); err != nil {
+			return nil, err
+		}
+		return map[string]bool{"rescanning": true}, nil
+	case "list-links":
+		return m.Links(arg)
+	}
+	return nil, errors.New("unknown command " + command)
+}
+
+// ControlRequest sends a command to the daemon and decodes its reply
+func ControlRequest(path, command string, reply interface{}) error {
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+	if _, err = conn.Write([]byte(command + "\n")); err != nil {
+		return err
+	}
+	data, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var failure struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &failure) == nil && len(failure.Error) != 0 {
+		return errors.New(failure.Error)
+	}
+	return json.Unmarshal(data, reply)
+}
@@ -0,0 +1,82 @@
+package lnsync
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a line of the dead-letter file: an update given up on
+// after all its retries
+type DeadLetter struct {
+	Time        time.Time `json:"time"`
+	Mapping     string    `json:"mapping"`
+	Event       string    `json:"event"`
+	Source      string    `json:"source"`
+	OldSource   string    `json:"old_source,omitempty"`
+	SourceDir   string    `json:"source_dir"`
+	Destination string    `json:"destination"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error"`
+}
+
+var (
+	deadLetterLock sync.Mutex
+	deadLetterFile string
+)
+
+// SetDeadLetter makes the package append the updates it gives up on to
+// file as JSON lines, empty to stop
+func SetDeadLetter(file string) {
+	deadLetterLock.Lock()
+	deadLetterFile = file
+	deadLetterLock.Unlock()
+}
+
+// deadLetter records the failed update in the dead-letter file. The file
+// is opened for every record, which are rare, so it may be rotated freely.
+func deadLetter(update *UpdateHeader, err error) {
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+	if len(deadLetterFile) == 0 {
+		return
+	}
+	line, jerr := json.Marshal(DeadLetter{
+		Time:        time.Now(),
+		Mapping:     update.Path.Mapping.Name,
+		Event:       eventName(&update.Event),
+		Source:      update.Event.Name,
+		OldSource:   update.OldName,
+		SourceDir:   update.Path.Path,
+		Destination: update.Path.Dist,
+		Attempts:    update.Attempt + 1,
+		Error:       err.Error(),
+	})
+	if jerr != nil {
+		slog.Error("dead-letter record failed", "source", update.Event.Name, "error", jerr)
+		return
+	}
+	if werr := appendSync(deadLetterFile, append(line, '\n')); werr != nil {
+		slog.Error("writing dead-letter file failed", "file", deadLetterFile, "source", update.Event.Name,
+			"error", werr)
+	}
+}
+
+// appendSync appends data to file and flushes it to disk
+func appendSync(file string, data []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,86 @@
+package lnsync
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// defaultDestMode is the mode of created destination directories
+const defaultDestMode = 0755
+
+// ensureDest creates the destination of the mapping if it asks for it and
+// the directory is missing, at startup or because it was removed since
+func ensureDest(m *Mapping) error {
+	if !m.CreateDest {
+		return nil
+	}
+	if _, err := os.Stat(m.Destination); !os.IsNotExist(err) {
+		return err
+	}
+	mode, err := destMode(m.DestMode)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Destination, mode); err != nil {
+		return err
+	}
+	// MkdirAll is subject to the umask
+	if err := os.Chmod(m.Destination, mode); err != nil {
+		return err
+	}
+	if len(m.DestOwner) != 0 {
+		uid, gid, err := lookupOwner(m.DestOwner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(m.Destination, uid, gid); err != nil {
+			return err
+		}
+	}
+	slog.Info("destination created", "mapping", m.Name, "destination", m.Destination, "mode", mode.String())
+	return nil
+}
+
+func destMode(mode string) (os.FileMode, error) {
+	if len(mode) == 0 {
+		return defaultDestMode, nil
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 07777 {
+		return 0, errors.New("invalid mode " + mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// lookupOwner resolves "user", "user:group" or their numeric ids. Without
+// a group the primary group of the user is taken; -1 leaves a part alone.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	name, group, _ := strings.Cut(owner, ":")
+	uid, gid = -1, -1
+	if len(name) != 0 {
+		u, err := user.Lookup(name)
+		if err != nil {
+			if u, err = user.LookupId(name); err != nil {
+				return 0, 0, errors.New("unknown user " + name)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		if len(group) == 0 {
+			gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+	if len(group) != 0 {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return 0, 0, errors.New("unknown group " + group)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
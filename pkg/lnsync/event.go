@@ -0,0 +1,75 @@
+package lnsync
+
+import (
+	"github.com/howeyc/fsnotify"
+)
+
+// Op is the kind of change an Event reports
+type Op uint32
+
+// Kinds of change in a source directory
+const (
+	OpCreate Op = 1 << iota
+	OpWrite
+	OpRemove
+	OpRename
+	OpChmod
+)
+
+// String is the log name of the operation
+func (op Op) String() string {
+	switch {
+	case op&OpCreate != 0:
+		return "create"
+	case op&OpRemove != 0:
+		return "remove"
+	case op&OpRename != 0:
+		return "rename"
+	case op&OpWrite != 0:
+		return "write"
+	case op&OpChmod != 0:
+		return "chmod"
+	}
+	return "unknown"
+}
+
+// Event is a change of one path in a source directory, normalized from
+// whichever backend noticed it, so nothing past the watchers depends on
+// the watcher library
+type Event struct {
+	Name string
+	Op   Op
+}
+
+func (e Event) IsCreate() bool { return e.Op&OpCreate != 0 }
+func (e Event) IsWrite() bool  { return e.Op&OpWrite != 0 }
+func (e Event) IsRemove() bool { return e.Op&OpRemove != 0 }
+func (e Event) IsRename() bool { return e.Op&OpRename != 0 }
+func (e Event) IsChmod() bool  { return e.Op&OpChmod != 0 }
+
+// newEvent converts an inotify event
+func newEvent(ev *fsnotify.FileEvent) *Event {
+	e := &Event{Name: ev.Name}
+	if ev.IsCreate() {
+		e.Op |= OpCreate
+	}
+	if ev.IsModify() {
+		e.Op |= OpWrite
+	}
+	if ev.IsDelete() {
+		e.Op |= OpRemove
+	}
+	if ev.IsRename() {
+		e.Op |= OpRename
+	}
+	if ev.IsAttrib() {
+		// inotify reports attribute changes as modifications as well
+		e.Op = e.Op&^OpWrite | OpChmod
+	}
+	return e
+}
+
+// eventName is the log name of a watcher event
+func eventName(ev *Event) string {
+	return ev.Op.String()
+}
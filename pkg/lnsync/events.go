@@ -0,0 +1,76 @@
+package lnsync
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many link events a slow subscriber may lag
+// behind before events are dropped for it
+const subscriberBuffer = 256
+
+// Link event types
+const (
+	EventCreated = "created"
+	EventRemoved = "removed"
+	EventRenamed = "renamed"
+)
+
+// LinkEvent is a change made to a destination directory
+type LinkEvent struct {
+	Type    string    `json:"type"`
+	Mapping string    `json:"mapping"`
+	Link    string    `json:"link"`
+	OldLink string    `json:"old_link,omitempty"`
+	Source  string    `json:"source,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+var (
+	subscriberLock sync.Mutex
+	subscribers    = make(map[chan LinkEvent]bool)
+)
+
+// linkCreated counts and publishes a destination entry created for source
+func linkCreated(mapping, link, source string) {
+	countCreated()
+	publish(LinkEvent{Type: EventCreated, Mapping: mapping, Link: link, Source: source})
+}
+
+// linkRemoved counts and publishes a removed destination entry. source is
+// empty when the entry was dangling.
+func linkRemoved(mapping, link, source string) {
+	countRemoved()
+	publish(LinkEvent{Type: EventRemoved, Mapping: mapping, Link: link, Source: source})
+}
+
+// publish hands ev to every subscriber without blocking the link workers
+func publish(ev LinkEvent) {
+	ev.Time = time.Now()
+	subscriberLock.Lock()
+	defer subscriberLock.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- ev:
+		default:
+			slog.Warn("event subscriber too slow, dropping event", "event", ev.Type, "destination", ev.Link)
+		}
+	}
+}
+
+// subscribe returns a channel receiving every following link event until
+// it is passed to unsubscribe
+func subscribe() chan LinkEvent {
+	ch := make(chan LinkEvent, subscriberBuffer)
+	subscriberLock.Lock()
+	subscribers[ch] = true
+	subscriberLock.Unlock()
+	return ch
+}
+
+func unsubscribe(ch chan LinkEvent) {
+	subscriberLock.Lock()
+	delete(subscribers, ch)
+	subscriberLock.Unlock()
+}
@@ -0,0 +1,116 @@
+package lnsync
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Policies for destination entries lnsync did not create which are in the
+// way of a link
+const (
+	ExistingSkip      = "skip"
+	ExistingOverwrite = "overwrite"
+	ExistingBackup    = "backup"
+	ExistingFail      = "fail"
+)
+
+// backupSuffix is appended to entries moved aside by the backup policy
+const backupSuffix = ".lnsync-orig"
+
+// isForeign reports whether the destination entry for file was not made
+// by lnsync: anything but a symlink in symlink mode, with a state file an
+// entry it does not record, and without one an entry not made for the
+// mapping as far as madeFor can tell. Mappings adopting existing entries
+// take them all.
+func isForeign(m *Mapping, link, file string, info os.FileInfo) bool {
+	if m.LinkMode == LinkSymbolic && info.Mode()&os.ModeSymlink == 0 {
+		return true
+	}
+	if m.AdoptExisting {
+		return false
+	}
+	if state == nil {
+		return !m.madeFor(link, file, info)
+	}
+	return !state.Owns(link)
+}
+
+// replaceForeign applies the existing entry policy of the mapping to the
+// foreign entry in the way of the link to file, and reports whether the
+// link took its place. The link is renamed over the entry, so readers
+// never find the name missing; the backup policy keeps a hardlink or copy
+// of the entry first. Only a directory has to be moved or removed before
+// the link is made.
+func replaceForeign(ctx context.Context, m *Mapping, link, file string) (bool, error) {
+	switch m.Existing {
+	case ExistingOverwrite:
+		info, err := os.Lstat(link)
+		if err != nil {
+			return false, err
+		}
+		if info.IsDir() {
+			err = removeEntry(m, link)
+			if err == nil {
+				err = makeLink(ctx, m, file, link)
+			}
+		} else {
+			err = replaceLink(ctx, m, file, link)
+		}
+		if err != nil {
+			return false, err
+		}
+		slog.Warn("existing entry overwritten", "source", file, "destination", link)
+		return true, nil
+	case ExistingBackup:
+		info, err := os.Lstat(link)
+		if err != nil {
+			return false, err
+		}
+		backup := link + backupSuffix
+		if _, err := os.Lstat(backup); err == nil {
+			backup += "." + strconv.FormatInt(time.Now().Unix(), 10)
+		}
+		if info.IsDir() {
+			err = os.Rename(link, backup)
+			if err == nil {
+				err = makeLink(ctx, m, file, link)
+			}
+		} else if err = keepEntry(ctx, m, link, backup, info); err == nil {
+			err = replaceLink(ctx, m, file, link)
+		}
+		if err != nil {
+			return false, err
+		}
+		slog.Warn("existing entry moved aside", "source", file, "destination", link, "backup", backup)
+		return true, nil
+	case ExistingFail:
+		return false, &os.PathError{Op: "link " + file, Path: link, Err: os.ErrExist}
+	}
+	slog.Debug("entry not managed by lnsync, keeping it", "source", file, "destination", link)
+	return false, nil
+}
+
+// keepEntry preserves the entry as backup while it stays in place: as a
+// hardlink, or where the filesystem refuses one as a copy of the file or
+// the symlink
+func keepEntry(ctx context.Context, m *Mapping, entry, backup string, info os.FileInfo) error {
+	err := os.Link(entry, backup)
+	switch {
+	case err == nil:
+	case info.Mode()&os.ModeSymlink != 0:
+		target, rerr := os.Readlink(entry)
+		if rerr != nil {
+			return rerr
+		}
+		err = symlink(target, backup)
+	case info.Mode().IsRegular():
+		err = copyFile(ctx, entry, backup, m.Durable)
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(m, backup)
+}
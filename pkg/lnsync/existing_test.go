@@ -0,0 +1,112 @@
+package lnsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsForeign(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		entry    string
+		adopt    bool
+		recorded bool
+		state    bool
+		want     bool
+	}{
+		{"own symlink", LinkSymbolic, "symlink to file", false, false, false, false},
+		{"symlink of another tool", LinkSymbolic, "symlink elsewhere", false, false, false, true},
+		{"file in symlink mode", LinkSymbolic, "file by hand", false, false, false, true},
+		{"file in symlink mode adopted", LinkSymbolic, "file by hand", true, false, false, true},
+		{"own copy", LinkCopy, "copy", false, false, false, false},
+		{"file by hand in copy mode", LinkCopy, "file by hand", false, false, false, true},
+		{"file by hand adopted", LinkCopy, "file by hand", true, false, false, false},
+		{"own hardlink", LinkHard, "hardlink", false, false, false, false},
+		{"recorded symlink", LinkSymbolic, "symlink elsewhere", false, true, true, false},
+		{"unrecorded symlink", LinkSymbolic, "symlink to file", false, false, true, true},
+		{"unrecorded symlink adopted", LinkSymbolic, "symlink to file", true, false, true, false},
+		{"recorded copy", LinkCopy, "file by hand", false, true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newEntryFixture(t)
+			m := &Mapping{Name: "test", Sources: []string{f.src}, Destination: f.dest,
+				LinkMode: tt.mode, AdoptExisting: tt.adopt}
+			link := f.entry(t, tt.entry)
+			info, err := os.Lstat(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.state {
+				s, err := LoadState(filepath.Join(t.TempDir(), "state.json"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.recorded {
+					s.Add(link, f.file, m.Name)
+				}
+				SetState(s)
+				defer SetState(nil)
+			}
+			if got := isForeign(m, link, f.file, info); got != tt.want {
+				t.Errorf("isForeign = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceForeign(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		entry    string
+		replaced bool
+		backup   string
+	}{
+		{"skip", ExistingSkip, "file by hand", false, ""},
+		{"overwrite file", ExistingOverwrite, "file by hand", true, ""},
+		{"overwrite symlink", ExistingOverwrite, "symlink elsewhere", true, ""},
+		{"backup file", ExistingBackup, "file by hand", true, "written by hand\n"},
+		{"backup symlink", ExistingBackup, "symlink elsewhere", true, "content\n"},
+		{"fail", ExistingFail, "file by hand", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newEntryFixture(t)
+			m := &Mapping{Name: "test", Sources: []string{f.src}, Destination: f.dest,
+				LinkMode: LinkSymbolic, Existing: tt.policy}
+			link := f.entry(t, tt.entry)
+			before, err := os.Lstat(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replaced, err := replaceForeign(context.Background(), m, link, f.file)
+			if replaced != tt.replaced {
+				t.Fatalf("replaceForeign = %v, %v, want replaced %v", replaced, err, tt.replaced)
+			}
+			if (err != nil) != (tt.policy == ExistingFail) {
+				t.Fatalf("replaceForeign error = %v", err)
+			}
+			target, _ := os.Readlink(link)
+			if replaced && target != f.file {
+				t.Errorf("link points to %q, want %q", target, f.file)
+			}
+			if !replaced {
+				if after, err := os.Lstat(link); err != nil || !os.SameFile(before, after) {
+					t.Errorf("entry changed although it was kept: %v", err)
+				}
+			}
+			backup, err := os.ReadFile(link + backupSuffix)
+			if len(tt.backup) == 0 {
+				if !os.IsNotExist(err) {
+					t.Errorf("backup left behind: %v", err)
+				}
+			} else if string(backup) != tt.backup {
+				t.Errorf("backup holds %q, %v, want %q", backup, err, tt.backup)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package lnsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// fanotifyMask selects the directory entry events of the fanotify backend
+const fanotifyMask = unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO |
+	unix.FAN_CLOSE_WRITE | unix.FAN_ONDIR
+
+// errNoFanotify is nil, the fanotify backend runs here
+var errNoFanotify error
+
+// runFanotify watches the whole filesystem of the source with a single
+// fanotify descriptor, instead of one inotify watch per directory, and
+// sends the events below the source. It needs Linux 5.9 and CAP_SYS_ADMIN.
+// It returns when reading fails or the context of the directory is
+// cancelled.
+func (d *Directory) runFanotify() error {
+	defer d.startOnce.Do(func() { close(d.Started) })
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_REPORT_DFID_NAME,
+		unix.O_RDONLY|unix.O_CLOEXEC)
+	if err != nil {
+		return errors.New("fanotify_init: " + err.Error())
+	}
+	// a non-blocking descriptor goes through the runtime poller, so closing
+	// the file interrupts a pending read
+	file := os.NewFile(uintptr(fd), "fanotify")
+	defer file.Close()
+	if err = unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, fanotifyMask, unix.AT_FDCWD, d.Path); err != nil {
+		return errors.New("fanotify_mark " + d.Path + ": " + err.Error())
+	}
+	// any descriptor on the filesystem resolves the handles of its events
+	mount, err := unix.Open(d.Path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(mount)
+	// resolved handles name the real path of the source
+	root, err := filepath.EvalSymlinks(d.Path)
+	if err != nil {
+		return err
+	}
+
+	d.watchLock.Lock()
+	d.watched = map[string]bool{d.Path: true}
+	d.watchLock.Unlock()
+	if atomic.CompareAndSwapInt32(&d.failed, 1, 0) {
+		slog.Info("fanotify watcher restarted", "source", d.Path, "mapping", d.Mapping.Name)
+		d.manager.rescanLater(d.Mapping.Name)
+	}
+	d.startOnce.Do(func() { close(d.Started) })
+
+	stop := make(chan bool)
+	defer close(stop)
+	lost := d.sourceLost(stop)
+	go func() {
+		select {
+		case <-d.ctx.Done():
+			file.Close()
+		case <-lost:
+			file.Close()
+		case <-stop:
+		}
+	}()
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if d.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		d.fanotifyEvents(mount, root, buf[:n])
+	}
+}
+
+// fanotifyEvents sends the events of one read. Unlike inotify, fanotify
+// has no rename cookie: a moved-from event directly followed by a
+// moved-to event is taken for one rename.
+func (d *Directory) fanotifyEvents(mount int, root string, buf []byte) {
+	var moved *Event
+	for len(buf) >= unix.FAN_EVENT_METADATA_LEN {
+		size := int(binary.NativeEndian.Uint32(buf[0:]))
+		metaSize := int(binary.NativeEndian.Uint16(buf[6:]))
+		mask := binary.NativeEndian.Uint64(buf[8:])
+		if size < unix.FAN_EVENT_METADATA_LEN || size > len(buf) || metaSize > size {
+			break
+		}
+		record := buf[metaSize:size]
+		buf = buf[size:]
+		if mask&unix.FAN_Q_OVERFLOW != 0 {
+			d.lostEvents("fanotify queue overflow")
+			continue
+		}
+		name, ok := fanotifyName(mount, record)
+		if ok {
+			name, ok = d.below(root, name)
+		}
+		if !ok {
+			continue
+		}
+		ev := &Event{Name: name}
+		switch {
+		case mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0:
+			ev.Op = OpCreate
+		case mask&unix.FAN_DELETE != 0:
+			ev.Op = OpRemove
+		case mask&unix.FAN_MOVED_FROM != 0:
+			ev.Op = OpRename
+		case mask&unix.FAN_CLOSE_WRITE != 0:
+			ev.Op = OpWrite
+		}
+		slog.Debug("fanotify event", "event", eventName(ev), "source", name, "mask", mask)
+		if mask&unix.FAN_ONDIR != 0 {
+			if ev.IsCreate() && d.Mapping.Recursive {
+				d.sendTree(name)
+			}
+			continue
+		}
+		if moved != nil {
+			from := moved
+			moved = nil
+			if mask&unix.FAN_MOVED_TO != 0 {
+				d.sendRename(from, ev)
+				continue
+			}
+			d.send(from)
+		}
+		if ev.IsRename() {
+			moved = ev
+			continue
+		}
+		d.send(ev)
+	}
+	if moved != nil {
+		d.send(moved)
+	}
+}
+
+// fanotifyName resolves the directory handle and entry name of an event
+// record to a path. Events of directories removed in the meantime cannot
+// be resolved.
+func fanotifyName(mount int, record []byte) (string, bool) {
+	if len(record) < 20 || record[0] != unix.FAN_EVENT_INFO_TYPE_DFID_NAME {
+		return "", false
+	}
+	size := int(binary.NativeEndian.Uint32(record[12:]))
+	kind := int32(binary.NativeEndian.Uint32(record[16:]))
+	if len(record) < 20+size {
+		return "", false
+	}
+	name := record[20+size:]
+	if idx := bytes.IndexByte(name, 0); idx >= 0 {
+		name = name[:idx]
+	}
+	fd, err := unix.OpenByHandleAt(mount, unix.NewFileHandle(kind, record[20:20+size]), unix.O_PATH|unix.O_CLOEXEC)
+	if err != nil {
+		return "", false
+	}
+	defer unix.Close(fd)
+	dir, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+	if err != nil {
+		return "", false
+	}
+	return dir + "/" + string(name), true
+}
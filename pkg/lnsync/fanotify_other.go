@@ -0,0 +1,15 @@
+//go:build !linux
+
+package lnsync
+
+import (
+	"errors"
+)
+
+// errNoFanotify refuses mappings choosing the backend on this platform
+var errNoFanotify = errors.New("the fanotify backend needs Linux")
+
+func (d *Directory) runFanotify() error {
+	d.startOnce.Do(func() { close(d.Started) })
+	return errNoFanotify
+}
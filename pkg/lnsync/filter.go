@@ -0,0 +1,186 @@
+package lnsync
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// sniffLen is the number of bytes content type detection looks at
+const sniffLen = 512
+
+// defaultIgnores match editor swap and backup files and partial transfers,
+// which are not linked unless a mapping asks for temporary files. The
+// temporary files of rsync are told apart by rsyncTemp.
+var defaultIgnores = []string{
+	".*.swp", ".*.swx", "*~", "*.tmp", ".DS_Store", "*.part", "*.crdownload",
+}
+
+// rsyncTemp reports whether name is shaped like the file rsync writes
+// before renaming it into place: the target name hidden behind a dot,
+// followed by the six letters and digits mkstemp picks. An extension of
+// lower case letters only is taken for a word, as in .bashrc.backup; the
+// few rsync names that random leaves lower case pass.
+func rsyncTemp(name string) bool {
+	idx := strings.LastIndexByte(name, '.')
+	if !strings.HasPrefix(name, ".") || idx < 2 || len(name)-idx-1 != 6 {
+		return false
+	}
+	random := false
+	for _, char := range name[idx+1:] {
+		switch {
+		case char >= 'a' && char <= 'z':
+		case char >= 'A' && char <= 'Z', char >= '0' && char <= '9':
+			random = true
+		default:
+			return false
+		}
+	}
+	return random
+}
+
+// accept reports whether a file name passes the include/exclude filters
+// of the mapping. Without include patterns every name is included.
+func (m *Mapping) accept(name string) bool {
+	name = filepath.Base(name)
+	if len(m.Extensions) != 0 && !m.hasExtension(name) {
+		return false
+	}
+	if m.SkipHidden && strings.HasPrefix(name, ".") {
+		return false
+	}
+	if !m.LinkTempFiles {
+		if rsyncTemp(name) {
+			return false
+		}
+		for _, pattern := range defaultIgnores {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return false
+			}
+		}
+	}
+	for _, pattern := range m.Exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(m.Include) == 0 {
+		return true
+	}
+	for _, pattern := range m.Include {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sizeAccepted reports whether a file of size bytes is within the size
+// range of the mapping. A zero bound is no bound.
+func (m *Mapping) sizeAccepted(size int64) bool {
+	return size >= int64(m.MinSize) && (m.MaxSize == 0 || size <= int64(m.MaxSize))
+}
+
+// specialModes are the file types which are not linked unless a mapping
+// asks for them
+const specialModes = os.ModeSocket | os.ModeNamedPipe | os.ModeDevice | os.ModeCharDevice | os.ModeIrregular
+
+// admits reports whether the type, size and content type of file pass the
+// filters of the mapping. Subdirectories of a source pass only if the
+// mapping links them. A file gone meanwhile passes, its events are handled
+// as usual.
+func (m *Mapping) admits(file string) bool {
+	info, err := os.Stat(file)
+	if errors.Is(err, syscall.ELOOP) {
+		slog.Warn("symlink loop in source, not linking it", "source", file)
+		return false
+	} else if err != nil {
+		return true
+	}
+	if info.IsDir() {
+		return m.LinkDirs && !m.Recursive
+	}
+	if info.Mode()&specialModes != 0 && !m.LinkSpecial {
+		slog.Debug("special file skipped", "source", file, "mode", info.Mode().String())
+		return false
+	}
+	if info.Mode().IsRegular() && !m.sizeAccepted(info.Size()) {
+		return false
+	}
+	return len(m.ContentTypes) == 0 || m.sniffed(file)
+}
+
+// sniffed reports whether the content type detected from the first bytes
+// of file matches one of the content types of the mapping. An empty file
+// has none yet.
+func (m *Mapping) sniffed(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if n == 0 {
+		return err != nil && err != io.EOF
+	}
+	detected, _, _ := strings.Cut(http.DetectContentType(buf[:n]), ";")
+	for _, pattern := range m.ContentTypes {
+		if ok, _ := path.Match(pattern, detected); ok {
+			return true
+		}
+	}
+	slog.Debug("content type not accepted", "source", file, "content_type", detected)
+	return false
+}
+
+// hasExtension reports whether name ends in one of the extensions of the
+// mapping, ignoring case. Extensions may span dots, as in tar.gz.
+func (m *Mapping) hasExtension(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range m.Extensions {
+		if strings.HasSuffix(name, "."+ext) && len(name) > len(ext)+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// skipDir reports whether a subdirectory of a source is left out with
+// everything below it
+func (m *Mapping) skipDir(name string) bool {
+	return m.SkipHidden && strings.HasPrefix(filepath.Base(name), ".")
+}
+
+// hiddenBelow reports whether name lies in a hidden subdirectory of root
+// which the mapping skips
+func (m *Mapping) hiddenBelow(root, name string) bool {
+	if !m.SkipHidden {
+		return false
+	}
+	rel, err := filepath.Rel(root, filepath.Dir(name))
+	if err != nil || rel == "." {
+		return false
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package lnsync
+
+import "testing"
+
+func TestAcceptTempFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"report.pdf", true},
+		{".report.pdf.a8Xk2Q", false},
+		{".report.pdf.Q7ZK2M", false},
+		{".bashrc.backup", true},
+		{".config.yaml", true},
+		{".report.pdf.a8Xk2", true},
+		{".report.pdf.a8-k2Q", true},
+		{"..a8Xk2Q", true},
+		{"report.pdf.a8Xk2Q", true},
+		{".report.swp", false},
+		{"report.part", false},
+	}
+	m := &Mapping{}
+	for _, tt := range tests {
+		if got := m.accept("/src/" + tt.name); got != tt.want {
+			t.Errorf("accept(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	m.LinkTempFiles = true
+	if !m.accept("/src/.report.pdf.a8Xk2Q") {
+		t.Error("rsync temporary file refused with link_temp_files")
+	}
+}
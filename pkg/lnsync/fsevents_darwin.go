@@ -0,0 +1,151 @@
+//go:build darwin && cgo
+
+package lnsync
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsevents"
+)
+
+// DefaultBackend is the backend of mappings which do not choose one:
+// FSEvents watches a whole tree without a descriptor per file
+const DefaultBackend = BackendFSEvents
+
+// errNoFSEvents is nil, the fsevents backend runs here
+var errNoFSEvents error
+
+// fseventsLatency is how long FSEvents collects changes before delivering
+// them
+const fseventsLatency = 100 * time.Millisecond
+
+// fseventsDropped are the flags of an event standing for changes lost by
+// FSEvents
+const fseventsDropped = fsevents.MustScanSubDirs | fsevents.UserDropped | fsevents.KernelDropped
+
+// runFSEvents watches the source with one FSEvents stream, which covers
+// the whole tree, and sends the events of files below the source. It
+// returns when the source goes away or the context of the directory is
+// cancelled.
+func (d *Directory) runFSEvents() error {
+	defer d.startOnce.Do(func() { close(d.Started) })
+	if d.sourceMissing() {
+		return errSourceRemoved
+	}
+	// events name the real path of the source, /private/var for /var
+	root, err := filepath.EvalSymlinks(d.Path)
+	if err != nil {
+		return err
+	}
+	stream := &fsevents.EventStream{
+		Paths:   []string{root},
+		Latency: fseventsLatency,
+		Flags:   fsevents.FileEvents | fsevents.WatchRoot | fsevents.NoDefer,
+	}
+	if err := stream.Start(); err != nil {
+		return errors.New("fsevents " + d.Path + ": " + err.Error())
+	}
+	defer stream.Stop()
+
+	d.watchLock.Lock()
+	d.watched = map[string]bool{d.Path: true}
+	d.watchLock.Unlock()
+	if atomic.CompareAndSwapInt32(&d.failed, 1, 0) {
+		slog.Info("fsevents watcher restarted", "source", d.Path, "mapping", d.Mapping.Name)
+		d.manager.rescanLater(d.Mapping.Name)
+	}
+	d.startOnce.Do(func() { close(d.Started) })
+
+	stop := make(chan bool)
+	defer close(stop)
+	lost := d.sourceLost(stop)
+	for {
+		select {
+		case events := <-stream.Events:
+			if d.fseventsEvents(root, events) {
+				return errSourceRemoved
+			}
+		case <-lost:
+			return errSourceRemoved
+		case <-d.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// fseventsEvents sends the events of one batch and reports whether the
+// source itself went away. FSEvents coalesces the changes of a path into
+// one event with several flags, so whether the file still exists decides
+// between creation and removal. A renamed path which is gone, directly
+// followed by one which exists, is taken for one rename.
+func (d *Directory) fseventsEvents(root string, events []fsevents.Event) bool {
+	var moved *Event
+	var movedID uint64
+	for _, fe := range events {
+		if fe.Flags&fseventsDropped != 0 {
+			d.lostEvents("fsevents dropped events")
+			continue
+		}
+		name := fe.Path
+		if !filepath.IsAbs(name) {
+			name = "/" + name
+		}
+		if fe.Flags&fsevents.RootChanged != 0 || name == root {
+			if d.sourceMissing() {
+				return true
+			}
+			continue
+		}
+		name, ok := d.below(root, name)
+		if !ok {
+			continue
+		}
+		_, err := os.Lstat(name)
+		exists := err == nil
+		ev := &Event{Name: name}
+		switch {
+		case !exists && fe.Flags&fsevents.ItemRenamed != 0:
+			ev.Op = OpRename
+		case !exists:
+			ev.Op = OpRemove
+		case fe.Flags&(fsevents.ItemCreated|fsevents.ItemRenamed) != 0:
+			ev.Op = OpCreate
+		case fe.Flags&fsevents.ItemModified != 0:
+			ev.Op = OpWrite
+		case fe.Flags&(fsevents.ItemInodeMetaMod|fsevents.ItemChangeOwner) != 0:
+			ev.Op = OpChmod
+		default:
+			continue
+		}
+		slog.Debug("fsevents event", "event", eventName(ev), "source", name, "flags", uint32(fe.Flags))
+		if fe.Flags&fsevents.ItemIsDir != 0 {
+			if ev.IsCreate() && d.Mapping.Recursive {
+				d.sendTree(name)
+			}
+			continue
+		}
+		if moved != nil {
+			from := moved
+			moved = nil
+			if ev.IsCreate() && fe.Flags&fsevents.ItemRenamed != 0 && fe.ID == movedID+1 {
+				d.sendRename(from, ev)
+				continue
+			}
+			d.send(from)
+		}
+		if ev.IsRename() {
+			moved, movedID = ev, fe.ID
+			continue
+		}
+		d.send(ev)
+	}
+	if moved != nil {
+		d.send(moved)
+	}
+	return false
+}
@@ -0,0 +1,15 @@
+//go:build !darwin || !cgo
+
+package lnsync
+
+import (
+	"errors"
+)
+
+// errNoFSEvents refuses mappings choosing the backend on this platform
+var errNoFSEvents = errors.New("the fsevents backend needs macOS and a build with cgo")
+
+func (d *Directory) runFSEvents() error {
+	d.startOnce.Do(func() { close(d.Started) })
+	return errNoFSEvents
+}
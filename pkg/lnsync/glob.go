@@ -0,0 +1,144 @@
+package lnsync
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// isGlob reports whether a source is a pattern such as
+// /data/hosts/*/incoming rather than a directory
+func isGlob(src string) bool {
+	return strings.ContainsAny(src, "*?[")
+}
+
+// globBase is the part of a source before its first pattern element, the
+// directory which has to exist for the pattern to match anything
+func globBase(src string) string {
+	if !isGlob(src) {
+		return src
+	}
+	base := src[:strings.IndexAny(src, "*?[")]
+	return filepath.Dir(base + "x")
+}
+
+// dynamic reports whether the sources of the mapping stand for a set of
+// directories which changes while running
+func (m *Mapping) dynamic() bool {
+	return m.WatchParent || slices.ContainsFunc(m.Sources, isGlob)
+}
+
+// expandSources lists the directories the sources of the mapping stand
+// for: each pattern replaced by the directories it currently matches, and
+// in watch parent mode each of those by its subdirectories
+func (m *Mapping) expandSources() []string {
+	if !m.WatchParent {
+		return m.matchSources()
+	}
+	sources := make([]string, 0)
+	for _, parent := range m.matchSources() {
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			dir := filepath.Join(parent, entry.Name())
+			if strings.HasPrefix(entry.Name(), ".") || slices.Contains(sources, dir) {
+				continue
+			}
+			if info, err := os.Stat(dir); err == nil && info.IsDir() {
+				sources = append(sources, dir)
+			}
+		}
+	}
+	return sources
+}
+
+// matchSources lists the directories the sources of the mapping name or
+// match
+func (m *Mapping) matchSources() []string {
+	sources := make([]string, 0, len(m.Sources))
+	for _, src := range m.Sources {
+		if !isGlob(src) {
+			sources = append(sources, src)
+			continue
+		}
+		matches, _ := filepath.Glob(src)
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.IsDir() && !slices.Contains(sources, match) {
+				sources = append(sources, match)
+			}
+		}
+	}
+	return sources
+}
+
+// expanded returns the mapping with its sources expanded. The copy is what
+// the watchers of the mapping run with, so they are replaced as soon as a
+// pattern matches a different set of directories.
+func (m *Mapping) expanded() *Mapping {
+	expanded := *m
+	expanded.Sources = m.expandSources()
+	return &expanded
+}
+
+// ExpandEvery looks for directories newly matching, or no longer
+// matching, the source patterns of the mappings at every interval and
+// starts or stops watching them
+func (m *Manager) ExpandEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			return
+		}
+		m.expand()
+	}
+}
+
+// expand restarts the watchers of the mappings whose sources stand for
+// other directories than those watched. The new sources are linked by the
+// reconciliation pass which follows.
+func (m *Manager) expand() {
+	m.applyLock.Lock()
+	defer m.applyLock.Unlock()
+	m.lock.Lock()
+	conf, current := m.conf, m.mappings
+	m.lock.Unlock()
+	if conf == nil {
+		return
+	}
+	changed := false
+	for idx := range conf.Mappings {
+		mapping := &conf.Mappings[idx]
+		if !mapping.dynamic() {
+			continue
+		}
+		sources := mapping.expandSources()
+		if !reflect.DeepEqual(sources, watchedSources(current, mapping.Name)) {
+			slog.Info("sources of mapping changed", "mapping", mapping.Name, "sources", strings.Join(sources, ","))
+			changed = true
+		}
+	}
+	if changed {
+		if err := m.apply(conf); err != nil {
+			slog.Error("reconciliation failed", "error", err)
+		}
+	}
+}
+
+// watchedSources lists the sources of the named mapping being watched
+func watchedSources(mappings [][]*Directory, name string) []string {
+	for _, dirs := range mappings {
+		if len(dirs) != 0 && dirs[0].Mapping.Name == name {
+			return dirs[0].Mapping.Sources
+		}
+	}
+	return []string{}
+}
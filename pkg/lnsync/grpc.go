@@ -0,0 +1,164 @@
+package lnsync
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcReadOnly are the methods of the gRPC service which change nothing
+var grpcReadOnly = map[string]bool{
+	"/lnsync.v1.Lnsync/GetStatus":   true,
+	"/lnsync.v1.Lnsync/WatchEvents": true,
+}
+
+// ServeGRPC runs the gRPC service described in lnsync.proto, over TLS
+// with tlsConf, in plain text when nil. Like the admin API it listens on
+// loopback unless public is set, and checks the api_token of the config
+// file, sent as "authorization: Bearer <token>" metadata.
+func ServeGRPC(addr string, public bool, tlsConf *tls.Config, m *Manager) error {
+	addr, err := LoopbackAddr(addr, public, "-grpc-public")
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(protoCodec{}),
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler) (interface{}, error) {
+			if err := m.grpcToken(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+			handler grpc.StreamHandler) error {
+			if err := m.grpcToken(stream.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+	if tlsConf != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf)))
+	}
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "lnsync.v1.Lnsync",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			unary("AddSource", func(ctx context.Context, req *pbRequest) (protoMarshaler, error) {
+				return &pbEmpty{}, m.AddSource(req.Mapping, req.Path)
+			}),
+			unary("RemoveSource", func(ctx context.Context, req *pbRequest) (protoMarshaler, error) {
+				return &pbEmpty{}, m.RemoveSource(req.Mapping, req.Path)
+			}),
+			unary("Rescan", func(ctx context.Context, req *pbRequest) (protoMarshaler, error) {
+				return &pbEmpty{}, m.Rescan(req.Mapping)
+			}),
+			unary("GetStatus", func(ctx context.Context, req *pbRequest) (protoMarshaler, error) {
+				return pbStatus{m.Status()}, nil
+			}),
+		},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "WatchEvents",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				var req pbRequest
+				if err := stream.RecvMsg(&req); err != nil {
+					return err
+				}
+				return watchEvents(stream, req.Mapping)
+			},
+		}},
+		Metadata: "lnsync.proto",
+	}, m)
+	return server.Serve(l)
+}
+
+// unary wraps call as the handler of a gRPC method taking a request of
+// string fields
+func unary(name string, call func(context.Context, *pbRequest) (protoMarshaler, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+			interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			var req pbRequest
+			if err := dec(&req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				reply, err := call(ctx, req.(*pbRequest))
+				if err != nil {
+					return nil, grpcError(err)
+				}
+				return reply, nil
+			}
+			if interceptor == nil {
+				return handler(ctx, &req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/lnsync.v1.Lnsync/" + name}
+			return interceptor(ctx, &req, info, handler)
+		},
+	}
+}
+
+// watchEvents streams the link events of a mapping, or of every mapping,
+// until the client goes away
+func watchEvents(stream grpc.ServerStream, mapping string) error {
+	events := subscribe()
+	defer unsubscribe(events)
+	for {
+		select {
+		case ev := <-events:
+			if len(mapping) != 0 && ev.Mapping != mapping {
+				continue
+			}
+			if err := stream.SendMsg(pbLinkEvent{ev}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// grpcToken checks the bearer token in the metadata of a call to method
+func (m *Manager) grpcToken(ctx context.Context, method string) error {
+	token := ""
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) != 0 {
+		if bearer, found := strings.CutPrefix(values[0], "Bearer "); found {
+			token = bearer
+		}
+	}
+	err := m.checkToken(token, grpcReadOnly[method])
+	switch {
+	case errors.Is(err, errNoToken):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	return nil
+}
+
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, errNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errPaused):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
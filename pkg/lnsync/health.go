@@ -0,0 +1,90 @@
+package lnsync
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// stallTimeout is how long queued updates may wait without any worker
+// progress before the event queue is considered stalled
+const stallTimeout = time.Minute
+
+// Active reports whether the watcher of the source is running
+func (d *Directory) Active() bool {
+	if d.origin != nil {
+		return d.origin.Active()
+	}
+	if atomic.LoadInt32(&d.failed) != 0 {
+		return false
+	}
+	d.watchLock.Lock()
+	defer d.watchLock.Unlock()
+	return d.watched[d.Path]
+}
+
+// Stalled reports whether updates are queued but no worker made progress
+// for stallTimeout
+func (m *Manager) Stalled() bool {
+	if m.QueueDepth() == 0 {
+		return false
+	}
+	last := time.Unix(0, atomic.LoadInt64(&m.progress))
+	return time.Since(last) > stallTimeout
+}
+
+// Health lists the problems which make the daemon unhealthy: dead
+// watchers and a stalled event queue
+func (m *Manager) Health() []string {
+	problems := make([]string, 0)
+	for _, dir := range m.Dirs() {
+		if atomic.LoadInt32(&dir.missing) != 0 {
+			continue
+		}
+		if !dir.Active() {
+			problems = append(problems, "watcher not active: "+dir.Path)
+		}
+	}
+	if m.Stalled() {
+		problems = append(problems, "event queue stalled")
+	}
+	return problems
+}
+
+// Ready lists the problems which keep the daemon from serving: the initial
+// reconciliation has not finished, a source is missing, a kqueue watcher
+// scans directories beyond its descriptor budget, a destination is not
+// writable or an alert threshold is crossed, on top of the Health
+// problems. A restart fixes none of them, so they do not count for Health.
+func (m *Manager) Ready() []string {
+	problems := m.Health()
+	if atomic.LoadInt32(&m.ready) == 0 {
+		problems = append(problems, "initial reconciliation not finished")
+	}
+	for _, dir := range m.Dirs() {
+		if atomic.LoadInt32(&dir.missing) != 0 {
+			problems = append(problems, "source missing: "+dir.Path)
+		} else if n := dir.Scanned(); n != 0 {
+			problems = append(problems, "kqueue descriptor budget exhausted, "+strconv.Itoa(n)+
+				" directories scanned: "+dir.Path)
+		}
+	}
+	problems = append(problems, m.Unwritable()...)
+	return append(problems, m.alertHealth()...)
+}
+
+// Unwritable lists the destinations the daemon cannot create entries in
+func (m *Manager) Unwritable() []string {
+	var problems []string
+	dists := make(map[string]bool)
+	for _, dir := range m.Dirs() {
+		if dists[dir.Dist] {
+			continue
+		}
+		dists[dir.Dist] = true
+		if err := writable(dir.Dist); err != nil {
+			problems = append(problems, "destination not writable: "+dir.Dist+": "+err.Error())
+		}
+	}
+	return problems
+}
@@ -0,0 +1,229 @@
+package lnsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Hook runs commands for link events. Commands are split into words and
+// every word is a text/template over HookData; no shell is involved.
+// Template actions and quoted strings stay within one word, so values
+// containing spaces are passed as one argument.
+type Hook struct {
+	OnCreate string `toml:"on_create"`
+	OnRemove string `toml:"on_remove"`
+	OnRename string `toml:"on_rename"`
+	// Mappings limits the hook to these mappings, all when empty
+	Mappings    []string `toml:"mappings"`
+	Timeout     Duration `toml:"timeout"`
+	Concurrency int      `toml:"concurrency"`
+
+	commands map[string][]*template.Template
+}
+
+// HookData is available to hook command templates, e.g. {{.LinkPath}}
+type HookData struct {
+	Event       string
+	Mapping     string
+	LinkPath    string
+	OldLinkPath string
+	SourcePath  string
+}
+
+func (h *Hook) check() error {
+	if h.Timeout.Duration <= 0 {
+		h.Timeout.Duration = 30 * time.Second
+	}
+	if h.Concurrency < 1 {
+		h.Concurrency = 1
+	}
+	h.commands = make(map[string][]*template.Template)
+	for event, command := range map[string]string{
+		EventCreated: h.OnCreate,
+		EventRemoved: h.OnRemove,
+		EventRenamed: h.OnRename,
+	} {
+		if len(command) == 0 {
+			continue
+		}
+		words, err := splitCommand(command)
+		if err != nil {
+			return errors.New("hook " + command + ": " + err.Error())
+		}
+		for _, word := range words {
+			tmpl, err := template.New(event).Option("missingkey=error").Parse(word)
+			if err != nil {
+				return errors.New("hook " + command + ": " + err.Error())
+			}
+			h.commands[event] = append(h.commands[event], tmpl)
+		}
+	}
+	if len(h.commands) == 0 {
+		return errors.New("hook: none of on_create, on_remove or on_rename defined")
+	}
+	return nil
+}
+
+// splitCommand splits a hook command into words at the spaces outside of
+// template actions and quotes. The quotes around a word are removed, those
+// within an action belong to the template.
+func splitCommand(command string) ([]string, error) {
+	if _, err := template.New("").Parse(command); err != nil {
+		return nil, err
+	}
+	var words []string
+	var word strings.Builder
+	var quote byte
+	inWord, action := false, false
+	for idx := 0; idx < len(command); idx++ {
+		char := command[idx]
+		switch {
+		case action:
+			if strings.HasPrefix(command[idx:], "}}") {
+				word.WriteString("}}")
+				idx++
+				action = false
+				continue
+			}
+		case strings.HasPrefix(command[idx:], "{{"):
+			word.WriteString("{{")
+			idx++
+			inWord, action = true, true
+			continue
+		case quote != 0:
+			if char == quote {
+				quote = 0
+				continue
+			}
+		case char == '"' || char == '\'':
+			quote, inWord = char, true
+			continue
+		case char == ' ' || char == '\t' || char == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		}
+		word.WriteByte(char)
+		inWord = true
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	if len(words) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return words, nil
+}
+
+func (h *Hook) accept(ev LinkEvent) bool {
+	if len(h.commands[ev.Type]) == 0 {
+		return false
+	}
+	if len(h.Mappings) == 0 {
+		return true
+	}
+	for _, name := range h.Mappings {
+		if name == ev.Mapping {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	hookLock sync.Mutex
+	hookQuit chan bool
+)
+
+// StartHooks replaces the running hooks with the configured ones. Commands
+// already started are left to finish.
+func StartHooks(hooks []Hook) {
+	hookLock.Lock()
+	defer hookLock.Unlock()
+	if hookQuit != nil {
+		close(hookQuit)
+		hookQuit = nil
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	hookQuit = make(chan bool)
+	for idx := range hooks {
+		hook := hooks[idx]
+		go hook.run(hookQuit)
+	}
+}
+
+// run starts the command for every accepted event, at most Concurrency
+// at a time
+func (h *Hook) run(quit chan bool) {
+	events := subscribe()
+	defer unsubscribe(events)
+	slots := make(chan bool, h.Concurrency)
+	for {
+		select {
+		case ev := <-events:
+			if !h.accept(ev) {
+				continue
+			}
+			select {
+			case slots <- true:
+			case <-quit:
+				return
+			}
+			go func() {
+				h.exec(ev)
+				<-slots
+			}()
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (h *Hook) exec(ev LinkEvent) {
+	data := HookData{
+		Event:       ev.Type,
+		Mapping:     ev.Mapping,
+		LinkPath:    ev.Link,
+		OldLinkPath: ev.OldLink,
+		SourcePath:  ev.Source,
+	}
+	args := make([]string, 0, len(h.commands[ev.Type]))
+	for _, tmpl := range h.commands[ev.Type] {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			slog.Error("hook template failed", "event", ev.Type, "destination", ev.Link, "error", err)
+			return
+		}
+		args = append(args, buf.String())
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout.Duration)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New("timed out after " + h.Timeout.Duration.String())
+	}
+	if err != nil {
+		slog.Error("hook failed", "event", ev.Type, "command", args[0], "destination", ev.Link,
+			"output", strings.TrimSpace(string(out)), "error", err)
+		countError(err)
+		return
+	}
+	slog.Debug("hook finished", "event", ev.Type, "command", args[0], "destination", ev.Link,
+		"duration", time.Since(start))
+}
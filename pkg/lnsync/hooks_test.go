@@ -0,0 +1,34 @@
+package lnsync
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+		valid   bool
+	}{
+		{"index.sh add {{.LinkPath}}", []string{"index.sh", "add", "{{.LinkPath}}"}, true},
+		{"index.sh add {{ .LinkPath }}", []string{"index.sh", "add", "{{ .LinkPath }}"}, true},
+		{"index.sh --from={{ .OldLinkPath }} {{ .LinkPath }}", []string{"index.sh", "--from={{ .OldLinkPath }}", "{{ .LinkPath }}"}, true},
+		{`notify.sh "new file" {{printf "%s %s" .Mapping .LinkPath}}`, []string{"notify.sh", "new file", `{{printf "%s %s" .Mapping .LinkPath}}`}, true},
+		{"notify.sh 'a  b'  c", []string{"notify.sh", "a  b", "c"}, true},
+		{`notify.sh ""`, []string{"notify.sh", ""}, true},
+		{"index.sh {{ .LinkPath", nil, false},
+		{`notify.sh "new file`, nil, false},
+		{"   ", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := splitCommand(tt.command)
+		if (err == nil) != tt.valid {
+			t.Errorf("splitCommand(%q) error = %v, want valid %v", tt.command, err, tt.valid)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("splitCommand(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package lnsync
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ignoreFileName is the gitignore style file read from the top of every
+// source. It is never linked itself.
+const ignoreFileName = ".lnsyncignore"
+
+// ignoreCheckInterval is how often the ignore files are looked at for
+// changes
+const ignoreCheckInterval = 2 * time.Second
+
+// ignoreRule is a single pattern of an ignore file. Patterns without a
+// slash match the name at any depth, others the path relative to the
+// source, where ** spans any number of directories.
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreRules are the rules of the global and the source ignore file, the
+// latter taking precedence, with the stamp of the files they were read from
+type ignoreRules struct {
+	rules []ignoreRule
+	stamp string
+}
+
+// readIgnore parses an ignore file. A missing file has no rules.
+func readIgnore(file string) ([]ignoreRule, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules := make([]ignoreRule, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		rule.anchored = strings.Contains(line, "/")
+		rule.pattern = strings.TrimPrefix(line, "/")
+		if len(rule.pattern) == 0 {
+			continue
+		}
+		if _, err := path.Match(rule.pattern, ""); err != nil {
+			return nil, &os.PathError{Op: "parse pattern " + line, Path: file, Err: err}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// match reports whether the rule matches rel, a slash separated path
+// relative to the source
+func (r *ignoreRule) match(rel string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+	if !r.anchored {
+		ok, _ := path.Match(r.pattern, path.Base(rel))
+		return ok
+	}
+	return matchPath(strings.Split(r.pattern, "/"), strings.Split(rel, "/"))
+}
+
+func matchPath(pattern, parts []string) bool {
+	for len(pattern) != 0 {
+		if pattern[0] == "**" {
+			for idx := 0; idx <= len(parts); idx++ {
+				if matchPath(pattern[1:], parts[idx:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// excluded applies the rules to rel, the last matching rule deciding
+func (r *ignoreRules) excluded(rel string, dir bool) bool {
+	excluded := false
+	for idx := range r.rules {
+		if r.rules[idx].match(rel, dir) {
+			excluded = !r.rules[idx].negate
+		}
+	}
+	return excluded
+}
+
+// ignoreFiles lists the ignore files of the source in order of precedence
+func (d *Directory) ignoreFiles() []string {
+	files := make([]string, 0, 2)
+	if len(d.Mapping.IgnoreFile) != 0 {
+		files = append(files, d.Mapping.IgnoreFile)
+	}
+	return append(files, filepath.Join(d.Path, ignoreFileName))
+}
+
+// ignoreStamp identifies the current contents of the ignore files
+func (d *Directory) ignoreStamp() string {
+	stamp := ""
+	for _, file := range d.ignoreFiles() {
+		if info, err := os.Stat(file); err == nil {
+			stamp += strconv.FormatInt(info.ModTime().UnixNano(), 10) + "/" +
+				strconv.FormatInt(info.Size(), 10)
+		}
+		stamp += ";"
+	}
+	return stamp
+}
+
+// loadIgnore reads the ignore files of the source
+func (d *Directory) loadIgnore() (*ignoreRules, error) {
+	loaded := &ignoreRules{stamp: d.ignoreStamp()}
+	for _, file := range d.ignoreFiles() {
+		rules, err := readIgnore(file)
+		if err != nil {
+			return nil, err
+		}
+		loaded.rules = append(loaded.rules, rules...)
+	}
+	return loaded, nil
+}
+
+// ignoreRules returns the rules of the source, reading them on first use
+func (d *Directory) ignoreRules() *ignoreRules {
+	if d.origin != nil {
+		return d.origin.ignoreRules()
+	}
+	d.ignoreLock.Lock()
+	defer d.ignoreLock.Unlock()
+	if d.ignore == nil {
+		rules, err := d.loadIgnore()
+		if err != nil {
+			slog.Error("reading ignore file failed", "source", d.Path, "mapping", d.Mapping.Name, "error", err)
+			rules = &ignoreRules{stamp: d.ignoreStamp()}
+		}
+		d.ignore = rules
+	}
+	return d.ignore
+}
+
+// ignored reports whether the ignore files exclude name or one of the
+// directories it lies in
+func (d *Directory) ignored(name string, dir bool) bool {
+	rel, err := filepath.Rel(d.Path, name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+	if rel == ignoreFileName {
+		return true
+	}
+	rules := d.ignoreRules()
+	if len(rules.rules) == 0 {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for idx := 1; idx < len(parts); idx++ {
+		if rules.excluded(strings.Join(parts[:idx], "/"), true) {
+			return true
+		}
+	}
+	return rules.excluded(strings.Join(parts, "/"), dir)
+}
+
+// accept reports whether a file of the source passes the mapping filters
+// and the ignore files
+func (d *Directory) accept(name string) bool {
+	return d.Mapping.accept(name) && !d.ignored(name, false)
+}
+
+// skipDir reports whether a subdirectory of the source is left out with
+// everything below it
+func (d *Directory) skipDir(name string) bool {
+	return name != d.Path && (d.Mapping.skipDir(name) || d.ignored(name, true))
+}
+
+// watchIgnore reloads the ignore files when they change and has the
+// mapping reconciled with the new rules, linking files no longer ignored
+// and removing the links of those ignored now
+func (d *Directory) watchIgnore() {
+	ticker := time.NewTicker(ignoreCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+		stamp := d.ignoreStamp()
+		if stamp == d.ignoreRules().stamp {
+			continue
+		}
+		rules, err := d.loadIgnore()
+		if err != nil {
+			slog.Error("reloading ignore file failed, keeping the previous rules", "source", d.Path,
+				"mapping", d.Mapping.Name, "error", err)
+			rules = d.ignoreRules()
+			rules = &ignoreRules{rules: rules.rules, stamp: stamp}
+		} else {
+			slog.Info("ignore files reloaded", "source", d.Path, "mapping", d.Mapping.Name,
+				"rules", len(rules.rules))
+		}
+		d.ignoreLock.Lock()
+		d.ignore = rules
+		d.ignoreLock.Unlock()
+		if err == nil {
+			d.manager.rescanLater(d.Mapping.Name)
+		}
+	}
+}
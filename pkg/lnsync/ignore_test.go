@@ -0,0 +1,130 @@
+package lnsync
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/*", "a/b", true},
+		{"a/*", "a/b/c", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/c", false},
+		{"**/b", "b", true},
+		{"**/b", "x/y/b", true},
+		{"**/b", "x/y/c", false},
+		{"a/**", "a/x/y", true},
+		{"a/**", "b/x", false},
+		{"**/*.md", "docs/x/readme.md", true},
+		{"a/?.txt", "a/1.txt", true},
+		{"a/?.txt", "a/12.txt", false},
+		{"a/[0-9]", "a/5", true},
+		{"a/[0-9]", "a/x", false},
+	}
+	for _, tt := range tests {
+		got := matchPath(strings.Split(tt.pattern, "/"), strings.Split(tt.path, "/"))
+		if got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		path  string
+		dir   bool
+		want  bool
+	}{
+		{"unanchored name", "*.log", "a.log", false, true},
+		{"unanchored at depth", "*.log", "x/y/a.log", false, true},
+		{"unanchored no match", "*.log", "a.txt", false, false},
+		{"anchored at top", "/build", "build", true, true},
+		{"anchored not below", "/build", "src/build", true, false},
+		{"slash anchors", "src/gen", "src/gen", true, true},
+		{"slash anchors not below", "src/gen", "x/src/gen", true, false},
+		{"directory only skips files", "build/", "build", false, false},
+		{"directory only matches directories", "build/", "build", true, true},
+		{"directory only excludes contents", "build/", "x/build/out.o", false, true},
+		{"double star zero directories", "docs/**/*.md", "docs/a.md", false, true},
+		{"double star many directories", "docs/**/*.md", "docs/x/y/a.md", false, true},
+		{"double star other root", "docs/**/*.md", "other/a.md", false, false},
+		{"leading double star", "**/tmp", "a/b/tmp", true, true},
+		{"negation", "*.log\n!keep.log", "keep.log", false, false},
+		{"negation leaves others", "*.log\n!keep.log", "a.log", false, true},
+		{"last rule wins", "!keep.log\n*.log", "keep.log", false, true},
+		{"negation cannot reach into excluded directory", "logs/\n!logs/keep.txt", "logs/keep.txt", false, true},
+		{"comments and blanks", "# *.txt\n\n*.tmp", "a.txt", false, false},
+		{"escaped hash", `\#notes`, "#notes", false, true},
+		{"trailing spaces", "*.tmp  ", "a.tmp", false, true},
+		{"ignore file itself", "", ignoreFileName, false, true},
+		{"no rules", "", "a.log", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := t.TempDir()
+			if err := os.WriteFile(filepath.Join(src, ignoreFileName), []byte(tt.rules), 0644); err != nil {
+				t.Fatal(err)
+			}
+			d := &Directory{Path: src, Mapping: &Mapping{}}
+			got := d.ignored(filepath.Join(src, filepath.FromSlash(tt.path)), tt.dir)
+			if got != tt.want {
+				t.Errorf("ignored(%q) with rules %q = %v, want %v", tt.path, tt.rules, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreFilePrecedence(t *testing.T) {
+	src := t.TempDir()
+	global := filepath.Join(t.TempDir(), "global")
+	if err := os.WriteFile(global, []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, ignoreFileName), []byte("!audit.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := &Directory{Path: src, Mapping: &Mapping{IgnoreFile: global}}
+	if !d.ignored(filepath.Join(src, "app.log"), false) {
+		t.Error("app.log not ignored by the global ignore file")
+	}
+	if d.ignored(filepath.Join(src, "audit.log"), false) {
+		t.Error("audit.log ignored despite the negation of the source ignore file")
+	}
+}
+
+func TestReadIgnore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ignore")
+	if rules, err := readIgnore(file); err != nil || len(rules) != 0 {
+		t.Errorf("readIgnore of a missing file = %v, %v, want no rules", rules, err)
+	}
+	if err := os.WriteFile(file, []byte("[a-\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readIgnore(file); err == nil {
+		t.Error("readIgnore accepted a malformed pattern")
+	}
+	if err := os.WriteFile(file, []byte("!/a/b/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := readIgnore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ignoreRule{pattern: "a/b", negate: true, dirOnly: true, anchored: true}
+	if len(rules) != 1 || rules[0] != want {
+		t.Errorf("readIgnore = %+v, want [%+v]", rules, want)
+	}
+}
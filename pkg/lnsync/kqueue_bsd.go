@@ -0,0 +1,343 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package lnsync
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// errNoKqueue is nil, the kqueue backend runs here
+var errNoKqueue error
+
+// kqueueDirNotes are the changes of a watched directory, kqueueFileNotes
+// those of a watched file
+const (
+	kqueueDirNotes  = unix.NOTE_WRITE | unix.NOTE_DELETE | unix.NOTE_RENAME
+	kqueueFileNotes = unix.NOTE_WRITE | unix.NOTE_EXTEND | unix.NOTE_ATTRIB | unix.NOTE_DELETE | unix.NOTE_RENAME
+)
+
+// defaultKqueueBudget is the number of descriptors a source may hold
+// unless its mapping sets kqueue_budget
+const defaultKqueueBudget = 1024
+
+// kqueueWait bounds a wait for events, so cancellation and scans are not
+// held up by a quiet source
+const kqueueWait = 500 * time.Millisecond
+
+// kqueueWatch is the state of one kqueue backend: the descriptors held
+// within the budget, and the directories scanned instead for lack of them
+type kqueueWatch struct {
+	d       *Directory
+	kq      int
+	budget  int
+	paths   map[int]string
+	fds     map[string]int
+	dirs    map[string]map[string]fileStamp
+	scanned map[string]bool
+}
+
+// runKqueue watches the source with kqueue, which needs a descriptor per
+// watched directory and file. Descriptors are spent on directories first
+// and on files while the budget of the mapping lasts; directories beyond
+// it are scanned every poll interval and files beyond it have their
+// writes noticed by the scans of their directory. It returns when the
+// source goes away or the context of the directory is cancelled.
+func (d *Directory) runKqueue() error {
+	defer d.startOnce.Do(func() { close(d.Started) })
+	if d.sourceMissing() {
+		return errSourceRemoved
+	}
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return errors.New("kqueue: " + err.Error())
+	}
+	w := &kqueueWatch{
+		d:       d,
+		kq:      kq,
+		budget:  d.Mapping.KqueueBudget,
+		paths:   make(map[int]string),
+		fds:     make(map[string]int),
+		dirs:    make(map[string]map[string]fileStamp),
+		scanned: make(map[string]bool),
+	}
+	if w.budget <= 0 {
+		w.budget = defaultKqueueBudget
+	}
+	defer w.close()
+	if err := w.addDir(d.Path, false); err != nil {
+		return err
+	}
+	if _, ok := w.fds[d.Path]; !ok {
+		return errors.New("kqueue: descriptor budget too small for " + d.Path)
+	}
+
+	d.watchLock.Lock()
+	d.watched = map[string]bool{d.Path: true}
+	d.watchLock.Unlock()
+	if atomic.CompareAndSwapInt32(&d.failed, 1, 0) {
+		slog.Info("kqueue watcher restarted", "source", d.Path, "mapping", d.Mapping.Name)
+		d.manager.rescanLater(d.Mapping.Name)
+	}
+	d.startOnce.Do(func() { close(d.Started) })
+
+	interval := d.Mapping.PollInterval.Duration
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	lastScan := time.Now()
+	timeout := unix.NsecToTimespec(int64(kqueueWait))
+	events := make([]unix.Kevent_t, 64)
+	for {
+		if d.ctx.Err() != nil {
+			return nil
+		}
+		n, err := unix.Kevent(kq, nil, events, &timeout)
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			return errors.New("kevent: " + err.Error())
+		}
+		for _, ev := range events[:max(n, 0)] {
+			if w.handle(ev) {
+				return errSourceRemoved
+			}
+		}
+		if len(w.scanned) != 0 && time.Since(lastScan) >= interval {
+			lastScan = time.Now()
+			w.scanOverflow()
+		}
+		if d.sourceMissing() {
+			return errSourceRemoved
+		}
+	}
+}
+
+// watch spends a descriptor of the budget on path, and reports whether
+// there was one left
+func (w *kqueueWatch) watch(path string, notes uint32) bool {
+	if _, ok := w.fds[path]; ok {
+		return true
+	}
+	if len(w.fds) >= w.budget {
+		return false
+	}
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		slog.Debug("kqueue open failed", "source", path, "error", err)
+		return false
+	}
+	change := unix.Kevent_t{}
+	unix.SetKevent(&change, fd, unix.EVFILT_VNODE, unix.EV_ADD|unix.EV_CLEAR|unix.EV_ENABLE)
+	change.Fflags = notes
+	if _, err := unix.Kevent(w.kq, []unix.Kevent_t{change}, nil, nil); err != nil {
+		unix.Close(fd)
+		slog.Error("kqueue watch failed", "source", path, "error", err)
+		return false
+	}
+	w.fds[path] = fd
+	w.paths[fd] = path
+	return true
+}
+
+// unwatch gives the descriptor of path back to the budget
+func (w *kqueueWatch) unwatch(path string) {
+	if fd, ok := w.fds[path]; ok {
+		unix.Close(fd)
+		delete(w.fds, path)
+		delete(w.paths, fd)
+	}
+}
+
+func (w *kqueueWatch) close() {
+	for path := range w.fds {
+		w.unwatch(path)
+	}
+	unix.Close(w.kq)
+	atomic.StoreInt32(&w.d.degraded, 0)
+}
+
+// addDir starts watching a directory and, in recursive mode, the tree
+// below it. With link set the files found are sent as created, they
+// appeared without events of their own.
+func (w *kqueueWatch) addDir(dir string, link bool) error {
+	files, subdirs, err := w.d.listDir(dir)
+	if err != nil {
+		return err
+	}
+	w.dirs[dir] = files
+	if !w.watch(dir, kqueueDirNotes) {
+		w.overflow(dir)
+	}
+	for name := range files {
+		if link {
+			w.d.send(&Event{Name: name, Op: OpCreate})
+		}
+		if !w.scanned[dir] && !w.watch(name, kqueueFileNotes) {
+			w.overflow(dir)
+		}
+	}
+	if !w.d.Mapping.Recursive {
+		return nil
+	}
+	for _, sub := range subdirs {
+		if err := w.addDir(sub, link); err != nil && !os.IsNotExist(err) {
+			slog.Warn("walk directory failed", "source", sub, "error", err)
+		}
+	}
+	return nil
+}
+
+// removeDir stops watching a directory which went away, and the tree
+// below it, and sends a removal for every file it listed
+func (w *kqueueWatch) removeDir(dir string) {
+	names := make([]string, 0, len(w.dirs[dir]))
+	for name := range w.dirs[dir] {
+		w.unwatch(name)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.d.send(&Event{Name: name, Op: OpRemove})
+	}
+	delete(w.dirs, dir)
+	w.unwatch(dir)
+	if w.scanned[dir] {
+		delete(w.scanned, dir)
+		w.report()
+	}
+	for sub := range w.dirs {
+		if filepath.Dir(sub) == dir {
+			w.removeDir(sub)
+		}
+	}
+}
+
+// overflow has dir scanned for want of descriptors
+func (w *kqueueWatch) overflow(dir string) {
+	if !w.scanned[dir] {
+		w.scanned[dir] = true
+		w.report()
+	}
+}
+
+// report publishes how many directories are scanned rather than watched,
+// and logs when the watcher enters or leaves degraded mode
+func (w *kqueueWatch) report() {
+	count := int32(len(w.scanned))
+	prev := atomic.SwapInt32(&w.d.degraded, count)
+	switch {
+	case prev == 0 && count != 0:
+		slog.Warn("kqueue descriptor budget exhausted, scanning directories instead", "source", w.d.Path,
+			"mapping", w.d.Mapping.Name, "budget", w.budget)
+	case prev != 0 && count == 0:
+		slog.Info("kqueue watching every directory again", "source", w.d.Path, "mapping", w.d.Mapping.Name)
+	}
+}
+
+// handle acts on one kqueue event and reports whether the source itself
+// went away
+func (w *kqueueWatch) handle(ev unix.Kevent_t) bool {
+	path, ok := w.paths[int(ev.Ident)]
+	if !ok {
+		return false
+	}
+	gone := ev.Fflags&(unix.NOTE_DELETE|unix.NOTE_RENAME) != 0
+	if _, isDir := w.dirs[path]; isDir {
+		if gone && path == w.d.Path {
+			return true
+		}
+		if gone {
+			// the parent sees the removal
+			w.unwatch(path)
+			return false
+		}
+		w.rescanDir(path)
+		return false
+	}
+	if gone {
+		w.unwatch(path)
+		return false
+	}
+	ev2 := &Event{Name: path, Op: OpWrite}
+	if ev.Fflags&(unix.NOTE_WRITE|unix.NOTE_EXTEND) == 0 {
+		ev2.Op = OpChmod
+	}
+	slog.Debug("kqueue event", "event", eventName(ev2), "source", path, "fflags", ev.Fflags)
+	w.d.send(ev2)
+	return false
+}
+
+// rescanDir compares a directory with its previous listing, sends the
+// differences and watches what appeared
+func (w *kqueueWatch) rescanDir(dir string) {
+	files, subdirs, err := w.d.listDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			// keep the listing, so an unreadable directory does not
+			// take its links with it
+			slog.Warn("scan directory failed", "source", dir, "error", err)
+			return
+		}
+		w.removeDir(dir)
+		return
+	}
+	prev := w.dirs[dir]
+	for name := range prev {
+		if _, ok := files[name]; !ok {
+			w.unwatch(name)
+		}
+	}
+	w.d.diff(prev, files)
+	w.dirs[dir] = files
+	for name := range files {
+		if !w.scanned[dir] && !w.watch(name, kqueueFileNotes) {
+			w.overflow(dir)
+		}
+	}
+	if !w.d.Mapping.Recursive {
+		return
+	}
+	for sub := range w.dirs {
+		if filepath.Dir(sub) == dir {
+			if _, err := os.Stat(sub); err != nil {
+				w.removeDir(sub)
+			}
+		}
+	}
+	for _, sub := range subdirs {
+		if _, ok := w.dirs[sub]; !ok {
+			w.addDir(sub, true)
+		}
+	}
+}
+
+// scanOverflow rescans the directories without descriptors, and tries to
+// watch them again as descriptors were given back
+func (w *kqueueWatch) scanOverflow() {
+	for dir := range w.scanned {
+		w.rescanDir(dir)
+		if _, ok := w.dirs[dir]; !ok {
+			continue
+		}
+		if !w.watch(dir, kqueueDirNotes) {
+			continue
+		}
+		covered := true
+		for name := range w.dirs[dir] {
+			if !w.watch(name, kqueueFileNotes) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			delete(w.scanned, dir)
+		}
+	}
+	w.report()
+}
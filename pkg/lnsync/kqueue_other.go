@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package lnsync
+
+import (
+	"errors"
+)
+
+// errNoKqueue refuses mappings choosing the backend on this platform
+var errNoKqueue = errors.New("the kqueue backend needs BSD or macOS")
+
+func (d *Directory) runKqueue() error {
+	d.startOnce.Do(func() { close(d.Started) })
+	return errNoKqueue
+}
@@ -0,0 +1,724 @@
+package lnsync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// linkName is the path of the destination entry for a source file,
+// relative to the destination directory
+func (d *Directory) linkName(name string) string {
+	var info os.FileInfo
+	stable := d.Mapping.stableNames()
+	if stable {
+		if cached, ok := d.names.Load(name); ok {
+			return cached.(string)
+		}
+		var err error
+		if info, err = os.Lstat(name); err != nil {
+			info = nil
+			// the file is gone, its link may still be on record
+			if link, ok := state.LinkOf(name, d.Mapping.Name); ok {
+				if rel, err := filepath.Rel(d.Dist, link); err == nil {
+					return rel
+				}
+			}
+		}
+	}
+	link := d.entryName(name, info)
+	if dir := d.Mapping.layoutDir(name, info); len(dir) != 0 {
+		link = filepath.Join(dir, link)
+	}
+	if d.Mapping.SourceSubdirs {
+		link = filepath.Join(d.Mapping.sourcePrefix(d.Path), link)
+	}
+	link = d.Mapping.normalize(link)
+	if info != nil {
+		d.names.Store(name, link)
+	}
+	return link
+}
+
+// entryName is the name of the destination entry for a source file within
+// the directories of its source and the layout
+func (d *Directory) entryName(name string, info os.FileInfo) string {
+	if len(d.Mapping.NameTemplate) != 0 {
+		return d.templateName(name, info)
+	}
+	base := d.Mapping.rename(filepath.Base(name))
+	if len(d.Mapping.ContentNames) != 0 {
+		base = d.Mapping.contentName(name, base)
+	}
+	if d.Mapping.Collision == CollisionPrefix {
+		base = d.Mapping.sourcePrefix(d.Path) + "__" + base
+	}
+	if d.Mapping.MirrorTree {
+		if rel, err := filepath.Rel(d.Path, filepath.Dir(name)); err == nil {
+			return filepath.Join(rel, base)
+		}
+	}
+	return base
+}
+
+// sourcePrefix is the name of a source put in front of its link names:
+// the last element of its path, extended by the elements before it as far
+// as needed to tell it from the other sources of the mapping, so sources
+// /data/web01/logs and /data/web02/logs become web01_logs and web02_logs
+func (m *Mapping) sourcePrefix(src string) string {
+	parts := strings.Split(strings.Trim(filepath.ToSlash(src), "/"), "/")
+	for n := 1; n < len(parts); n++ {
+		suffix := strings.Join(parts[len(parts)-n:], "/")
+		unique := true
+		for _, other := range m.Sources {
+			if other != src && strings.HasSuffix("/"+strings.Trim(filepath.ToSlash(other), "/"), "/"+suffix) {
+				unique = false
+				break
+			}
+		}
+		if unique {
+			return strings.Join(parts[len(parts)-n:], "_")
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// normalize brings a link name into the Unicode normalization form of the
+// mapping, so a file named on macOS (NFD) and one named on Linux (NFC)
+// map to the same destination entry
+func (m *Mapping) normalize(name string) string {
+	switch m.Normalize {
+	case NormalizeNFC:
+		return norm.NFC.String(name)
+	case NormalizeNFD:
+		return norm.NFD.String(name)
+	}
+	return name
+}
+
+// pruneDirs removes the directories between link and dist left empty
+// after the link was removed
+func pruneDirs(link, dist string) {
+	for dir := filepath.Dir(link); strings.HasPrefix(dir, dist+"/"); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// resolveCollision picks the source file which owns a destination entry
+// claimed by both prev and next during a scan
+func resolveCollision(m *Mapping, prev, next string) (string, error) {
+	switch m.Collision {
+	case CollisionNewest:
+		if isNewer(next, prev) {
+			return next, nil
+		}
+		return prev, nil
+	case CollisionPriority:
+		if m.priority(next) < m.priority(prev) {
+			return next, nil
+		}
+		return prev, nil
+	case CollisionFirst:
+		return prev, nil
+	}
+	return "", errors.New("name collision: " + prev + " and " + next)
+}
+
+// priority ranks the source of file by its position among the sources of
+// the mapping, 0 being the highest priority. The watchers run with the
+// sources expanded, so each directory a pattern matches or a parent holds
+// ranks of its own; a pattern not expanded ranks every directory it
+// matches alike.
+func (m *Mapping) priority(file string) int {
+	for idx, src := range m.Sources {
+		if within(file, src) || (isGlob(src) && matchesAbove(file, src)) {
+			return idx
+		}
+	}
+	return len(m.Sources)
+}
+
+// matchesAbove reports whether a directory holding file matches pattern
+func matchesAbove(file, pattern string) bool {
+	for dir := filepath.Dir(file); ; dir = filepath.Dir(dir) {
+		if ok, _ := filepath.Match(pattern, dir); ok {
+			return true
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return false
+		}
+	}
+}
+
+// linkedSource returns the source file the destination entry link is
+// known to be made for
+func (d *Directory) linkedSource(link string) (string, bool) {
+	if rec, ok := state.Record(link); ok {
+		return rec.Source, true
+	}
+	target, err := readLink(link)
+	return target, err == nil
+}
+
+// outranks reports whether file has a higher priority than the source
+// file the existing entry link was made for
+func (d *Directory) outranks(file, link string) bool {
+	current, ok := d.linkedSource(link)
+	return !ok || d.Mapping.priority(file) < d.Mapping.priority(current)
+}
+
+// isNewer reports whether name was modified after the file old points to
+func isNewer(name, old string) bool {
+	info, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	oldInfo, err := os.Stat(old)
+	if err != nil {
+		return true
+	}
+	return info.ModTime().After(oldInfo.ModTime())
+}
+
+// isManagedFile reports whether a regular destination entry is an up to
+// date hardlink or copy of the source file
+func isManagedFile(mode string, info os.FileInfo, file string) bool {
+	if len(file) == 0 {
+		return false
+	}
+	src, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	switch mode {
+	case LinkHard:
+		return os.SameFile(info, src)
+	case LinkCopy:
+		return info.Size() == src.Size() && info.ModTime().Equal(src.ModTime())
+	}
+	return false
+}
+
+// makeLink creates the destination entry newname for the source file
+// oldname
+func makeLink(ctx context.Context, m *Mapping, oldname, newname string) (err error) {
+	ctx, span := traceOp(ctx, "lnsync.link", oldname, newname)
+	defer func() { endSpan(span, err) }()
+	if err := makeEntry(ctx, m, oldname, newname); err != nil {
+		return err
+	}
+	m.ownEntry(oldname, newname)
+	return syncDir(m, newname)
+}
+
+func makeEntry(ctx context.Context, m *Mapping, oldname, newname string) error {
+	if err := ensureDest(m); err != nil {
+		return err
+	}
+	oldname, err := m.linkTarget(oldname)
+	if err != nil {
+		return err
+	}
+	if m.nested() {
+		if err := os.MkdirAll(filepath.Dir(newname), 0755); err != nil {
+			return err
+		}
+	}
+	switch m.LinkMode {
+	case LinkHard:
+		err := os.Link(oldname, newname)
+		if !crossDevice(err) {
+			return err
+		}
+		slog.Warn("hardlink across filesystems, creating a symlink instead", "source", oldname,
+			"destination", newname)
+	case LinkCopy:
+		return copyFile(ctx, oldname, newname, m.Durable)
+	}
+	if m.LinkStyle == LinkRelative {
+		target, err := relativeTarget(oldname, newname)
+		if err != nil {
+			return err
+		}
+		return symlink(target, newname)
+	}
+	return symlink(oldname, newname)
+}
+
+// moveEntry renames a destination entry. Across filesystems the entry is
+// created anew from its source file and the old one removed.
+func moveEntry(ctx context.Context, m *Mapping, source, oldlink, newlink string) (err error) {
+	ctx, span := traceOp(ctx, "lnsync.move", source, newlink)
+	defer func() { endSpan(span, err) }()
+	err = os.Rename(oldlink, newlink)
+	if !crossDevice(err) {
+		return err
+	}
+	slog.Warn("rename across filesystems, recreating the entry instead", "source", source,
+		"destination", newlink, "old_destination", oldlink)
+	if err := makeEntry(ctx, m, source, newlink); err != nil {
+		return err
+	}
+	return os.Remove(oldlink)
+}
+
+// relativeTarget is the path of oldname relative to the directory of the
+// link newname
+func relativeTarget(oldname, newname string) (string, error) {
+	abs, err := filepath.Abs(oldname)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(filepath.Dir(newname))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(dir, abs)
+}
+
+// readLink returns the target of a symlink as an absolute path, whether it
+// was written absolute or relative
+func readLink(link string) (string, error) {
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(link), target)
+	}
+	return target, nil
+}
+
+// tmpPrefix starts the temporary names entries are created under before
+// they are renamed into place
+const tmpPrefix = ".lnsync."
+
+// staleTemp is the age after which a temporary entry is taken for the
+// leftover of an interrupted operation
+const staleTemp = time.Minute
+
+func tmpName(link string) string {
+	return filepath.Join(filepath.Dir(link), tmpPrefix+filepath.Base(link))
+}
+
+func isTemp(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), tmpPrefix)
+}
+
+// removeStaleTemps deletes the temporaries of link operations which were
+// interrupted, by a crash for instance
+func removeStaleTemps(target string, tree bool) {
+	filepath.Walk(target, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if !tree && name != target {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isTemp(name) && time.Since(info.ModTime()) > staleTemp {
+			slog.Info("removing stale temporary", "destination", name)
+			os.Remove(name)
+		}
+		return nil
+	})
+}
+
+// replaceLink creates the new entry under a temporary name and renames it
+// over newname, so readers of the destination never find the entry
+// missing or dangling, whatever it was before
+func replaceLink(ctx context.Context, m *Mapping, oldname, newname string) (err error) {
+	ctx, span := traceOp(ctx, "lnsync.replace", oldname, newname)
+	defer func() { endSpan(span, err) }()
+	if m.LinkMode == LinkCopy {
+		if err := copyFile(ctx, oldname, newname, m.Durable); err != nil {
+			return err
+		}
+		m.ownEntry(oldname, newname)
+		return syncDir(m, newname)
+	}
+	tmp := tmpName(newname)
+	os.Remove(tmp)
+	if err := makeEntry(ctx, m, oldname, tmp); err != nil {
+		return err
+	}
+	m.ownEntry(oldname, tmp)
+	if err := os.Rename(tmp, newname); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(m, newname)
+}
+
+// removeEntry deletes a destination entry
+func removeEntry(m *Mapping, link string) error {
+	if err := os.Remove(link); err != nil {
+		return err
+	}
+	return syncDir(m, link)
+}
+
+// syncDir flushes the directory holding the entry name to disk for
+// durable mappings, so a link reported done survives a power loss
+func syncDir(m *Mapping, name string) error {
+	if !m.Durable {
+		return nil
+	}
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// copyFile writes the copy under a temporary name and renames it into
+// place, so consumers never see a partially written file. A durable copy
+// is flushed to disk before the rename. Cancelling ctx aborts the copy.
+func copyFile(ctx context.Context, src, dst string, durable bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("copy " + src + ": not a regular file")
+	}
+	tmp := tmpName(dst)
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, ctxReader{ctx, in}); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if durable {
+		if err = out.Sync(); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// ctxReader fails reads once its context is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// createLink links a new source file into dist, honouring the collision
+// policy when the destination entry already exists
+func (d *Directory) createLink(ctx context.Context, name, dist string) error {
+	start := time.Now()
+	link := dist + "/" + d.linkName(name)
+	if info, err := os.Lstat(link); err == nil && isForeign(d.Mapping, link, name, info) {
+		replaced, err := replaceForeign(ctx, d.Mapping, link, name)
+		if !replaced {
+			if err != nil {
+				slog.Error("create link failed", "source", name, "destination", link, "error", err)
+			}
+			return err
+		}
+		d.rememberTarget(name)
+		state.Add(link, name, d.Mapping.Name)
+		linkCreated(d.Mapping.Name, link, name)
+		slog.Debug("link replaced", "event", "create", "source", name, "destination", link,
+			"duration", time.Since(start))
+		return nil
+	} else if err == nil {
+		if !ownsLink(link, name, d.Mapping) {
+			slog.Debug("entry not managed by lnsync, keeping it", "source", name, "destination", link)
+			return nil
+		}
+		switch d.Mapping.Collision {
+		case CollisionFirst:
+			slog.Debug("link exists, keeping it", "source", name, "destination", link)
+			return nil
+		case CollisionNewest, CollisionPriority:
+			if d.Mapping.Collision == CollisionNewest && !isNewer(name, link) {
+				slog.Debug("link to newer file exists, keeping it", "source", name, "destination", link)
+				return nil
+			}
+			if d.Mapping.Collision == CollisionPriority && !d.outranks(name, link) {
+				slog.Debug("link to file of higher priority exists, keeping it", "source", name, "destination", link)
+				return nil
+			}
+			if err := replaceLink(ctx, d.Mapping, name, link); err != nil {
+				slog.Error("replace link failed", "source", name, "destination", link, "error", err)
+				return err
+			}
+			d.rememberTarget(name)
+			state.Add(link, name, d.Mapping.Name)
+			linkCreated(d.Mapping.Name, link, name)
+			slog.Debug("link replaced", "event", "create", "source", name, "destination", link,
+				"duration", time.Since(start))
+			return nil
+		}
+	}
+	err := makeLink(ctx, d.Mapping, name, link)
+	if err != nil {
+		slog.Error("create link failed", "source", name, "destination", link, "error", err)
+		return err
+	}
+	d.rememberTarget(name)
+	state.Add(link, name, d.Mapping.Name)
+	linkCreated(d.Mapping.Name, link, name)
+	slog.Debug("link created", "event", "create", "source", name, "destination", link,
+		"duration", time.Since(start))
+	return nil
+}
+
+// updateCopy refreshes the destination copy after the source was written
+func (d *Directory) updateCopy(ctx context.Context, name, dist string) error {
+	start := time.Now()
+	link := dist + "/" + d.linkName(name)
+	err := copyFile(ctx, name, link, d.Mapping.Durable)
+	if err == nil {
+		d.Mapping.ownEntry(name, link)
+		err = syncDir(d.Mapping, link)
+	}
+	if err != nil {
+		slog.Error("update copy failed", "source", name, "destination", link, "error", err)
+		return err
+	}
+	slog.Debug("copy updated", "event", "modify", "source", name, "destination", link,
+		"duration", time.Since(start))
+	return nil
+}
+
+// rehashLink moves the destination entry of a content named file which was
+// written to under the hash of its new contents, and reports whether it
+// did
+func (d *Directory) rehashLink(ctx context.Context, name, dist string) (bool, error) {
+	old := d.linkName(name)
+	d.names.Delete(name)
+	link := d.linkName(name)
+	if link == old {
+		return false, nil
+	}
+	if _, err := os.Lstat(dist + "/" + old); err != nil {
+		// the entry under the new name is made by revalidateLink
+		return false, nil
+	}
+	slog.Info("contents changed, renaming link", "source", name, "destination", dist+"/"+link,
+		"old_destination", dist+"/"+old)
+	d.names.Store(name, old)
+	if err := d.removeLink(name, dist); err != nil {
+		return false, err
+	}
+	d.names.Store(name, link)
+	return true, d.createLink(ctx, name, dist)
+}
+
+// revalidateLink checks the destination entry of a source file which was
+// written to or changed its mode: a missing entry is created again, and a
+// hardlink or copy no longer matching the file, because the file was
+// replaced rather than written in place, is renewed. An entry which may
+// belong to an equally named file of another source is left alone.
+func (d *Directory) revalidateLink(ctx context.Context, name, dist string) error {
+	link := dist + "/" + d.linkName(name)
+	info, err := os.Lstat(link)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(name); err != nil {
+			return nil
+		}
+		slog.Info("link missing, recreating it", "source", name, "destination", link)
+		return d.createLink(ctx, name, dist)
+	}
+	if err == nil && d.Mapping.Collision == CollisionNewest && info.Mode()&os.ModeSymlink != 0 {
+		if target, err := readLink(link); err == nil && !d.ownTarget(link, target, name) && isNewer(name, link) {
+			slog.Info("file became the newest copy, repointing the link", "source", name, "destination", link)
+			return d.createLink(ctx, name, dist)
+		}
+	}
+	if err == nil && d.Mapping.Collision == CollisionPriority && info.Mode()&os.ModeSymlink != 0 {
+		if target, err := readLink(link); err == nil && !d.ownTarget(link, target, name) && d.outranks(name, link) {
+			slog.Info("file of higher priority, repointing the link", "source", name, "destination", link)
+			return d.createLink(ctx, name, dist)
+		}
+	}
+	if err != nil || d.Mapping.LinkMode == LinkSymbolic || info.Mode()&os.ModeSymlink != 0 ||
+		!ownsLink(link, name, d.Mapping) {
+		return err
+	}
+	if isManagedFile(d.Mapping.LinkMode, info, name) {
+		return nil
+	}
+	if rec, ok := state.Record(link); ok && !samePath(rec.Source, name) {
+		return nil
+	} else if !ok && len(d.Mapping.Sources) > 1 {
+		return nil
+	}
+	start := time.Now()
+	if err := replaceLink(ctx, d.Mapping, name, link); err != nil {
+		slog.Error("renew link failed", "source", name, "destination", link, "error", err)
+		return err
+	}
+	state.Add(link, name, d.Mapping.Name)
+	linkCreated(d.Mapping.Name, link, name)
+	slog.Debug("link renewed", "event", "write", "source", name, "destination", link,
+		"duration", time.Since(start))
+	return nil
+}
+
+// renameLink moves the destination entry of oldname to the name of
+// newname. Symlinks are rewritten under a temporary name and renamed over
+// the new entry, so it never appears dangling.
+func (d *Directory) renameLink(ctx context.Context, oldname, newname, dist string) error {
+	start := time.Now()
+	oldlink := dist + "/" + d.linkName(oldname)
+	newlink := dist + "/" + d.linkName(newname)
+	var err error
+	if d.Mapping.LinkMode == LinkSymbolic {
+		err = replaceLink(ctx, d.Mapping, newname, newlink)
+		if err == nil && oldlink != newlink {
+			err = removeEntry(d.Mapping, oldlink)
+		}
+	} else {
+		if err = os.MkdirAll(filepath.Dir(newlink), 0755); err == nil {
+			err = moveEntry(ctx, d.Mapping, newname, oldlink, newlink)
+		}
+		if err == nil {
+			err = syncDir(d.Mapping, newlink)
+		}
+		if err == nil && filepath.Dir(oldlink) != filepath.Dir(newlink) {
+			err = syncDir(d.Mapping, oldlink)
+		}
+	}
+	if err == nil && d.Mapping.nested() {
+		pruneDirs(oldlink, dist)
+	}
+	if err != nil {
+		slog.Error("rename link failed", "source", newname, "destination", newlink,
+			"old_destination", oldlink, "error", err)
+		return err
+	}
+	d.resolved.Delete(oldname)
+	d.forgetName(oldname)
+	d.rememberTarget(newname)
+	state.Remove(oldlink)
+	state.Add(newlink, newname, d.Mapping.Name)
+	publish(LinkEvent{Type: EventRenamed, Mapping: d.Mapping.Name, Link: newlink, OldLink: oldlink, Source: newname})
+	slog.Debug("link renamed", "event", "rename", "source", newname, "destination", newlink,
+		"old_destination", oldlink, "duration", time.Since(start))
+	return nil
+}
+
+// removeLink deletes the destination entry of a removed source file. A
+// symlink pointing to another source's file won a collision and is kept.
+func (d *Directory) removeLink(name, dist string) error {
+	start := time.Now()
+	link := dist + "/" + d.linkName(name)
+	if !ownsLink(link, name, d.Mapping) {
+		slog.Debug("entry not managed by lnsync, keeping it", "source", name, "destination", link)
+		return nil
+	}
+	if d.Mapping.LinkMode == LinkSymbolic {
+		if target, err := readLink(link); err == nil && !d.ownTarget(link, target, name) {
+			slog.Debug("link belongs to another source, keeping it", "source", name, "destination", link)
+			return nil
+		}
+	}
+	err := removeEntry(d.Mapping, link)
+	if err != nil {
+		slog.Error("remove link failed", "source", name, "destination", link, "error", err)
+		return err
+	}
+	d.resolved.Delete(name)
+	d.forgetName(name)
+	state.Remove(link)
+	linkRemoved(d.Mapping.Name, link, name)
+	slog.Debug("link removed", "event", "delete", "source", name, "destination", link,
+		"duration", time.Since(start))
+	if d.Mapping.nested() {
+		pruneDirs(link, dist)
+	}
+	if d.Mapping.Collision == CollisionNewest || d.Mapping.Collision == CollisionPriority {
+		d.promoteNext(name, link, dist)
+	}
+	return nil
+}
+
+// promoteNext links the remaining copy of a removed file among the other
+// sources of the mapping which wins under the collision policy, the newest
+// or the one of highest priority, to its former link
+func (d *Directory) promoteNext(name, link, dist string) {
+	if d.manager == nil {
+		return
+	}
+	rel, err := filepath.Rel(d.Path, name)
+	if err != nil {
+		return
+	}
+	var (
+		best     *Directory
+		bestFile string
+		bestTime time.Time
+	)
+	// the watched sources, in the order of the expanded source list
+	for _, other := range d.manager.siblings(d) {
+		file := filepath.Join(other.Path, rel)
+		info, err := os.Stat(file)
+		if other.Path == d.Path || err != nil {
+			continue
+		}
+		if !other.accept(file) || !other.admits(file) || dist+"/"+other.linkName(file) != link {
+			continue
+		}
+		if d.Mapping.Collision == CollisionPriority && best != nil {
+			continue
+		}
+		if best == nil || info.ModTime().After(bestTime) {
+			best, bestFile, bestTime = other, file, info.ModTime()
+		}
+	}
+	if best == nil {
+		return
+	}
+	slog.Info("remaining copy takes over the link", "source", bestFile, "destination", link,
+		"collision", d.Mapping.Collision)
+	best.createLink(d.ctx, bestFile, dist)
+}
+
+func samePath(a, b string) bool {
+	if a == b {
+		return true
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
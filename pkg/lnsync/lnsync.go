@@ -0,0 +1,771 @@
+// Package lnsync aggregates source directories into destination
+// directories of links and keeps them in sync as files come and go. The
+// lnsync daemon in cmd/lnsync is a thin command line front end to Syncer.
+package lnsync
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/howeyc/fsnotify"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// movePairTimeout is how long a moved-from event waits for its moved-to
+// counterpart before it is treated as a removal
+const movePairTimeout = 50 * time.Millisecond
+
+// Bounds of the backoff between restarts of a failed watcher. A watcher
+// which ran for maxRestartDelay starts over at minRestartDelay.
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = 5 * time.Minute
+)
+
+// UpdateHeader is a single change in a source directory. OldName is set
+// when Event is the moved-to half of a rename inside the watched tree.
+type UpdateHeader struct {
+	Event    Event
+	OldName  string
+	Path     *Directory
+	Attempt  int
+	received time.Time
+	span     trace.SpanContext
+	// key is the entry the update is serialized on, routes the renamed
+	// entries it holds on to, both set once it is queued to a worker
+	key    string
+	routes []string
+	// seq identifies the update among the queued ones, 0 when its wait
+	// is not tracked
+	seq uint64
+}
+
+// retryable reports whether the failed update may succeed later. Nothing
+// can be done once the link exists or the source file is gone.
+func (u *UpdateHeader) retryable(err error) bool {
+	if os.IsExist(err) {
+		return false
+	}
+	if u.Event.IsRemove() || (u.Event.IsRename() && len(u.OldName) == 0) {
+		return !os.IsNotExist(err)
+	}
+	_, serr := os.Lstat(u.Event.Name)
+	return serr == nil
+}
+
+type Directory struct {
+	Path        string
+	Dist        string
+	Mapping     *Mapping
+	Update      chan UpdateHeader
+	Started     chan bool
+	startOnce   sync.Once
+	ctx         context.Context
+	cancel      context.CancelFunc
+	manager     *Manager
+	fileWatcher *fsnotify.Watcher
+	watchLock   sync.Mutex
+	watched     map[string]bool
+	files       int64
+	events      int64
+	failed      int32
+	ignoreLock  sync.Mutex
+	ignore      *ignoreRules
+	resolved    sync.Map
+	brokenLock  sync.Mutex
+	broken      map[string]bool
+	brokenOnce  sync.Once
+	names       sync.Map
+	mountpoint  int32
+	missing     int32
+	unreadable  int32
+	degraded    int32
+	replicas    []*Directory
+	origin      *Directory
+	errLock     sync.Mutex
+	errCount    int64
+	lastErr     string
+	lastErrAt   time.Time
+}
+
+func cleanDirs(ctx context.Context, sources []*Directory, target string) (err error) {
+	if len(sources) == 0 {
+		return nil
+	}
+	mapping := sources[0].Mapping
+	filenames, err := expectedLinks(sources)
+	if err != nil {
+		return err
+	}
+	if err := ensureDest(mapping); err != nil {
+		return err
+	}
+	removeStaleTemps(target, mapping.nested())
+	files, err := listTarget(target, mapping.nested())
+	if err != nil {
+		return err
+	}
+	target_files := make(map[string]string)
+	conflicts := make([]string, 0)
+	for _, name := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		link := target + "/" + name
+		target_files[name] = target
+		info, err := os.Lstat(link)
+		if err != nil {
+			return err
+		}
+		if isForeign(mapping, link, filenames[name], info) {
+			file, ok := filenames[name]
+			if !ok {
+				continue
+			}
+			replaced, err := replaceForeign(ctx, mapping, link, file)
+			if err != nil && mapping.Existing == ExistingFail {
+				conflicts = append(conflicts, link)
+			} else if err != nil {
+				return err
+			}
+			if replaced {
+				state.Add(link, file, mapping.Name)
+				linkCreated(mapping.Name, link, file)
+			}
+			continue
+		}
+		if !ownsLink(link, filenames[name], mapping) {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+			_, err := filepath.EvalSymlinks(link)
+			if err != nil && mirroredBroken(mapping, link) {
+				continue
+			}
+			if file, ok := filenames[name]; err != nil && ok {
+				slog.Info("unresolved link, replacing", "source", file, "destination", link)
+				if err := replaceLink(ctx, mapping, file, link); err != nil {
+					return err
+				}
+				state.Add(link, file, mapping.Name)
+				linkCreated(mapping.Name, link, file)
+				continue
+			}
+			if err != nil {
+				slog.Info("unresolved link, deleting", "destination", link)
+				err := removeEntry(mapping, link)
+				if err != nil {
+					return err
+				}
+				state.Remove(link)
+				linkRemoved(mapping.Name, link, "")
+				delete(target_files, name)
+				pruneDirs(link, target)
+				continue
+			}
+			file, ok := filenames[name]
+			if !ok || (mapping.Collision != CollisionNewest && mapping.Collision != CollisionPriority) {
+				continue
+			}
+			if old, _ := readLink(link); !mapping.pointsTo(old, file) {
+				slog.Info("newer file for link, replacing", "source", file, "destination", link)
+				if err := replaceLink(ctx, mapping, file, link); err != nil {
+					return err
+				}
+				state.Add(link, file, mapping.Name)
+				linkCreated(mapping.Name, link, file)
+			}
+		} else if file, ok := filenames[name]; ok && !isManagedFile(mapping.LinkMode, info, file) {
+			slog.Info("outdated file, replacing", "source", file, "destination", link)
+			if err := replaceLink(ctx, mapping, file, link); err != nil {
+				return err
+			}
+			state.Add(link, file, mapping.Name)
+			linkCreated(mapping.Name, link, file)
+		} else if !ok {
+			slog.Info("unresolved file, deleting", "destination", link)
+			err := removeEntry(mapping, link)
+			if err != nil {
+				return err
+			}
+			state.Remove(link)
+			linkRemoved(mapping.Name, link, filenames[name])
+			delete(target_files, name)
+			pruneDirs(link, target)
+		}
+	}
+	if len(conflicts) != 0 {
+		sort.Strings(conflicts)
+		return errors.New("mapping <" + mapping.Name + ">: " + strconv.Itoa(len(conflicts)) +
+			" destination entries not created by lnsync in the way: " + strings.Join(conflicts, ", "))
+	}
+
+	for key, file := range filenames {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, ok := target_files[key]; !ok {
+			err := makeLink(ctx, mapping, file, target+"/"+key)
+			if err != nil {
+				slog.Error("create link failed", "source", file, "destination", target+"/"+key, "error", err)
+				return err
+			}
+			state.Add(target+"/"+key, file, mapping.Name)
+			linkCreated(mapping.Name, target+"/"+key, file)
+			slog.Debug("missing link created", "source", file, "destination", target+"/"+key)
+		}
+	}
+	state.Prune(mapping.Name)
+
+	return nil
+}
+
+// expectedLinks maps every destination entry of the sources to the file it
+// should point to, after applying the collision policy
+func expectedLinks(sources []*Directory) (map[string]string, error) {
+	mapping := sources[0].Mapping
+	filenames := make(map[string]string)
+	for _, source := range sources {
+		files, err := source.scan()
+		if err != nil {
+			return nil, err
+		}
+		atomic.StoreInt64(&source.files, int64(len(files)))
+		for _, file := range files {
+			name := source.linkName(file)
+			if prev, ok := filenames[name]; ok {
+				file, err = resolveCollision(mapping, prev, file)
+				if err != nil {
+					return nil, err
+				}
+			}
+			filenames[name] = file
+		}
+	}
+	return filenames, nil
+}
+
+// ownsLink reports whether lnsync may remove or replace a destination
+// entry. With a state file only recorded entries are managed, without one
+// those madeFor recognizes, unless the mapping adopts existing entries.
+func ownsLink(link, file string, mapping *Mapping) bool {
+	if state == nil {
+		info, err := os.Lstat(link)
+		if err != nil || mapping.AdoptExisting || mapping.madeFor(link, file, info) {
+			return true
+		}
+		keepUnknown(mapping, link)
+		return false
+	}
+	if state.Owns(link) {
+		return true
+	}
+	if !mapping.AdoptExisting {
+		return false
+	}
+	slog.Info("adopting existing entry", "source", file, "destination", link)
+	state.Add(link, file, mapping.Name)
+	return true
+}
+
+// madeFor tells without a state file whether the destination entry was
+// made by lnsync for file, empty when no source file goes by its name: a
+// symlink into a source of the mapping, a hardlink of file, or a copy of
+// file of the same size and modification time
+func (m *Mapping) madeFor(link, file string, info os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := readLink(link)
+		return err == nil && (m.inSources(target) || (len(file) != 0 && m.pointsTo(target, file)))
+	}
+	if m.LinkMode == LinkHard || m.LinkMode == LinkCopy {
+		return isManagedFile(m.LinkMode, info, file)
+	}
+	return false
+}
+
+// inSources reports whether path lies within a source of the mapping,
+// source patterns included
+func (m *Mapping) inSources(path string) bool {
+	for _, src := range m.Sources {
+		for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+			if ok, _ := filepath.Match(src, dir); ok {
+				return true
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// unknownDests holds the destinations already warned about entries lnsync
+// cannot tell it made
+var unknownDests sync.Map
+
+// keepUnknown logs, once per destination, that an entry is kept because
+// without a state file lnsync cannot tell it made it
+func keepUnknown(m *Mapping, link string) {
+	if _, warned := unknownDests.LoadOrStore(m.Destination, true); !warned {
+		slog.Warn("keeping destination entries lnsync cannot tell it made, -state is required to manage them",
+			"mapping", m.Name, "destination", m.Destination, "entry", link)
+	}
+}
+
+// listTarget lists the destination entries relative to target, leaving out
+// temporaries of link operations in progress and the manifest. With the mirrored layout
+// directories are descended into instead of listed.
+func listTarget(target string, tree bool) ([]string, error) {
+	names := make([]string, 0)
+	if !tree {
+		files, err := ioutil.ReadDir(target)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !isTemp(f.Name()) && !isManifest(f.Name()) {
+				names = append(names, f.Name())
+			}
+		}
+		return names, nil
+	}
+	err := filepath.Walk(target, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || isTemp(name) || isManifest(name) {
+			return nil
+		}
+		rel, err := filepath.Rel(target, name)
+		if err != nil {
+			return err
+		}
+		names = append(names, rel)
+		return nil
+	})
+	return names, err
+}
+
+// scan lists the entries of the source directory, or every file of the
+// source tree in recursive mode, that pass the mapping filters
+func (d *Directory) scan() ([]string, error) {
+	names := make([]string, 0)
+	if d.Mapping.Recursive {
+		err := filepath.Walk(d.Path, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && d.skipDir(name) {
+				return filepath.SkipDir
+			}
+			if !info.IsDir() && d.accept(name) && d.admits(name) {
+				names = append(names, name)
+			}
+			return nil
+		})
+		return names, err
+	}
+	files, err := ioutil.ReadDir(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if name := d.Path + "/" + f.Name(); d.accept(name) && d.admits(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// UpdateDirs applies a change of the source to the destination dist. ctx
+// interrupts copies in progress.
+func (d *Directory) UpdateDirs(ctx context.Context, dist string, updated UpdateHeader) error {
+	if destRefused(dist) {
+		// picked up by the rescan once the destination is fixed
+		return nil
+	}
+	if !updated.Event.IsRemove() && !d.admits(updated.Event.Name) {
+		// the file grew or shrank out of the size range or its content
+		// changed type, or it never passed the filters
+		name := updated.Event.Name
+		if len(updated.OldName) != 0 {
+			name = updated.OldName
+		}
+		if _, err := os.Lstat(dist + "/" + d.linkName(name)); err != nil {
+			return nil
+		}
+		_, span := traceOp(ctx, "lnsync.unlink", name, dist)
+		err := d.removeLink(name, dist)
+		endSpan(span, err)
+		return err
+	}
+	if len(updated.OldName) != 0 {
+		return d.renameLink(ctx, updated.OldName, updated.Event.Name, dist)
+	}
+	if updated.Event.IsCreate() {
+		atomic.AddInt64(&d.files, 1)
+		if err := d.createLink(ctx, updated.Event.Name, dist); err != nil {
+			return err
+		}
+	}
+	if updated.Event.IsWrite() && !updated.Event.IsRemove() && len(d.Mapping.ContentNames) != 0 {
+		// the link is named by the contents the file had before
+		if renamed, err := d.rehashLink(ctx, updated.Event.Name, dist); err != nil || renamed {
+			return err
+		}
+	}
+	if updated.Event.IsWrite() && d.Mapping.LinkMode == LinkCopy {
+		if err := d.updateCopy(ctx, updated.Event.Name, dist); err != nil {
+			return err
+		}
+	} else if updated.Event.IsWrite() || updated.Event.IsChmod() {
+		if err := d.revalidateLink(ctx, updated.Event.Name, dist); err != nil {
+			return err
+		}
+	}
+	if updated.Event.IsRemove() || updated.Event.IsRename() {
+		atomic.AddInt64(&d.files, -1)
+		_, span := traceOp(ctx, "lnsync.unlink", updated.Event.Name, dist)
+		err := d.removeLink(updated.Event.Name, dist)
+		endSpan(span, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InitFSWatch watches the source until the context of the directory is
+// cancelled. A failed watcher is re-created with exponential backoff;
+// meanwhile the source is inactive and its mapping reported degraded.
+func (d *Directory) InitFSWatch() {
+	go d.watchIgnore()
+	watch := d.runWatcher
+	switch d.Mapping.Backend {
+	case BackendPoll:
+		watch = d.runPoller
+	case BackendFanotify:
+		watch = d.runFanotify
+	case BackendFSEvents:
+		watch = d.runFSEvents
+	case BackendKqueue:
+		watch = d.runKqueue
+	}
+	delay := minRestartDelay
+	for {
+		if isMountpoint(d.Path) {
+			atomic.StoreInt32(&d.mountpoint, 1)
+		}
+		started := time.Now()
+		err := watch()
+		if d.ctx.Err() != nil {
+			return
+		}
+		atomic.StoreInt32(&d.failed, 1)
+		if d.sourceMissing() {
+			d.sourceRemoved()
+			if !d.awaitSource() {
+				return
+			}
+			delay = minRestartDelay
+			continue
+		}
+		if time.Since(started) > maxRestartDelay {
+			delay = minRestartDelay
+		}
+		slog.Error("file watcher failed, restarting", "source", d.Path, "mapping", d.Mapping.Name,
+			"delay", delay, "error", err)
+		notify("file watcher failed: "+d.Path, "mapping "+d.Mapping.Name+": "+err.Error())
+		select {
+		case <-time.After(delay):
+		case <-d.ctx.Done():
+			return
+		}
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// runWatcher watches the source with a new watcher until the watcher
+// fails or the context of the directory is cancelled
+func (d *Directory) runWatcher() error {
+	defer d.startOnce.Do(func() { close(d.Started) })
+	if d.sourceMissing() {
+		return errSourceRemoved
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	d.watchLock.Lock()
+	d.fileWatcher, d.watched = watcher, nil
+	d.watchLock.Unlock()
+
+	failed := make(chan error, 1)
+	go func() { failed <- d.fsEvent(watcher) }()
+	d.StartFSWatch()
+	if atomic.CompareAndSwapInt32(&d.failed, 1, 0) {
+		// changes made while the watcher was down went unnoticed
+		slog.Info("file watcher restarted", "source", d.Path, "mapping", d.Mapping.Name)
+		d.manager.rescanLater(d.Mapping.Name)
+	}
+	d.startOnce.Do(func() { close(d.Started) })
+	stop := make(chan bool)
+	defer close(stop)
+	select {
+	case err = <-failed:
+		return err
+	case <-d.sourceLost(stop):
+		return errSourceRemoved
+	case <-d.ctx.Done():
+		return nil
+	}
+}
+
+func (d *Directory) StartFSWatch() {
+	if !d.Mapping.Recursive {
+		d.addWatch(d.Path)
+		return
+	}
+	d.watchTree(d.Path, false)
+}
+
+func (d *Directory) StopFSWatch() {
+	d.watchLock.Lock()
+	dirs := make([]string, 0, len(d.watched))
+	for dir := range d.watched {
+		dirs = append(dirs, dir)
+	}
+	d.watchLock.Unlock()
+	for _, dir := range dirs {
+		d.removeWatch(dir)
+	}
+}
+
+func (d *Directory) addWatch(dir string) {
+	err := d.watcher().Watch(dir)
+	if err != nil {
+		slog.Error("add watch failed", "source", dir, "error", err)
+		return
+	}
+	slog.Debug("directory watched", "source", dir)
+	d.watchLock.Lock()
+	if d.watched == nil {
+		d.watched = make(map[string]bool)
+	}
+	d.watched[dir] = true
+	d.watchLock.Unlock()
+}
+
+// watcher returns the fsnotify watcher, which is replaced when it restarts
+func (d *Directory) watcher() *fsnotify.Watcher {
+	d.watchLock.Lock()
+	defer d.watchLock.Unlock()
+	return d.fileWatcher
+}
+
+func (d *Directory) removeWatch(dir string) {
+	d.watchLock.Lock()
+	delete(d.watched, dir)
+	d.watchLock.Unlock()
+	err := d.watcher().RemoveWatch(dir)
+	if err != nil {
+		slog.Error("remove watch failed", "source", dir, "error", err)
+		return
+	}
+	slog.Debug("directory unwatched", "source", dir)
+}
+
+// watchTree adds watches for dir and all its subdirectories. When link is
+// set, files already present in the tree are linked too: they may have been
+// created before the watch was registered and we never see their events.
+// Directories excluded by the ignore files are watched all the same, their
+// events are dropped later, so editing the rules takes effect without
+// rebuilding the watches.
+func (d *Directory) watchTree(dir string, link bool) {
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			slog.Warn("walk directory failed", "source", name, "error", err)
+			return nil
+		}
+		if info.IsDir() && name != d.Path && d.Mapping.skipDir(name) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
+			d.addWatch(name)
+		} else if link && d.accept(name) && d.admits(name) {
+			d.createLink(d.ctx, name, d.Dist)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Warn("walk directory failed", "source", dir, "error", err)
+	}
+}
+
+// handleSubdir keeps watches in sync with the source tree in recursive mode
+// and reports whether the event was about a directory
+func (d *Directory) handleSubdir(ev *Event) bool {
+	if ev.IsCreate() {
+		info, err := os.Lstat(ev.Name)
+		if err != nil || !info.IsDir() {
+			return false
+		}
+		if !d.Mapping.skipDir(ev.Name) {
+			d.watchTree(ev.Name, true)
+		}
+		return true
+	}
+	if ev.IsRemove() || ev.IsRename() {
+		d.watchLock.Lock()
+		_, ok := d.watched[ev.Name]
+		delete(d.watched, ev.Name)
+		d.watchLock.Unlock()
+		return ok
+	}
+	return false
+}
+
+// fsEvent forwards watcher events to the update channel until the watcher
+// is closed or fails. A moved-from event is held back until the next event:
+// if that is the moved-to half both are sent as one rename, otherwise the
+// file left the tree.
+func (d *Directory) fsEvent(watcher *fsnotify.Watcher) error {
+	var (
+		moved  *Event
+		expire <-chan time.Time
+	)
+	for {
+		select {
+		case raw, ok := <-watcher.Event:
+			if !ok {
+				return nil
+			}
+			if len(raw.Name) == 0 {
+				// inotify reports a queue overflow as an event without a
+				// watch, hence without a name
+				d.lostEvents("kernel event queue overflow")
+				continue
+			}
+			ev := newEvent(raw)
+			slog.Debug("watcher event", "event", eventName(ev), "source", ev.Name, "raw", raw.String())
+			if ev.Name == d.Path && (ev.IsRemove() || ev.IsRename()) {
+				return errSourceRemoved
+			}
+			if d.Mapping.Recursive && d.handleSubdir(ev) {
+				continue
+			}
+			if moved != nil {
+				from := moved
+				moved, expire = nil, nil
+				if ev.IsCreate() {
+					d.sendRename(from, ev)
+					continue
+				}
+				d.send(from)
+			}
+			if ev.IsRename() {
+				moved, expire = ev, time.After(movePairTimeout)
+				continue
+			}
+			d.send(ev)
+		case <-expire:
+			d.send(moved)
+			moved, expire = nil, nil
+		case err, ok := <-watcher.Error:
+			if !ok {
+				return nil
+			}
+			if strings.Contains(err.Error(), "overflow") {
+				d.lostEvents(err.Error())
+				continue
+			}
+			countError(err)
+			return err
+		}
+	}
+}
+
+// lostEvents records that the watcher missed events and has the mapping
+// reconciled to pick up whatever changed in the meantime
+func (d *Directory) lostEvents(reason string) {
+	countOverflow()
+	slog.Error("file watcher lost events, scheduling a rescan", "source", d.Path, "mapping", d.Mapping.Name,
+		"reason", reason)
+	d.manager.rescanLater(d.Mapping.Name)
+}
+
+func (d *Directory) send(ev *Event) {
+	if !d.accept(ev.Name) {
+		return
+	}
+	countEvent(d)
+	d.post(UpdateHeader{Event: *ev, Path: d})
+}
+
+func (d *Directory) sendRename(from, to *Event) {
+	switch {
+	case d.accept(from.Name) && d.accept(to.Name):
+		countEvent(d)
+		d.post(UpdateHeader{Event: *to, OldName: from.Name, Path: d})
+	case d.accept(from.Name):
+		d.send(from)
+	default:
+		d.send(to)
+	}
+}
+
+// below maps a path under root, the resolved source path, to the source
+// and reports whether it belongs to the source: only to its top level
+// unless watching recursively
+func (d *Directory) below(root, name string) (string, bool) {
+	if !strings.HasPrefix(name, root+"/") {
+		return "", false
+	}
+	name = d.Path + name[len(root):]
+	if d.Mapping.hiddenBelow(d.Path, name) {
+		return "", false
+	}
+	return name, d.Mapping.Recursive || filepath.Dir(name) == d.Path
+}
+
+// sendTree sends a create event for every file of a directory which
+// appeared in the source, as its content came without events
+func (d *Directory) sendTree(dir string) {
+	filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && d.skipDir(name) {
+			return filepath.SkipDir
+		}
+		if err == nil && !info.IsDir() {
+			d.send(&Event{Name: name, Op: OpCreate})
+		}
+		return nil
+	})
+}
+
+// post hands an update to the manager unless the watcher is shutting down.
+// A full event queue is handled according to the overflow policy.
+func (d *Directory) post(update UpdateHeader) {
+	traceEvent(&update)
+	select {
+	case d.Update <- update:
+		return
+	case <-d.ctx.Done():
+		return
+	default:
+	}
+	d.manager.overflow(update)
+}
@@ -0,0 +1,192 @@
+package lnsync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// entryFixture holds a mapping with one source file, and builds candidate
+// destination entries for it
+type entryFixture struct {
+	src, dest, file, other string
+}
+
+func newEntryFixture(t *testing.T) *entryFixture {
+	f := &entryFixture{src: t.TempDir(), dest: t.TempDir()}
+	f.file = filepath.Join(f.src, "a.txt")
+	f.other = filepath.Join(t.TempDir(), "a.txt")
+	for _, name := range []string{f.file, f.other} {
+		if err := os.WriteFile(name, []byte("content\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+// entry creates the destination entry a.txt the way kind says
+func (f *entryFixture) entry(t *testing.T, kind string) string {
+	link := filepath.Join(f.dest, "a.txt")
+	var err error
+	switch kind {
+	case "symlink to file":
+		err = os.Symlink(f.file, link)
+	case "symlink to gone source file":
+		err = os.Symlink(filepath.Join(f.src, "gone.txt"), link)
+	case "symlink elsewhere":
+		err = os.Symlink(f.other, link)
+	case "dangling symlink elsewhere":
+		err = os.Symlink(filepath.Join(filepath.Dir(f.other), "gone.txt"), link)
+	case "hardlink":
+		err = os.Link(f.file, link)
+	case "copy":
+		err = copyEntry(f.file, link, 0)
+	case "copy with other mtime":
+		err = copyEntry(f.file, link, time.Hour)
+	case "file by hand":
+		err = os.WriteFile(link, []byte("written by hand\n"), 0644)
+	default:
+		t.Fatal("unknown entry kind " + kind)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+// copyEntry copies src to dst with the modification time of src moved by
+// skew
+func copyEntry(src, dst string, skew time.Duration) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(dst, data, 0644); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime().Add(skew), info.ModTime().Add(skew))
+}
+
+func TestMadeFor(t *testing.T) {
+	tests := []struct {
+		mode  string
+		entry string
+		want  bool
+	}{
+		{LinkSymbolic, "symlink to file", true},
+		{LinkSymbolic, "symlink to gone source file", true},
+		{LinkSymbolic, "symlink elsewhere", false},
+		{LinkSymbolic, "dangling symlink elsewhere", false},
+		{LinkSymbolic, "file by hand", false},
+		{LinkHard, "hardlink", true},
+		{LinkHard, "copy", false},
+		{LinkHard, "file by hand", false},
+		{LinkCopy, "copy", true},
+		{LinkCopy, "copy with other mtime", false},
+		{LinkCopy, "file by hand", false},
+		{LinkCopy, "symlink to file", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.entry, func(t *testing.T) {
+			f := newEntryFixture(t)
+			m := &Mapping{Sources: []string{f.src}, Destination: f.dest, LinkMode: tt.mode}
+			link := f.entry(t, tt.entry)
+			info, err := os.Lstat(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.madeFor(link, f.file, info); got != tt.want {
+				t.Errorf("madeFor = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOwnsLinkWithoutState(t *testing.T) {
+	tests := []struct {
+		mode  string
+		entry string
+		adopt bool
+		want  bool
+	}{
+		{LinkSymbolic, "symlink to file", false, true},
+		{LinkSymbolic, "dangling symlink elsewhere", false, false},
+		{LinkSymbolic, "dangling symlink elsewhere", true, true},
+		{LinkCopy, "copy", false, true},
+		{LinkCopy, "file by hand", false, false},
+		{LinkCopy, "file by hand", true, true},
+		{LinkHard, "hardlink", false, true},
+		{LinkHard, "file by hand", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.entry, func(t *testing.T) {
+			f := newEntryFixture(t)
+			m := &Mapping{Name: "test", Sources: []string{f.src}, Destination: f.dest,
+				LinkMode: tt.mode, AdoptExisting: tt.adopt}
+			link := f.entry(t, tt.entry)
+			if got := ownsLink(link, f.file, m); got != tt.want {
+				t.Errorf("ownsLink = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	f := newEntryFixture(t)
+	m := &Mapping{Name: "test", Sources: []string{f.src}, Destination: f.dest, LinkMode: LinkCopy}
+	if !ownsLink(filepath.Join(f.dest, "missing.txt"), f.file, m) {
+		t.Error("ownsLink refused a missing entry")
+	}
+}
+
+func TestSourceMissing(t *testing.T) {
+	parent := t.TempDir()
+	src := filepath.Join(parent, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	d := &Directory{Path: src, Mapping: &Mapping{Name: "test"}}
+	if d.sourceMissing() {
+		t.Fatal("existing source taken for missing")
+	}
+	if os.Geteuid() != 0 {
+		if err := os.Chmod(parent, 0); err != nil {
+			t.Fatal(err)
+		}
+		missing := d.sourceMissing()
+		os.Chmod(parent, 0755)
+		if missing {
+			t.Fatal("source which cannot be read taken for missing")
+		}
+	}
+	if err := os.Remove(src); err != nil {
+		t.Fatal(err)
+	}
+	if !d.sourceMissing() {
+		t.Fatal("removed source not taken for missing")
+	}
+}
+
+func TestPriority(t *testing.T) {
+	tests := []struct {
+		sources []string
+		file    string
+		want    int
+	}{
+		{[]string{"/data/hosts/*/in", "/data/spool"}, "/data/hosts/web01/in/a.txt", 0},
+		{[]string{"/data/hosts/*/in", "/data/spool"}, "/data/hosts/web02/in/sub/a.txt", 0},
+		{[]string{"/data/hosts/*/in", "/data/spool"}, "/data/spool/a.txt", 1},
+		{[]string{"/data/hosts/*/in", "/data/spool"}, "/data/other/a.txt", 2},
+		{[]string{"/data/hosts/web01/in", "/data/hosts/web02/in", "/data/spool"}, "/data/hosts/web02/in/a.txt", 1},
+		{[]string{"/data/hosts/web01/in", "/data/hosts/web02/in", "/data/spool"}, "/data/spool/a.txt", 2},
+		{[]string{"/data/hosts"}, "/data/hosts/web01/a.txt", 0},
+	}
+	for _, tt := range tests {
+		m := &Mapping{Sources: tt.sources}
+		if got := m.priority(filepath.FromSlash(tt.file)); got != tt.want {
+			t.Errorf("priority(%q) with sources %q = %d, want %d", tt.file, tt.sources, got, tt.want)
+		}
+	}
+}
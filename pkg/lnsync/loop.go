@@ -0,0 +1,116 @@
+package lnsync
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// checkNesting refuses a destination inside a source of the mapping, or a
+// source inside its destination: every link created would be an event of
+// the source again
+func (m *Mapping) checkNesting() error {
+	for _, destination := range m.destinations() {
+		dest := resolvePath(destination)
+		for _, src := range m.Sources {
+			if watches(src, dest, true) {
+				return errors.New("mapping <" + m.Name + ">: destination " + destination +
+					" is inside source " + src + ", its links would feed back into it")
+			}
+			if within(resolvePath(globBase(src)), dest) {
+				return errors.New("mapping <" + m.Name + ">: source " + src +
+					" is inside destination " + destination + ", its links would feed back into it")
+			}
+		}
+	}
+	return nil
+}
+
+// CheckLoops refuses mappings which feed each other in a circle, the
+// destination of each being watched as a source of the next. Chains of
+// mappings are fine.
+func (c *Config) CheckLoops() error {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	marks := make([]int, len(c.Mappings))
+	path := make([]string, 0)
+	var visit func(idx int) error
+	visit = func(idx int) error {
+		marks[idx] = visiting
+		path = append(path, c.Mappings[idx].Name)
+		for next := range c.Mappings {
+			if !c.feeds(idx, next) {
+				continue
+			}
+			if marks[next] == visiting {
+				return errors.New("mappings feed each other in a loop: " + strings.Join(path, " -> ") +
+					" -> " + c.Mappings[next].Name)
+			}
+			if marks[next] == unvisited {
+				if err := visit(next); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		marks[idx] = done
+		return nil
+	}
+	for idx := range c.Mappings {
+		if marks[idx] == unvisited {
+			if err := visit(idx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// feeds reports whether mapping from creates links which mapping to
+// watches
+func (c *Config) feeds(from, to int) bool {
+	for _, dest := range c.Mappings[from].destinations() {
+		dest = resolvePath(dest)
+		for _, src := range c.Mappings[to].Sources {
+			if within(resolvePath(globBase(src)), dest) || watches(src, dest, c.Mappings[to].Recursive || c.Mappings[to].WatchParent) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// watches reports whether the source, a directory or a pattern, covers
+// dir, itself or with recursive anywhere below it
+func watches(src, dir string, recursive bool) bool {
+	if !isGlob(src) {
+		src = resolvePath(src)
+		return dir == src || (recursive && within(dir, src))
+	}
+	for {
+		if ok, _ := filepath.Match(src, dir); ok {
+			return true
+		}
+		if !recursive || dir == filepath.Dir(dir) {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// within reports whether path is dir or below it
+func within(path, dir string) bool {
+	sep := string(filepath.Separator)
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, sep)+sep)
+}
+
+// resolvePath follows the symlinks of path as far as it exists
+func resolvePath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return filepath.Clean(path)
+}
@@ -0,0 +1,989 @@
+package lnsync
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errPaused is returned for reconciliation requests while paused
+var errPaused = errors.New("processing is paused")
+
+// Policies for a full event queue
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop-oldest"
+	OverflowRescan     = "rescan"
+)
+
+// maxRetryDelay caps the exponential backoff of failed link operations
+const maxRetryDelay = 5 * time.Minute
+
+// Manager owns the watched source directories of every mapping and
+// dispatches their updates
+type Manager struct {
+	// Retries is the number of times a failed link operation is retried,
+	// starting after RetryDelay and doubling the delay every attempt
+	Retries    int
+	RetryDelay time.Duration
+	// OpTimeout is the deadline of a single link operation, none when 0
+	OpTimeout time.Duration
+	// Overflow decides what a watcher does when the event queue is full:
+	// wait for room, drop the oldest event, or drop events and reconcile
+	// every mapping once the queue has drained
+	Overflow string
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	watchers    sync.WaitGroup
+	applyLock   sync.Mutex
+	conf        *Config
+	parents     map[string]context.CancelFunc
+	lock        sync.Mutex
+	dirs        map[string]*Directory
+	mappings    [][]*Directory
+	syncLock    sync.Mutex
+	update      chan UpdateHeader
+	done        chan bool
+	pendingLock sync.Mutex
+	pending     map[pendingKey]*pendingUpdate
+	queues      []chan UpdateHeader
+	retrying    int64
+	orderLock   sync.Mutex
+	blocked     map[string][]UpdateHeader
+	inflight    int64
+	overflowed  int32
+	progress    int64
+	ready       int32
+	started     time.Time
+	ping        chan chan bool
+	drain       chan chan bool
+	pauseLock   sync.Mutex
+	paused      bool
+	held        []UpdateHeader
+	postponed   bool
+	lossLock    sync.Mutex
+	lost        map[string]int
+	routeLock   sync.Mutex
+	routes      map[string]*route
+	queuedLock  sync.Mutex
+	queued      map[uint64]time.Time
+	queueSeq    uint64
+	retryLock   sync.Mutex
+	retries     map[*scheduledRetry]bool
+}
+
+// scheduledRetry is a failed update waiting for its retry, with the
+// failure it is recorded with if the retry never runs
+type scheduledRetry struct {
+	update UpdateHeader
+	err    error
+	timer  *time.Timer
+}
+
+// route sends the updates of an entry renamed to where the rename went,
+// until every update routed that way was applied
+type route struct {
+	key  string
+	refs int
+}
+
+type pendingKey struct {
+	dir  *Directory
+	name string
+}
+
+// pendingUpdate collects the events of one path during a debounce window
+type pendingUpdate struct {
+	first  UpdateHeader
+	last   UpdateHeader
+	window time.Duration
+	timer  *time.Timer
+}
+
+// NewManager starts the given number of link workers, each with a queue of
+// queueSize updates. The event queue between the watchers and Run holds
+// queueSize updates as well. Cancelling ctx stops the watchers, workers and
+// Run.
+func NewManager(ctx context.Context, workers, queueSize int) *Manager {
+	if workers < 1 {
+		workers = 1
+	}
+	m := &Manager{
+		dirs:    make(map[string]*Directory),
+		update:  make(chan UpdateHeader, queueSize),
+		done:    make(chan bool),
+		pending: make(map[pendingKey]*pendingUpdate),
+		blocked: make(map[string][]UpdateHeader),
+		lost:    make(map[string]int),
+		routes:  make(map[string]*route),
+		queued:  make(map[uint64]time.Time),
+		retries: make(map[*scheduledRetry]bool),
+		queues:  make([]chan UpdateHeader, workers),
+		ping:    make(chan chan bool),
+		drain:   make(chan chan bool),
+		started: time.Now(),
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	for idx := range m.queues {
+		m.queues[idx] = make(chan UpdateHeader, queueSize)
+		go m.worker(m.queues[idx])
+	}
+	return m
+}
+
+func (m *Manager) worker(queue chan UpdateHeader) {
+	for {
+		select {
+		case update := <-queue:
+			m.dequeued(update)
+			m.process(update)
+			atomic.AddInt64(&m.inflight, -1)
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// process applies an update. While a failed update of the same entry waits
+// for its retry, later updates are held back and applied in order after it,
+// so a retried create never lands after the delete that followed it.
+func (m *Manager) process(update UpdateHeader) {
+	key := update.key
+	m.orderLock.Lock()
+	if backlog, blocked := m.blocked[key]; blocked && update.Attempt == 0 {
+		m.blocked[key] = append(backlog, update)
+		m.orderLock.Unlock()
+		atomic.AddInt64(&m.retrying, 1)
+		return
+	}
+	m.orderLock.Unlock()
+	for {
+		retried := m.run(update)
+		if !retried {
+			m.unroute(update)
+		}
+		m.orderLock.Lock()
+		backlog, blocked := m.blocked[key]
+		if retried {
+			if !blocked {
+				m.blocked[key] = nil
+			}
+			m.orderLock.Unlock()
+			return
+		}
+		if !blocked {
+			m.orderLock.Unlock()
+			return
+		}
+		if len(backlog) == 0 {
+			delete(m.blocked, key)
+			m.orderLock.Unlock()
+			return
+		}
+		update, m.blocked[key] = backlog[0], backlog[1:]
+		m.orderLock.Unlock()
+		atomic.AddInt64(&m.retrying, -1)
+	}
+}
+
+// run applies a single update and reports whether it was scheduled for a
+// retry
+func (m *Manager) run(update UpdateHeader) bool {
+	ctx := m.ctx
+	if m.OpTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.OpTimeout)
+		defer cancel()
+	}
+	ctx, span := traceUpdate(ctx, &update)
+	start := time.Now()
+	err := update.Path.UpdateDirs(ctx, update.Path.Dist, update)
+	observeUpdate(update.Path.Mapping, time.Since(start))
+	endSpan(span, err)
+	atomic.StoreInt64(&m.progress, time.Now().UnixNano())
+	if err != nil {
+		countError(err)
+		observeFailure()
+		update.Path.recordError(err)
+		notifyWriteError(update.Path.Mapping, err)
+		return m.retry(update, err)
+	}
+	return false
+}
+
+// retry schedules a failed update again with exponential backoff and
+// reports whether it did. An update which cannot be retried is recorded in
+// the dead-letter file.
+func (m *Manager) retry(update UpdateHeader, err error) bool {
+	if m.ctx.Err() != nil || !update.retryable(err) {
+		deadLetter(&update, err)
+		return false
+	}
+	if update.Attempt >= m.Retries {
+		slog.Error("giving up on update", "event", eventName(&update.Event), "source", update.Event.Name,
+			"attempts", update.Attempt+1, "error", err)
+		notify("giving up on update: "+update.Path.Mapping.Name, eventName(&update.Event)+" "+update.Event.Name+
+			" failed after "+strconv.Itoa(update.Attempt+1)+" attempts: "+err.Error())
+		deadLetter(&update, err)
+		return false
+	}
+	delay := m.RetryDelay << uint(update.Attempt)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	scheduled := &scheduledRetry{update: update, err: err}
+	update.Attempt++
+	slog.Warn("retrying update", "event", eventName(&update.Event), "source", update.Event.Name,
+		"attempt", update.Attempt, "delay", delay)
+	atomic.AddInt64(&m.retrying, 1)
+	m.retryLock.Lock()
+	m.retries[scheduled] = true
+	scheduled.timer = time.AfterFunc(delay, func() {
+		m.retryLock.Lock()
+		ok := m.retries[scheduled]
+		delete(m.retries, scheduled)
+		m.retryLock.Unlock()
+		if !ok {
+			return
+		}
+		atomic.AddInt64(&m.retrying, -1)
+		if m.ctx.Err() == nil {
+			m.enqueue(update)
+		} else {
+			deadLetter(&scheduled.update, err)
+		}
+	})
+	m.retryLock.Unlock()
+	return true
+}
+
+// dropRetries stops the retries still scheduled and records their updates
+// in the dead-letter file
+func (m *Manager) dropRetries() {
+	m.retryLock.Lock()
+	dropped := make([]*scheduledRetry, 0, len(m.retries))
+	for scheduled := range m.retries {
+		scheduled.timer.Stop()
+		dropped = append(dropped, scheduled)
+	}
+	clear(m.retries)
+	m.retryLock.Unlock()
+	if len(dropped) != 0 {
+		slog.Warn("dropping updates waiting for a retry", "retrying", len(dropped))
+	}
+	for _, scheduled := range dropped {
+		atomic.AddInt64(&m.retrying, -1)
+		deadLetter(&scheduled.update, scheduled.err)
+	}
+}
+
+// enqueue hands an update to a worker. Updates are partitioned by their
+// destination entry, so operations on one entry never race each other and
+// apply in event order. A full queue blocks the caller.
+func (m *Manager) enqueue(update UpdateHeader) {
+	m.pauseLock.Lock()
+	defer m.pauseLock.Unlock()
+	if m.paused {
+		m.held = append(m.held, update)
+		return
+	}
+	m.push(update)
+}
+
+// key names the destination entry an update operates on
+func (m *Manager) key(update UpdateHeader) string {
+	name := update.Event.Name
+	if len(update.OldName) != 0 {
+		name = update.OldName
+	}
+	return entryKey(update.Path, name)
+}
+
+// entryKey names the destination entry of the source file name. Content
+// named entries are named by their source file instead: hashing it here
+// would hold up the dispatch of every event, it is left to the worker.
+func entryKey(dir *Directory, name string) string {
+	if len(dir.Mapping.ContentNames) != 0 {
+		return dir.Dist + "/" + dir.Mapping.Name + ":" + name
+	}
+	return dir.Dist + "/" + dir.linkName(name)
+}
+
+// route sets the key of an update on its first way to a worker. A rename
+// is keyed by the entry it moves, and the updates of the new entry follow
+// it to the same worker until it was applied, so they never overtake it.
+func (m *Manager) route(update *UpdateHeader) {
+	if len(update.key) != 0 {
+		return
+	}
+	m.routeLock.Lock()
+	defer m.routeLock.Unlock()
+	update.key = m.key(*update)
+	if r, ok := m.routes[update.key]; ok {
+		r.refs++
+		update.routes = append(update.routes, update.key)
+		update.key = r.key
+	}
+	if len(update.OldName) == 0 {
+		return
+	}
+	name := entryKey(update.Path, update.Event.Name)
+	r, ok := m.routes[name]
+	if !ok {
+		r = &route{key: update.key}
+		m.routes[name] = r
+	}
+	r.refs++
+	update.routes = append(update.routes, name)
+}
+
+// unroute releases the routes held by an update once it was applied or
+// given up on
+func (m *Manager) unroute(update UpdateHeader) {
+	if len(update.routes) == 0 {
+		return
+	}
+	m.routeLock.Lock()
+	defer m.routeLock.Unlock()
+	for _, name := range update.routes {
+		if r, ok := m.routes[name]; ok {
+			if r.refs--; r.refs <= 0 {
+				delete(m.routes, name)
+			}
+		}
+	}
+}
+
+// push queues an update to the worker owning its destination entry, and a
+// copy of a new one for every further destination of its mapping
+func (m *Manager) push(update UpdateHeader) {
+	for _, replica := range update.fanOut() {
+		m.pushOne(replica)
+	}
+	m.pushOne(update)
+}
+
+func (m *Manager) pushOne(update UpdateHeader) {
+	m.route(&update)
+	m.queue(&update)
+	atomic.AddInt64(&m.inflight, 1)
+	select {
+	case m.queues[m.queueOf(update)] <- update:
+	case <-m.ctx.Done():
+		m.dequeued(update)
+		m.unroute(update)
+		atomic.AddInt64(&m.inflight, -1)
+	}
+}
+
+// queue records when an update arrived, for the queue_age alert. Retries
+// wait on purpose and are not tracked.
+func (m *Manager) queue(update *UpdateHeader) {
+	if update.Attempt != 0 || update.received.IsZero() {
+		return
+	}
+	m.queuedLock.Lock()
+	m.queueSeq++
+	update.seq = m.queueSeq
+	m.queued[update.seq] = update.received
+	m.queuedLock.Unlock()
+}
+
+// dequeued forgets the arrival of an update a worker took
+func (m *Manager) dequeued(update UpdateHeader) {
+	if update.seq == 0 {
+		return
+	}
+	m.queuedLock.Lock()
+	delete(m.queued, update.seq)
+	m.queuedLock.Unlock()
+}
+
+// QueueAge is how long the oldest update waiting in the debounce window or
+// for a link worker has been waiting since its event arrived
+func (m *Manager) QueueAge() time.Duration {
+	var oldest time.Time
+	older := func(at time.Time) {
+		if !at.IsZero() && (oldest.IsZero() || at.Before(oldest)) {
+			oldest = at
+		}
+	}
+	m.queuedLock.Lock()
+	for _, at := range m.queued {
+		older(at)
+	}
+	m.queuedLock.Unlock()
+	m.pendingLock.Lock()
+	for _, p := range m.pending {
+		older(p.first.received)
+	}
+	m.pendingLock.Unlock()
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// queueOf picks the worker of an update by its key. A mapping
+// limited to fewer workers than the manager runs keeps to a range of
+// them, chosen by its name.
+func (m *Manager) queueOf(update UpdateHeader) int {
+	h := fnv.New32a()
+	h.Write([]byte(update.key))
+	workers := uint32(len(m.queues))
+	limit := update.Path.Mapping.Workers
+	if limit <= 0 || limit >= len(m.queues) {
+		return int(h.Sum32() % workers)
+	}
+	base := fnv.New32a()
+	base.Write([]byte(update.Path.Mapping.Name))
+	return int((base.Sum32() + h.Sum32()%uint32(limit)) % workers)
+}
+
+// Apply brings the set of watched directories in line with conf: watchers
+// of removed or changed mappings are stopped, new ones are started and
+// every mapping goes through a reconciliation pass. Updates already queued
+// by stopped watchers are still applied.
+func (m *Manager) Apply(conf *Config) (err error) {
+	m.applyLock.Lock()
+	defer m.applyLock.Unlock()
+	return m.apply(conf)
+}
+
+func (m *Manager) apply(conf *Config) (err error) {
+	m.lock.Lock()
+	m.conf = conf
+	dirs := make(map[string]*Directory)
+	mappings := make([][]*Directory, 0, len(conf.Mappings))
+	started := make([]*Directory, 0)
+	for idx := range conf.Mappings {
+		mapping := conf.Mappings[idx].expanded()
+		mappingDirs := make([]*Directory, 0)
+		replicas := mapping.replicas()
+		fresh := false
+		for _, src := range mapping.Sources {
+			key := mapping.Name + ":" + src
+			if dir, ok := m.dirs[key]; ok && reflect.DeepEqual(*dir.Mapping, *mapping) {
+				dirs[key] = dir
+				mappingDirs = append(mappingDirs, dir)
+				continue
+			}
+			dir := &Directory{Path: src,
+				Dist:    mapping.Destination,
+				Mapping: mapping,
+				Update:  m.update,
+				manager: m,
+				Started: make(chan bool),
+			}
+			dir.ctx, dir.cancel = context.WithCancel(m.ctx)
+			for _, replica := range replicas {
+				dir.replicas = append(dir.replicas, dir.newReplica(replica))
+			}
+			dirs[key] = dir
+			mappingDirs = append(mappingDirs, dir)
+			started = append(started, dir)
+			fresh = true
+			m.watchers.Add(1)
+			go func() {
+				defer m.watchers.Done()
+				dir.InitFSWatch()
+			}()
+		}
+		// every further destination is a mapping of its own, fed by the
+		// watchers of the first
+		groups := [][]*Directory{mappingDirs}
+		for idx := range replicas {
+			group := make([]*Directory, 0, len(mappingDirs))
+			for _, dir := range mappingDirs {
+				group = append(group, dir.replicas[idx])
+			}
+			groups = append(groups, group)
+		}
+		for _, group := range groups {
+			if fresh {
+				m.startGuards(group)
+			}
+			mappings = append(mappings, group)
+		}
+	}
+	removed := make([]*Directory, 0)
+	for key, dir := range m.dirs {
+		if dirs[key] != dir {
+			removed = append(removed, dir)
+		}
+	}
+	m.dirs = dirs
+	m.mappings = mappings
+	m.lock.Unlock()
+	m.watchParents(conf)
+
+	// reconcile only once the watchers are registered, so no change made
+	// during the pass goes unnoticed
+	for _, dir := range started {
+		<-dir.Started
+	}
+	if m.postpone() {
+		slog.Info("processing paused, reconciliation postponed until resume")
+	} else {
+		err = m.reconcile(mappings)
+	}
+	atomic.StoreInt32(&m.ready, 1)
+	for _, dir := range removed {
+		slog.Info("stop watching source", "mapping", dir.Mapping.Name, "source", dir.Path)
+		dir.cancel()
+	}
+	return err
+}
+
+// startGuards starts the destination guard, manifest and permission check
+// of a mapping, which go with its watchers and are all replaced when it
+// changes. The permissions of every destination are checked along with
+// the first one.
+func (m *Manager) startGuards(dirs []*Directory) {
+	mapping := dirs[0].Mapping
+	if len(mapping.Tamper) != 0 {
+		m.watchers.Add(1)
+		go func() {
+			defer m.watchers.Done()
+			m.guardDestination(dirs[0].ctx, dirs)
+		}()
+	}
+	if len(mapping.Manifest) != 0 {
+		m.watchers.Add(1)
+		go func() {
+			defer m.watchers.Done()
+			m.maintainManifest(dirs[0].ctx, dirs)
+		}()
+	}
+	if len(mapping.DestPerms) != 0 && dirs[0].origin == nil {
+		m.watchers.Add(1)
+		go func() {
+			defer m.watchers.Done()
+			m.enforceDestPerms(dirs[0].ctx, dirs)
+		}()
+	}
+}
+
+// Pause stops applying updates. Events are still collected and held back
+// until Resume, and reconciliation passes are refused or postponed.
+func (m *Manager) Pause() {
+	m.pauseLock.Lock()
+	defer m.pauseLock.Unlock()
+	if !m.paused {
+		slog.Info("processing paused")
+	}
+	m.paused = true
+}
+
+// Resume applies the updates held back while paused, in arrival order, and
+// returns their number
+func (m *Manager) Resume() int {
+	m.pauseLock.Lock()
+	held, postponed := m.held, m.postponed
+	m.paused, m.held, m.postponed = false, nil, false
+	for _, update := range held {
+		m.push(update)
+	}
+	m.pauseLock.Unlock()
+	if len(held) != 0 {
+		slog.Info("processing resumed", "held", len(held))
+	} else {
+		slog.Info("processing resumed")
+	}
+	if postponed {
+		go m.Resync()
+	}
+	return len(held)
+}
+
+// postpone reports whether processing is paused, and if so remembers to
+// reconcile on resume
+func (m *Manager) postpone() bool {
+	m.pauseLock.Lock()
+	defer m.pauseLock.Unlock()
+	if m.paused {
+		m.postponed = true
+	}
+	return m.paused
+}
+
+// Paused reports whether processing is paused and how many updates are
+// held back
+func (m *Manager) Paused() (bool, int) {
+	m.pauseLock.Lock()
+	defer m.pauseLock.Unlock()
+	return m.paused, len(m.held)
+}
+
+// Ping reports whether the event loop answers within timeout
+func (m *Manager) Ping(timeout time.Duration) bool {
+	reply := make(chan bool, 1)
+	select {
+	case m.ping <- reply:
+		return <-reply
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Resync runs a reconciliation pass over every mapping, repairing links
+// missed by the watchers or changed behind our back
+func (m *Manager) Resync() error {
+	return m.Rescan("")
+}
+
+// Rescan reconciles the named mapping, or every mapping when name is empty
+func (m *Manager) Rescan(name string) error {
+	mappings, err := m.rescanTargets(name)
+	if err != nil {
+		return err
+	}
+	return m.reconcile(mappings)
+}
+
+// StartRescan is Rescan in the background, for callers which cannot wait
+// for a pass over large trees. Errors of the pass are logged.
+func (m *Manager) StartRescan(name string) error {
+	mappings, err := m.rescanTargets(name)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := m.reconcile(mappings); err != nil {
+			slog.Error("rescan failed", "mapping", name, "error", err)
+		}
+	}()
+	return nil
+}
+
+func (m *Manager) rescanTargets(name string) ([][]*Directory, error) {
+	if paused, _ := m.Paused(); paused {
+		return nil, errPaused
+	}
+	m.lock.Lock()
+	mappings := make([][]*Directory, 0, len(m.mappings))
+	for _, dirs := range m.mappings {
+		if len(dirs) != 0 && (len(name) == 0 || dirs[0].Mapping.Name == name) {
+			mappings = append(mappings, dirs)
+		}
+	}
+	m.lock.Unlock()
+	if len(mappings) == 0 && len(name) != 0 {
+		return nil, errors.New("unknown mapping " + name)
+	}
+	return mappings, nil
+}
+
+// rescanLater reconciles a mapping whose watcher lost events in the
+// background. Requests arriving during that pass cause one more pass after
+// it, as the first one may already have walked past the lost changes.
+func (m *Manager) rescanLater(name string) {
+	if m.postpone() {
+		return
+	}
+	m.lossLock.Lock()
+	defer m.lossLock.Unlock()
+	if m.lost[name] != 0 {
+		m.lost[name] = 2
+		return
+	}
+	m.lost[name] = 1
+	go func() {
+		for {
+			if err := m.Rescan(name); err == errPaused {
+				m.postpone()
+			} else if err != nil {
+				slog.Error("background rescan failed", "mapping", name, "error", err)
+			}
+			m.lossLock.Lock()
+			if m.lost[name] == 1 || m.ctx.Err() != nil {
+				delete(m.lost, name)
+				m.lossLock.Unlock()
+				return
+			}
+			m.lost[name] = 1
+			m.lossLock.Unlock()
+		}
+	}()
+}
+
+// ResyncEvery runs Resync periodically
+func (m *Manager) ResyncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			return
+		}
+		if paused, _ := m.Paused(); paused {
+			continue
+		}
+		slog.Info("starting periodic resync")
+		m.Resync()
+	}
+}
+
+func (m *Manager) reconcile(mappings [][]*Directory) (err error) {
+	m.syncLock.Lock()
+	defer m.syncLock.Unlock()
+	for _, dirs := range mappings {
+		if len(dirs) == 0 {
+			continue
+		}
+		mapping := dirs[0].Mapping
+		start := time.Now()
+		slog.Info("reconciling mapping", "mapping", mapping.Name, "destination", mapping.Destination)
+		// the first destination checks the permissions of all of them
+		if dirs[0].origin == nil {
+			if perr := m.checkDestPerms(mapping); perr != nil {
+				countError(perr)
+				err = perr
+			}
+		}
+		if len(mapping.DestPerms) != 0 && destRefused(mapping.Destination) {
+			continue
+		}
+		if cerr := cleanDirs(m.ctx, dirs, mapping.Destination); cerr != nil {
+			slog.Error("reconciliation failed", "mapping", mapping.Name, "destination", mapping.Destination,
+				"error", cerr)
+			countError(cerr)
+			err = cerr
+			continue
+		}
+		slog.Info("mapping reconciled", "mapping", mapping.Name, "destination", mapping.Destination,
+			"duration", time.Since(start))
+	}
+	return err
+}
+
+// Stop cancels the context of the manager and waits for the watchers and
+// Run to return
+func (m *Manager) Stop() {
+	m.cancel()
+	m.watchers.Wait()
+	<-m.done
+}
+
+// overflow handles an update which found the event queue full
+func (m *Manager) overflow(update UpdateHeader) {
+	switch m.Overflow {
+	case OverflowDropOldest:
+		select {
+		case old := <-m.update:
+			countDropped()
+			slog.Warn("event queue full, dropping oldest event", "event", eventName(&old.Event),
+				"source", old.Event.Name)
+		default:
+		}
+	case OverflowRescan:
+		countDropped()
+		if atomic.CompareAndSwapInt32(&m.overflowed, 0, 1) {
+			slog.Warn("event queue full, dropping events until a rescan")
+		}
+		return
+	}
+	select {
+	case m.update <- update:
+	case <-update.Path.ctx.Done():
+	}
+}
+
+// directory returns the watched source src of the named mapping
+func (m *Manager) directory(mapping, src string) *Directory {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.dirs[mapping+":"+src]
+}
+
+// siblings returns the watched sources of the mapping and destination of
+// d, one for every directory its source patterns match or its parents hold
+func (m *Manager) siblings(d *Directory) []*Directory {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, dirs := range m.mappings {
+		if slices.Contains(dirs, d) {
+			return slices.Clone(dirs)
+		}
+	}
+	return nil
+}
+
+// Shutdown stops the watchers, drains the event queue, applies the updates
+// received so far and stops the manager. Updates still pending after
+// timeout are dropped, as are updates held back while paused. Updates
+// waiting for a retry are dropped and recorded in the dead-letter file.
+func (m *Manager) Shutdown(timeout time.Duration) error {
+	m.lock.Lock()
+	for _, dir := range m.dirs {
+		dir.cancel()
+	}
+	m.lock.Unlock()
+	m.watchers.Wait()
+
+	// with the watchers gone nothing is added to the event queue anymore,
+	// and once Run dispatched what it holds all updates are either queued
+	// to a worker or pending
+	reply := make(chan bool)
+	select {
+	case m.drain <- reply:
+		<-reply
+	case <-m.done:
+	}
+	m.pendingLock.Lock()
+	keys := make([]pendingKey, 0, len(m.pending))
+	for key := range m.pending {
+		keys = append(keys, key)
+	}
+	m.pendingLock.Unlock()
+	for _, key := range keys {
+		m.flush(key)
+	}
+	if paused, held := m.Paused(); paused && held != 0 {
+		slog.Warn("dropping updates held back while paused", "held", held)
+	}
+
+	var err error
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&m.inflight) > 0 {
+		if time.Now().After(deadline) {
+			err = errors.New("shutdown timed out with " +
+				strconv.FormatInt(atomic.LoadInt64(&m.inflight), 10) + " updates pending")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.cancel()
+	<-m.done
+	return err
+}
+
+// Run dispatches updates until the context of the manager is cancelled
+func (m *Manager) Run() {
+	defer close(m.done)
+	for {
+		select {
+		case <-m.ctx.Done():
+			m.dropRetries()
+			return
+		case fileUpdate := <-m.update:
+			m.dispatch(fileUpdate)
+			if len(m.update) == 0 && atomic.CompareAndSwapInt32(&m.overflowed, 1, 0) {
+				slog.Warn("event queue drained after overflow, reconciling")
+				go m.Resync()
+			}
+		case reply := <-m.ping:
+			reply <- true
+		case reply := <-m.drain:
+			for len(m.update) != 0 {
+				m.dispatch(<-m.update)
+			}
+			reply <- true
+		}
+	}
+}
+
+// dispatch applies an update, or holds it back for the debounce window of
+// its mapping so a burst of events for one path results in one action. A
+// new file is held back for the settle window of the mapping if that is
+// longer.
+func (m *Manager) dispatch(update UpdateHeader) {
+	window := update.Path.Mapping.Debounce.Duration
+	if settle := update.Path.Mapping.Settle.Duration; update.Event.IsCreate() && settle > window {
+		window = settle
+	}
+	if window <= 0 {
+		m.enqueue(update)
+		return
+	}
+	if len(update.OldName) != 0 {
+		// the moved-from path must be settled before it is renamed
+		m.flush(pendingKey{update.Path, update.OldName})
+		m.enqueue(update)
+		return
+	}
+
+	key := pendingKey{update.Path, update.Event.Name}
+	m.pendingLock.Lock()
+	defer m.pendingLock.Unlock()
+	if p, ok := m.pending[key]; ok {
+		p.last = update
+		p.timer.Reset(p.window)
+		return
+	}
+	m.pending[key] = &pendingUpdate{
+		first:  update,
+		last:   update,
+		window: window,
+		timer:  time.AfterFunc(window, func() { m.settle(key) }),
+	}
+}
+
+// settle flushes the pending update of key when its window passed, unless
+// the file is new and was modified within the settle window without an
+// event, as happens on network filesystems
+func (m *Manager) settle(key pendingKey) {
+	m.pendingLock.Lock()
+	if p, ok := m.pending[key]; ok {
+		if wait := p.unsettled(); wait > 0 {
+			p.timer.Reset(wait)
+			m.pendingLock.Unlock()
+			return
+		}
+	}
+	m.pendingLock.Unlock()
+	m.flush(key)
+}
+
+func (m *Manager) flush(key pendingKey) {
+	m.pendingLock.Lock()
+	p, ok := m.pending[key]
+	delete(m.pending, key)
+	m.pendingLock.Unlock()
+	if !ok {
+		return
+	}
+	p.timer.Stop()
+	if update, ok := p.coalesce(); ok {
+		m.enqueue(update)
+	}
+}
+
+// unsettled returns how long a new file has to stay unmodified until it
+// settled
+func (p *pendingUpdate) unsettled() time.Duration {
+	settle := p.first.Path.Mapping.Settle.Duration
+	if settle <= 0 || !p.first.Event.IsCreate() {
+		return 0
+	}
+	info, err := os.Stat(p.first.Event.Name)
+	if err != nil {
+		return 0
+	}
+	return settle - time.Since(info.ModTime())
+}
+
+// coalesce reduces the events seen for a path to the single action that
+// leads to its final state. A file created and removed within the window
+// needs no action at all.
+func (p *pendingUpdate) coalesce() (UpdateHeader, bool) {
+	created := p.first.Event.IsCreate()
+	last := p.last.Event
+	switch {
+	case last.IsRemove() || last.IsRename():
+		return p.last, !created
+	case (last.IsWrite() || last.IsChmod()) && created:
+		return p.first, true
+	}
+	return p.last, true
+}
@@ -0,0 +1,145 @@
+package lnsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRouteRename(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	dir := &Directory{Path: src, Dist: dest, Mapping: &Mapping{Name: "test", Sources: []string{src}, Destination: dest}}
+	m := &Manager{routes: make(map[string]*route)}
+	update := func(name, oldName string) UpdateHeader {
+		u := UpdateHeader{Event: Event{Name: filepath.Join(src, name)}, Path: dir}
+		if len(oldName) != 0 {
+			u.OldName = filepath.Join(src, oldName)
+		}
+		m.route(&u)
+		return u
+	}
+
+	rename := update("b", "a")
+	follow := update("b", "")
+	if follow.key != rename.key {
+		t.Fatalf("update after rename keyed %q, want the key of the rename %q", follow.key, rename.key)
+	}
+	chained := update("c", "b")
+	if chained.key != rename.key {
+		t.Fatalf("rename of the renamed entry keyed %q, want %q", chained.key, rename.key)
+	}
+	m.unroute(rename)
+	m.unroute(follow)
+	if other := update("b", ""); other.key != rename.key {
+		t.Fatalf("update keyed %q while the chained rename is pending, want %q", other.key, rename.key)
+	} else {
+		m.unroute(other)
+	}
+	m.unroute(chained)
+	if len(m.routes) != 0 {
+		t.Fatalf("routes left after all updates were applied: %v", m.routes)
+	}
+	if own := update("b", ""); own.key != m.key(own) {
+		t.Fatalf("update keyed %q once the rename was applied, want its own entry", own.key)
+	}
+}
+
+func TestEntryKeyContentNames(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	dir := &Directory{Path: src, Dist: dest, Mapping: &Mapping{Name: "test", Sources: []string{src}, Destination: dest,
+		ContentNames: ContentNamesHash}}
+	a, b := filepath.Join(src, "a"), filepath.Join(src, "b")
+	for _, name := range []string{a, b} {
+		if err := os.WriteFile(name, []byte("content\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entryKey(dir, a) == entryKey(dir, b) {
+		t.Fatalf("files of a content named mapping share the key %q", entryKey(dir, a))
+	}
+	if _, ok := dir.names.Load(a); ok {
+		t.Fatal("keying an update of a content named mapping hashed the file")
+	}
+}
+
+func TestCheckDestPermsEveryDestination(t *testing.T) {
+	src, first, second := t.TempDir(), t.TempDir(), t.TempDir()
+	for _, dest := range []string{first, second} {
+		if err := os.Chmod(dest, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(second, 0777); err != nil {
+		t.Fatal(err)
+	}
+	m := &Mapping{Name: "test", Sources: []string{src}, Destination: first, Destinations: []string{first, second},
+		DestPerms: DestPermsRefuse}
+	defer refusedDests.Delete(second)
+	if err := (&Manager{}).checkDestPerms(m); err == nil {
+		t.Fatal("world-writable second destination not refused")
+	}
+	if destRefused(first) || !destRefused(second) {
+		t.Fatalf("refused first %v, second %v, want only the second", destRefused(first), destRefused(second))
+	}
+}
+
+func TestQueueAge(t *testing.T) {
+	m := &Manager{queued: make(map[uint64]time.Time), pending: make(map[pendingKey]*pendingUpdate)}
+	if age := m.QueueAge(); age != 0 {
+		t.Fatalf("QueueAge() = %v with nothing queued, want 0", age)
+	}
+	queued := UpdateHeader{received: time.Now().Add(-time.Minute)}
+	m.queue(&queued)
+	retry := UpdateHeader{received: time.Now().Add(-time.Hour), Attempt: 1}
+	m.queue(&retry)
+	if age := m.QueueAge(); age < time.Minute || age > 2*time.Minute {
+		t.Fatalf("QueueAge() = %v, want the minute of the queued update", age)
+	}
+	m.pending[pendingKey{name: "a"}] = &pendingUpdate{first: UpdateHeader{received: time.Now().Add(-3 * time.Minute)}}
+	if age := m.QueueAge(); age < 3*time.Minute {
+		t.Fatalf("QueueAge() = %v, want the three minutes of the debounced update", age)
+	}
+	delete(m.pending, pendingKey{name: "a"})
+	m.dequeued(queued)
+	if age := m.QueueAge(); age != 0 {
+		t.Fatalf("QueueAge() = %v once the worker took the update, want 0", age)
+	}
+}
+
+func TestDropRetriesDeadLetter(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	file := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	SetDeadLetter(file)
+	t.Cleanup(func() { SetDeadLetter("") })
+	name := filepath.Join(src, "a")
+	if err := os.WriteFile(name, []byte("content\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := &Directory{Path: src, Dist: dest, Mapping: &Mapping{Name: "test", Sources: []string{src}, Destination: dest}}
+	m := NewManager(context.Background(), 1, 1)
+	t.Cleanup(m.cancel)
+	m.Retries, m.RetryDelay = 3, time.Hour
+	update := UpdateHeader{Event: Event{Name: name, Op: OpCreate}, Path: dir}
+
+	if m.retry(update, os.ErrExist) {
+		t.Fatal("retry() scheduled an update which cannot succeed")
+	}
+	if !m.retry(update, errors.New("read-only file system")) {
+		t.Fatal("retry() did not schedule a retryable update")
+	}
+	m.dropRetries()
+	if depth := m.RetryDepth(); depth != 0 {
+		t.Errorf("RetryDepth() = %d after dropping the retries, want 0", depth)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 2 {
+		t.Fatalf("dead-letter file has %d records, want 2:\n%s", lines, data)
+	}
+}
@@ -0,0 +1,138 @@
+package lnsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the destination manifest
+const (
+	ManifestJSON = "json"
+	ManifestTSV  = "tsv"
+)
+
+// manifestPrefix starts the name of the manifest in the destination, which
+// is not a link and left alone by reconciliation
+const manifestPrefix = ".lnsync-manifest"
+
+// manifestDelay collects link events before the manifest is rewritten
+const manifestDelay = time.Second
+
+// Manifest lists the managed entries of a destination
+type Manifest struct {
+	Mapping   string          `json:"mapping"`
+	Generated time.Time       `json:"generated"`
+	Links     []ManifestEntry `json:"links"`
+}
+
+// ManifestEntry is one destination entry, Link relative to the
+// destination. Size and ModTime are those of the source file.
+type ManifestEntry struct {
+	Link    string    `json:"link"`
+	Source  string    `json:"source"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+func manifestFile(m *Mapping) string {
+	return filepath.Join(m.Destination, manifestPrefix+"."+m.Manifest)
+}
+
+func isManifest(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), manifestPrefix)
+}
+
+// maintainManifest rewrites the manifest of the mapping whose sources are
+// dirs shortly after its links change, until ctx is done
+func (m *Manager) maintainManifest(ctx context.Context, dirs []*Directory) {
+	mapping := dirs[0].Mapping
+	events := subscribe()
+	defer unsubscribe(events)
+	write := time.After(manifestDelay)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Mapping == mapping.Name && write == nil {
+				write = time.After(manifestDelay)
+			}
+		case <-write:
+			write = nil
+			if err := writeManifest(mapping); err != nil {
+				slog.Error("writing manifest failed", "mapping", mapping.Name, "destination", mapping.Destination,
+					"error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// buildManifest lists the managed entries of the destination of mapping
+func buildManifest(mapping *Mapping) (*Manifest, error) {
+	names, err := listTarget(mapping.Destination, mapping.nested())
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	manifest := &Manifest{Mapping: mapping.Name, Generated: time.Now(), Links: make([]ManifestEntry, 0, len(names))}
+	for _, name := range names {
+		link := mapping.Destination + "/" + name
+		if state != nil && !state.Owns(link) {
+			continue
+		}
+		entry := ManifestEntry{Link: name}
+		if rec, ok := state.Record(link); ok {
+			entry.Source = rec.Source
+		} else if target, err := readLink(link); err == nil {
+			entry.Source = target
+		}
+		if info, err := os.Stat(link); err == nil {
+			entry.Size, entry.ModTime = info.Size(), info.ModTime()
+		}
+		manifest.Links = append(manifest.Links, entry)
+	}
+	return manifest, nil
+}
+
+// writeManifest writes the manifest under a temporary name and renames it
+// into place, so readers always find a complete one
+func writeManifest(mapping *Mapping) error {
+	manifest, err := buildManifest(mapping)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	switch mapping.Manifest {
+	case ManifestTSV:
+		buf.WriteString("link\tsource\tsize\tmtime\n")
+		for _, entry := range manifest.Links {
+			buf.WriteString(entry.Link + "\t" + entry.Source + "\t" + strconv.FormatInt(entry.Size, 10) + "\t" +
+				entry.ModTime.UTC().Format(time.RFC3339Nano) + "\n")
+		}
+	default:
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(manifest); err != nil {
+			return err
+		}
+	}
+	file := manifestFile(mapping)
+	tmp := tmpName(file)
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	slog.Debug("manifest written", "mapping", mapping.Name, "destination", file, "links", len(manifest.Links))
+	return syncDir(mapping, file)
+}
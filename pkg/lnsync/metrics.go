@@ -0,0 +1,91 @@
+package lnsync
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// ServeHTTP runs the HTTP endpoint of the daemon
+func ServeHTTP(addr string, m *Manager) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, m)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeProblems(w, m.Health())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeProblems(w, m.Ready())
+	})
+	return http.ListenAndServe(addr, mux)
+}
+
+// writeProblems answers a probe: 200 and "ok", or 503 and the problems
+func writeProblems(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain")
+	if len(problems) == 0 {
+		io.WriteString(w, "ok\n")
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, problem := range problems {
+		io.WriteString(w, problem+"\n")
+	}
+}
+
+// writeMetrics renders the counters in the Prometheus text format
+func writeMetrics(w io.Writer, m *Manager) {
+	metric(w, "lnsync_events_total", "counter", "Filesystem events received.")
+	fmt.Fprintln(w, "lnsync_events_total", atomic.LoadInt64(&stats.Events))
+	metric(w, "lnsync_links_created_total", "counter", "Destination entries created.")
+	fmt.Fprintln(w, "lnsync_links_created_total", atomic.LoadInt64(&stats.LinksCreated))
+	metric(w, "lnsync_links_removed_total", "counter", "Destination entries removed.")
+	fmt.Fprintln(w, "lnsync_links_removed_total", atomic.LoadInt64(&stats.LinksRemoved))
+	metric(w, "lnsync_errors_total", "counter", "Failed link operations.")
+	fmt.Fprintln(w, "lnsync_errors_total", atomic.LoadInt64(&stats.Errors))
+	metric(w, "lnsync_events_dropped_total", "counter", "Events dropped because the event queue was full.")
+	fmt.Fprintln(w, "lnsync_events_dropped_total", atomic.LoadInt64(&stats.Dropped))
+	metric(w, "lnsync_watcher_overflows_total", "counter", "Times a watcher lost events and its mapping was rescanned.")
+	fmt.Fprintln(w, "lnsync_watcher_overflows_total", atomic.LoadInt64(&stats.Overflows))
+	metric(w, "lnsync_tampered_total", "counter", "Destination entries found changed by someone else.")
+	fmt.Fprintln(w, "lnsync_tampered_total", atomic.LoadInt64(&stats.Tampered))
+	metric(w, "lnsync_dangling_removed_total", "counter", "Dangling links removed by sweeps.")
+	fmt.Fprintln(w, "lnsync_dangling_removed_total", atomic.LoadInt64(&stats.Swept))
+	metric(w, "lnsync_event_queue_depth", "gauge", "Events waiting to be dispatched.")
+	fmt.Fprintln(w, "lnsync_event_queue_depth", m.EventQueueDepth())
+	metric(w, "lnsync_queue_depth", "gauge", "Updates waiting for a link worker.")
+	fmt.Fprintln(w, "lnsync_queue_depth", m.QueueDepth())
+	metric(w, "lnsync_retry_queue_depth", "gauge", "Failed updates waiting for a retry.")
+	fmt.Fprintln(w, "lnsync_retry_queue_depth", m.RetryDepth())
+
+	dirs := m.Dirs()
+	metric(w, "lnsync_source_events_total", "counter", "Filesystem events received per source.")
+	for _, dir := range dirs {
+		fmt.Fprintln(w, "lnsync_source_events_total"+labels(dir), dir.Events())
+	}
+	metric(w, "lnsync_source_files", "gauge", "Files in the source directory.")
+	for _, dir := range dirs {
+		fmt.Fprintln(w, "lnsync_source_files"+labels(dir), dir.Files())
+	}
+	metric(w, "lnsync_watched_directories", "gauge", "Directories watched per source.")
+	for _, dir := range dirs {
+		fmt.Fprintln(w, "lnsync_watched_directories"+labels(dir), dir.Watched())
+	}
+	metric(w, "lnsync_scanned_directories", "gauge", "Directories scanned per source beyond the kqueue descriptor budget.")
+	for _, dir := range dirs {
+		fmt.Fprintln(w, "lnsync_scanned_directories"+labels(dir), dir.Scanned())
+	}
+}
+
+func metric(w io.Writer, name, kind, help string) {
+	fmt.Fprintln(w, "# HELP", name, help)
+	fmt.Fprintln(w, "# TYPE", name, kind)
+}
+
+func labels(d *Directory) string {
+	return "{mapping=" + strconv.Quote(d.Mapping.Name) + ",source=" + strconv.Quote(d.Path) + "}"
+}
@@ -0,0 +1,107 @@
+package lnsync
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mountPollInterval is how often WaitForMounts looks at the mounts again
+const mountPollInterval = time.Second
+
+// WaitForMounts blocks until the filesystems /etc/fstab mounts below the
+// sources and destination of every mapping are mounted, and the sources
+// exist, so a daemon started early at boot does not mirror an empty
+// mountpoint. It fails after timeout, listing the paths still missing.
+func WaitForMounts(ctx context.Context, conf *Config, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	mountpoints := fstabMountpoints()
+	logged := false
+	for {
+		missing := make([]string, 0)
+		for idx := range conf.Mappings {
+			m := &conf.Mappings[idx]
+			for _, src := range m.Sources {
+				if !mounted(mountpoints, globBase(src), true) {
+					missing = append(missing, globBase(src))
+				}
+			}
+			for _, dest := range m.destinations() {
+				if !mounted(mountpoints, dest, !m.CreateDest) {
+					missing = append(missing, dest)
+				}
+			}
+		}
+		if len(missing) == 0 {
+			if logged {
+				slog.Info("mounts available")
+			}
+			return nil
+		}
+		if !logged {
+			slog.Info("waiting for mounts", "paths", strings.Join(missing, ","), "timeout", timeout)
+			logged = true
+		}
+		select {
+		case <-time.After(mountPollInterval):
+		case <-ctx.Done():
+			return errors.New("timed out waiting for mounts: " + strings.Join(missing, ", "))
+		}
+	}
+}
+
+// mounted reports whether the fstab mountpoint closest above path is
+// mounted, and whether path exists when it must
+func mounted(mountpoints []string, path string, exist bool) bool {
+	best := ""
+	for _, mp := range mountpoints {
+		if (path == mp || strings.HasPrefix(path, mp+"/")) && len(mp) > len(best) {
+			best = mp
+		}
+	}
+	// looking at an autofs mountpoint triggers its mount
+	if len(best) != 0 && !isMountpoint(best) {
+		return false
+	}
+	if !exist {
+		return true
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// fstabMountpoints lists the mountpoints of /etc/fstab but the root
+func fstabMountpoints() []string {
+	mountpoints := make([]string, 0)
+	for _, mp := range readMountpoints("/etc/fstab") {
+		if strings.HasPrefix(mp, "/") && mp != "/" {
+			mountpoints = append(mountpoints, filepath.Clean(mp))
+		}
+	}
+	return mountpoints
+}
+
+// readMountpoints returns the second field of a fstab formatted file
+func readMountpoints(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	mountpoints := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		mountpoints = append(mountpoints, strings.ReplaceAll(fields[1], `\040`, " "))
+	}
+	return mountpoints
+}
@@ -0,0 +1,354 @@
+package lnsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// nameData is what the name template of a mapping is evaluated with
+type nameData struct {
+	Name       string    // file name
+	Stem       string    // file name without extension
+	Ext        string    // extension including the dot, may be empty
+	Dir        string    // directory relative to the source, "." at its top
+	Source     string    // source directory
+	SourceBase string    // last element of the source directory
+	Mapping    string    // mapping name
+	ModTime    time.Time // modification time of the file
+	Date       string    // modification date as 2006-01-02
+}
+
+// templates caches the parsed name templates by their text, so mappings
+// stay comparable when the config is reloaded
+var templates sync.Map
+
+var templateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+func parseNameTemplate(text string) (*template.Template, error) {
+	if tmpl, ok := templates.Load(text); ok {
+		return tmpl.(*template.Template), nil
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	templates.Store(text, tmpl)
+	return tmpl, nil
+}
+
+// checkNameTemplate parses the name template and evaluates it once, so a
+// reference to an unknown field is reported at startup
+func checkNameTemplate(text string) error {
+	tmpl, err := parseNameTemplate(text)
+	if err != nil {
+		return err
+	}
+	var out strings.Builder
+	data := nameData{Name: "file.txt", Stem: "file", Ext: ".txt", Dir: ".", Source: "/src",
+		SourceBase: "src", ModTime: time.Now(), Date: time.Now().Format("2006-01-02")}
+	if err := tmpl.Execute(&out, data); err != nil {
+		return err
+	}
+	if name, ok := cleanName(out.String()); !ok {
+		return errors.New("template yields " + name + " outside the destination")
+	}
+	return nil
+}
+
+// cleanName cleans a generated link name and reports whether it stays
+// within the destination
+func cleanName(name string) (string, bool) {
+	name = filepath.Clean(name)
+	return name, name != "." && name != ".." && !filepath.IsAbs(name) && !strings.HasPrefix(name, "../")
+}
+
+// nested reports whether the mapping places links in subdirectories of
+// its destination, which are then created and pruned as needed
+func (m *Mapping) nested() bool {
+	return m.MirrorTree || m.SourceSubdirs || m.Layout != LayoutFlat || templateNested(m.NameTemplate)
+}
+
+// dirFields are the fields of nameData which may hold a slash
+var dirFields = map[string]bool{"Dir": true, "Source": true}
+
+// templateNested reports whether the name template may yield a path: its
+// text holds a slash or it refers to a field naming a directory
+func templateNested(text string) bool {
+	if strings.Contains(text, "/") {
+		return true
+	}
+	if len(text) == 0 {
+		return false
+	}
+	tmpl, err := parseNameTemplate(text)
+	if err != nil {
+		return false
+	}
+	return nodeNested(tmpl.Tree.Root)
+}
+
+func nodeNested(node parse.Node) bool {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return false
+		}
+		for _, n := range node.Nodes {
+			if nodeNested(n) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeNested(node.Pipe)
+	case *parse.PipeNode:
+		if node == nil {
+			return false
+		}
+		for _, cmd := range node.Cmds {
+			if nodeNested(cmd) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			if nodeNested(arg) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return nodeNested(node.Node)
+	case *parse.FieldNode:
+		return dirFields[node.Ident[0]]
+	case *parse.VariableNode:
+		// $.Dir
+		return len(node.Ident) > 1 && node.Ident[0] == "$" && dirFields[node.Ident[1]]
+	case *parse.IfNode:
+		return nodeNested(node.Pipe) || nodeNested(node.List) || nodeNested(node.ElseList)
+	case *parse.RangeNode:
+		return nodeNested(node.Pipe) || nodeNested(node.List) || nodeNested(node.ElseList)
+	case *parse.WithNode:
+		return nodeNested(node.Pipe) || nodeNested(node.List) || nodeNested(node.ElseList)
+	}
+	return false
+}
+
+// stableNames reports whether link names depend on more than the path of
+// the source file. Such a name is kept for the file once computed, as it
+// must still be known after a change or the removal of the file.
+func (m *Mapping) stableNames() bool {
+	return len(m.NameTemplate) != 0 || m.Layout == LayoutDate || len(m.ContentNames) != 0
+}
+
+// contentName is the content addressed name of a file: the SHA-256 of its
+// contents, followed by its extension or name if the mapping keeps them. A
+// file which cannot be read keeps its name.
+func (m *Mapping) contentName(name, base string) string {
+	sum, err := fileHash(name)
+	if err != nil {
+		slog.Error("hashing file failed, keeping its name", "source", name, "mapping", m.Name, "error", err)
+		return base
+	}
+	switch m.ContentNames {
+	case ContentNamesExt:
+		return sum + filepath.Ext(base)
+	case ContentNamesName:
+		return sum + "__" + base
+	}
+	return sum
+}
+
+// contentHash is the hash of a file as of its size and modification time
+type contentHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// contentHashes caches the hashes of files by path, so a rescan only reads
+// the files changed since they were hashed
+var contentHashes sync.Map
+
+func fileHash(name string) (string, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if cached, ok := contentHashes.Load(name); ok {
+		if c := cached.(contentHash); c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+			return c.sum, nil
+		}
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	contentHashes.Store(name, contentHash{size: info.Size(), modTime: info.ModTime(), sum: sum})
+	return sum, nil
+}
+
+// layoutDir is the subdirectory of the destination the layout of the
+// mapping puts the link of a file in, info being nil if the file is gone
+func (m *Mapping) layoutDir(name string, info os.FileInfo) string {
+	switch m.Layout {
+	case LayoutDate:
+		if info != nil {
+			return info.ModTime().Format("2006/01/02")
+		}
+	case LayoutExtension:
+		return m.extensionGroup(filepath.Base(name))
+	case LayoutHash:
+		return m.shard(filepath.Base(name))
+	}
+	return ""
+}
+
+// defaultShardChars is the number of hash digits the hash layout takes by
+// default, two levels of 256 directories
+const defaultShardChars = 4
+
+// shard is the subdirectory of the hash layout for a file: the first
+// digits of the hash of its name in levels of two
+func (m *Mapping) shard(base string) string {
+	h := fnv.New64a()
+	h.Write([]byte(base))
+	sum := fmt.Sprintf("%016x", h.Sum64())[:m.ShardChars]
+	levels := make([]string, 0, (len(sum)+1)/2)
+	for len(sum) > 2 {
+		levels, sum = append(levels, sum[:2]), sum[2:]
+	}
+	return filepath.Join(append(levels, sum)...)
+}
+
+// otherGroup holds the links of files no extension group takes
+const otherGroup = "other"
+
+// extensionGroup is the subdirectory of the extension layout for a file:
+// the group listing the longest extension of the name, or without groups
+// the extension itself
+func (m *Mapping) extensionGroup(base string) string {
+	base = strings.ToLower(base)
+	if len(m.LayoutGroups) == 0 {
+		ext := strings.TrimPrefix(filepath.Ext(base), ".")
+		if len(ext) == 0 || len(ext) == len(base)-1 {
+			return otherGroup
+		}
+		return ext
+	}
+	group, longest := otherGroup, 0
+	for dir, exts := range m.LayoutGroups {
+		for _, ext := range exts {
+			if len(ext) > longest && len(base) > len(ext)+1 && strings.HasSuffix(base, "."+ext) {
+				group, longest = dir, len(ext)
+			}
+		}
+	}
+	return group
+}
+
+// templateName evaluates the name template of the mapping for a source
+// file, info being nil if the file is gone
+func (d *Directory) templateName(name string, info os.FileInfo) string {
+	base := d.Mapping.rename(filepath.Base(name))
+	ext := filepath.Ext(base)
+	data := nameData{
+		Name:       base,
+		Stem:       strings.TrimSuffix(base, ext),
+		Ext:        ext,
+		Dir:        ".",
+		Source:     d.Path,
+		SourceBase: filepath.Base(d.Path),
+		Mapping:    d.Mapping.Name,
+	}
+	if rel, err := filepath.Rel(d.Path, filepath.Dir(name)); err == nil {
+		data.Dir = rel
+	}
+	if info != nil {
+		data.ModTime = info.ModTime()
+		data.Date = data.ModTime.Format("2006-01-02")
+	}
+	tmpl, err := parseNameTemplate(d.Mapping.NameTemplate)
+	var out strings.Builder
+	if err == nil {
+		err = tmpl.Execute(&out, data)
+	}
+	link, ok := cleanName(out.String())
+	if err != nil || !ok {
+		slog.Error("name template failed, using the file name", "source", name, "mapping", d.Mapping.Name,
+			"name", out.String(), "error", err)
+		return base
+	}
+	return link
+}
+
+// forgetName drops the link name kept for a source file
+func (d *Directory) forgetName(name string) {
+	d.names.Delete(name)
+	contentHashes.Delete(name)
+}
+
+// RenameRule rewrites link names matching a regular expression, the
+// replacement referring to groups as $1 or ${name}
+type RenameRule struct {
+	Match   string `toml:"match" json:"match"`
+	Replace string `toml:"replace" json:"replace"`
+}
+
+// renamePatterns caches the compiled expressions of rename rules
+var renamePatterns sync.Map
+
+func compileRename(expr string) (*regexp.Regexp, error) {
+	if re, ok := renamePatterns.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	renamePatterns.Store(expr, re)
+	return re, nil
+}
+
+// rename applies the rename rules of the mapping to a file name, in
+// order, and lowercases it if asked to. A rule leaving no usable name is
+// skipped.
+func (m *Mapping) rename(base string) string {
+	for _, rule := range m.Rename {
+		re, err := compileRename(rule.Match)
+		if err != nil {
+			continue
+		}
+		renamed := re.ReplaceAllString(base, rule.Replace)
+		if len(renamed) == 0 || renamed == "." || renamed == ".." || strings.Contains(renamed, "/") {
+			slog.Warn("rename rule leaves no usable name, keeping the name", "name", base,
+				"mapping", m.Name, "match", rule.Match, "result", renamed)
+			continue
+		}
+		base = renamed
+	}
+	if m.Lowercase {
+		base = strings.ToLower(base)
+	}
+	return base
+}
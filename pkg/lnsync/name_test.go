@@ -0,0 +1,84 @@
+package lnsync
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestShard(t *testing.T) {
+	tests := []struct {
+		base  string
+		chars int
+		want  string
+	}{
+		{"a", 1, "a"},
+		{"a", 2, "af"},
+		{"a", 3, "af/6"},
+		{"a", 4, "af/63"},
+		{"a", 5, "af/63/d"},
+		{"a", 16, "af/63/dc/4c/86/01/ec/8c"},
+		{"report.pdf", 4, "8e/31"},
+		{"IMG_0001.jpg", 6, "c7/6e/c3"},
+	}
+	for _, tt := range tests {
+		m := &Mapping{Layout: LayoutHash, ShardChars: tt.chars}
+		if got := m.shard(tt.base); got != filepath.FromSlash(tt.want) {
+			t.Errorf("shard(%q) with %d chars = %q, want %q", tt.base, tt.chars, got, tt.want)
+		}
+	}
+}
+
+func TestCheckShardChars(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout string
+		chars  int
+		want   int
+		valid  bool
+	}{
+		{"hash default", LayoutHash, 0, defaultShardChars, true},
+		{"hash smallest", LayoutHash, 1, 1, true},
+		{"hash largest", LayoutHash, 16, 16, true},
+		{"hash negative", LayoutHash, -1, 0, false},
+		{"hash beyond the digits", LayoutHash, 17, 0, false},
+		{"flat leaves it alone", LayoutFlat, 0, 0, true},
+		{"date ignores it", LayoutDate, 3, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Mapping{Sources: []string{t.TempDir()}, Destination: t.TempDir(),
+				Layout: tt.layout, ShardChars: tt.chars}
+			err := m.Check()
+			if (err == nil) != tt.valid {
+				t.Fatalf("Check() = %v, want valid %v", err, tt.valid)
+			}
+			if tt.valid && m.ShardChars != tt.want {
+				t.Errorf("shard chars = %d, want %d", m.ShardChars, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateNested(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"", false},
+		{"{{.Name}}", false},
+		{"{{.Mapping}}-{{.Date}}-{{.Name | lower}}", false},
+		{"{{.Date}}/{{.Name}}", true},
+		{"{{.Dir}}", true},
+		{"{{.Dir}}-{{.Name}}", true},
+		{"{{printf \"%s_%s\" .Dir .Name}}", true},
+		{"{{if eq .Dir \".\"}}{{.Name}}{{else}}{{.Dir}}{{end}}", true},
+		{"{{with .Source}}{{.}}{{end}}", true},
+		{"{{$.Dir}}", true},
+		{"{{.SourceBase}}-{{.Name}}", false},
+	}
+	for _, tt := range tests {
+		if got := templateNested(tt.text); got != tt.want {
+			t.Errorf("templateNested(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package lnsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultNotifyInterval is the least time between two messages about the
+// same problem
+const defaultNotifyInterval = 15 * time.Minute
+
+// notifyBacklog is how many messages may wait for delivery before new ones
+// are dropped
+const notifyBacklog = 64
+
+// notifyTimeout bounds the delivery of one message
+const notifyTimeout = 30 * time.Second
+
+// Notifier sends a message to a Slack incoming webhook or by email when a
+// watcher fails, a destination is not writable or an update is given up on
+type Notifier struct {
+	// Slack is the URL of a Slack incoming webhook
+	Slack string `toml:"slack" json:"-"`
+	// SMTP is the host:port of the mail server
+	SMTP     string   `toml:"smtp" json:"smtp,omitempty"`
+	From     string   `toml:"from" json:"from,omitempty"`
+	To       []string `toml:"to" json:"to,omitempty"`
+	Username string   `toml:"username" json:"username,omitempty"`
+	Password string   `toml:"password" json:"-"`
+	// Interval is the least time between two messages about the same
+	// problem, the repeats in between are counted and reported with the
+	// next one
+	Interval Duration `toml:"interval" json:"interval"`
+}
+
+func (n *Notifier) check() error {
+	if len(n.Slack) == 0 && len(n.SMTP) == 0 {
+		return errors.New("notify: no slack or smtp defined")
+	}
+	if len(n.Slack) != 0 && len(n.SMTP) != 0 {
+		return errors.New("notify: both slack and smtp defined")
+	}
+	if len(n.SMTP) != 0 {
+		if _, _, err := net.SplitHostPort(n.SMTP); err != nil {
+			return errors.New("notify: smtp: " + err.Error())
+		}
+		if len(n.From) == 0 || len(n.To) == 0 {
+			return errors.New("notify: smtp needs from and to")
+		}
+	}
+	if n.Interval.Duration <= 0 {
+		n.Interval.Duration = defaultNotifyInterval
+	}
+	return nil
+}
+
+// notification is one message about a problem
+type notification struct {
+	subject    string
+	detail     string
+	suppressed int
+	at         time.Time
+}
+
+// notifier rate limits the messages of one Notifier and delivers them
+type notifier struct {
+	conf       Notifier
+	queue      chan notification
+	lock       sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+var (
+	notifyLock sync.Mutex
+	notifiers  []*notifier
+)
+
+// StartNotifiers replaces the running notifiers with the configured ones
+func StartNotifiers(conf []Notifier) {
+	notifyLock.Lock()
+	defer notifyLock.Unlock()
+	for _, n := range notifiers {
+		close(n.queue)
+	}
+	notifiers = nil
+	for _, c := range conf {
+		n := &notifier{conf: c, queue: make(chan notification, notifyBacklog),
+			last: make(map[string]time.Time), suppressed: make(map[string]int)}
+		notifiers = append(notifiers, n)
+		go n.deliver()
+	}
+}
+
+// notify sends subject and detail to every notifier. Messages with the same
+// subject are sent at most once per interval of the notifier.
+func notify(subject, detail string) {
+	notifyLock.Lock()
+	defer notifyLock.Unlock()
+	now := time.Now()
+	for _, n := range notifiers {
+		n.lock.Lock()
+		if last, ok := n.last[subject]; ok && now.Sub(last) < n.conf.Interval.Duration {
+			n.suppressed[subject]++
+			n.lock.Unlock()
+			continue
+		}
+		msg := notification{subject: subject, detail: detail, suppressed: n.suppressed[subject], at: now}
+		n.last[subject] = now
+		delete(n.suppressed, subject)
+		n.lock.Unlock()
+		select {
+		case n.queue <- msg:
+		default:
+			slog.Error("notification backlog full, dropping message", "subject", subject)
+		}
+	}
+}
+
+// notifyWriteError notifies when err says a destination is not writable
+func notifyWriteError(mapping *Mapping, err error) {
+	if errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.EROFS) {
+		notify("destination not writable: "+mapping.Destination,
+			"mapping "+mapping.Name+": "+err.Error())
+	}
+}
+
+func (n *notifier) deliver() {
+	for msg := range n.queue {
+		var err error
+		if len(n.conf.Slack) != 0 {
+			err = n.postSlack(msg)
+		} else {
+			err = n.sendMail(msg)
+		}
+		if err != nil {
+			slog.Error("sending notification failed", "subject", msg.subject, "error", err)
+		}
+	}
+}
+
+// text is the body of the message
+func (msg notification) text() string {
+	host, _ := os.Hostname()
+	var b strings.Builder
+	b.WriteString("lnsync on " + host + ": " + msg.subject + "\n" + msg.detail + "\n")
+	b.WriteString("at " + msg.at.Format(time.RFC3339) + "\n")
+	if msg.suppressed != 0 {
+		b.WriteString(strconv.Itoa(msg.suppressed) + " more since the previous message\n")
+	}
+	return b.String()
+}
+
+func (n *notifier) postSlack(msg notification) error {
+	body, err := json.Marshal(map[string]string{"text": msg.text()})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(n.conf.Slack, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("slack: status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+func (n *notifier) sendMail(msg notification) error {
+	var auth smtp.Auth
+	if len(n.conf.Username) != 0 {
+		host, _, _ := net.SplitHostPort(n.conf.SMTP)
+		auth = smtp.PlainAuth("", n.conf.Username, n.conf.Password, host)
+	}
+	var b strings.Builder
+	b.WriteString("From: " + n.conf.From + "\r\n")
+	b.WriteString("To: " + strings.Join(n.conf.To, ", ") + "\r\n")
+	b.WriteString("Subject: lnsync: " + msg.subject + "\r\n")
+	b.WriteString("Date: " + msg.at.Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.text(), "\n", "\r\n"))
+	return smtp.SendMail(n.conf.SMTP, auth, n.conf.From, n.conf.To, []byte(b.String()))
+}
@@ -0,0 +1,36 @@
+package lnsync
+
+import (
+	"log/slog"
+	"os"
+)
+
+// LinkOwnerSource gives destination entries the owner of their source file
+const LinkOwnerSource = "source"
+
+// ownEntry gives a created symlink or copy the owner the mapping asks for.
+// A hardlink shares the owner of its source file and is left alone. A
+// failure is logged, the entry itself is fine.
+func (m *Mapping) ownEntry(source, entry string) {
+	if len(m.LinkOwner) == 0 {
+		return
+	}
+	info, err := os.Lstat(entry)
+	if err != nil || (m.LinkMode == LinkHard && info.Mode().IsRegular()) {
+		return
+	}
+	uid, gid := -1, -1
+	if m.LinkOwner == LinkOwnerSource {
+		src, err := os.Stat(source)
+		if err != nil {
+			return
+		}
+		uid, gid, _ = fileOwner(src)
+	} else if uid, gid, err = lookupOwner(m.LinkOwner); err != nil {
+		slog.Error("setting link owner failed", "destination", entry, "mapping", m.Name, "error", err)
+		return
+	}
+	if err := os.Lchown(entry, uid, gid); err != nil {
+		slog.Error("setting link owner failed", "destination", entry, "mapping", m.Name, "error", err)
+	}
+}
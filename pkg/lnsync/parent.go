@@ -0,0 +1,117 @@
+package lnsync
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/howeyc/fsnotify"
+)
+
+// parentDelay collects the events of a parent directory before its
+// subdirectories are listed again
+const parentDelay = 500 * time.Millisecond
+
+// watchParents starts a watcher for every parent directory of the mappings
+// in watch parent mode and stops those no longer needed. It is called with
+// applyLock held.
+func (m *Manager) watchParents(conf *Config) {
+	if m.parents == nil {
+		m.parents = make(map[string]context.CancelFunc)
+	}
+	wanted := make(map[string]bool)
+	for idx := range conf.Mappings {
+		mapping := &conf.Mappings[idx]
+		if !mapping.WatchParent {
+			continue
+		}
+		for _, parent := range mapping.matchSources() {
+			key := mapping.Name + ":" + parent
+			wanted[key] = true
+			if _, ok := m.parents[key]; ok {
+				continue
+			}
+			ctx, cancel := context.WithCancel(m.ctx)
+			m.parents[key] = cancel
+			go m.watchParent(ctx, mapping.Name, parent)
+		}
+	}
+	for key, cancel := range m.parents {
+		if !wanted[key] {
+			cancel()
+			delete(m.parents, key)
+		}
+	}
+}
+
+// watchParent watches a parent directory of the mapping until ctx is done,
+// starting and stopping source watchers as subdirectories come and go. A
+// parent which cannot be watched, as it does not exist yet, is tried again
+// with backoff.
+func (m *Manager) watchParent(ctx context.Context, mapping, parent string) {
+	delay := minRestartDelay
+	for retry := false; ; retry = true {
+		started := time.Now()
+		err := m.runParent(ctx, mapping, parent, retry)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > maxRestartDelay {
+			delay = minRestartDelay
+		}
+		slog.Error("failed to watch parent directory, retrying", "mapping", mapping, "source", parent,
+			"delay", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// runParent watches the parent directory until its watcher fails or ctx is
+// done. A retried watch lists the subdirectories at once, they may have
+// appeared while the parent was not watched.
+func (m *Manager) runParent(ctx context.Context, mapping, parent string, retry bool) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Watch(parent); err != nil {
+		return err
+	}
+	slog.Info("watching parent directory", "mapping", mapping, "source", parent)
+	var expand <-chan time.Time
+	if retry {
+		expand = time.After(0)
+	}
+	for {
+		select {
+		case raw, ok := <-watcher.Event:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			if ev := newEvent(raw); (ev.IsWrite() || ev.IsChmod()) && !ev.IsCreate() {
+				continue
+			}
+			if expand == nil {
+				expand = time.After(parentDelay)
+			}
+		case <-expand:
+			expand = nil
+			m.expand()
+		case err, ok := <-watcher.Error:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			slog.Warn("parent directory watcher error", "mapping", mapping, "source", parent, "error", err)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package lnsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies for a destination whose mode or owner differ from the
+// destination_mode and destination_owner of its mapping
+const (
+	DestPermsRepair = "repair"
+	DestPermsAlert  = "alert"
+	DestPermsRefuse = "refuse"
+)
+
+// destPermsInterval is how often the destination permissions are checked
+// while running
+const destPermsInterval = time.Minute
+
+// refusedDests holds the destinations not linked into because of their
+// permissions
+var refusedDests sync.Map
+
+// destProblems lists how the destination of the mapping differs from its
+// configured mode and owner. Without a configured mode 0755 is expected.
+func destProblems(m *Mapping) ([]string, error) {
+	info, err := os.Stat(m.Destination)
+	if err != nil {
+		return nil, err
+	}
+	want, err := destMode(m.DestMode)
+	if err != nil {
+		return nil, err
+	}
+	problems := make([]string, 0)
+	mode := info.Mode().Perm()
+	if mode&0002 != 0 && want&0002 == 0 {
+		problems = append(problems, "world-writable")
+	}
+	if mode != want.Perm() {
+		problems = append(problems, fmt.Sprintf("mode %04o instead of %04o", mode, want.Perm()))
+	}
+	if len(m.DestOwner) != 0 {
+		uid, gid, err := lookupOwner(m.DestOwner)
+		if err != nil {
+			return nil, err
+		}
+		if owner, group, ok := fileOwner(info); ok {
+			if uid >= 0 && owner != uid {
+				problems = append(problems, fmt.Sprintf("owner %d instead of %d", owner, uid))
+			}
+			if gid >= 0 && group != gid {
+				problems = append(problems, fmt.Sprintf("group %d instead of %d", group, gid))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// repairDest sets the configured mode and owner on the destination
+func repairDest(m *Mapping) error {
+	mode, err := destMode(m.DestMode)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(m.Destination, mode); err != nil {
+		return err
+	}
+	if len(m.DestOwner) == 0 {
+		return nil
+	}
+	uid, gid, err := lookupOwner(m.DestOwner)
+	if err != nil {
+		return err
+	}
+	return os.Chown(m.Destination, uid, gid)
+}
+
+// checkDestPerms applies the permission policy of the mapping to each of
+// its destinations. Under the refuse policy it returns an error and no
+// link is made into a destination until it is fixed.
+func (m *Manager) checkDestPerms(mapping *Mapping) error {
+	if len(mapping.DestPerms) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, dest := range mapping.Split() {
+		errs = append(errs, m.checkDest(dest))
+	}
+	return errors.Join(errs...)
+}
+
+// checkDest is checkDestPerms for the single destination of mapping
+func (m *Manager) checkDest(mapping *Mapping) error {
+	problems, err := destProblems(mapping)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("checking destination permissions failed", "mapping", mapping.Name,
+				"destination", mapping.Destination, "error", err)
+		}
+		return nil
+	}
+	if len(problems) == 0 {
+		if _, refused := refusedDests.LoadAndDelete(mapping.Destination); refused {
+			slog.Info("destination permissions fixed, linking again", "mapping", mapping.Name,
+				"destination", mapping.Destination)
+			m.rescanLater(mapping.Name)
+		}
+		return nil
+	}
+	problem := strings.Join(problems, ", ")
+	switch mapping.DestPerms {
+	case DestPermsRepair:
+		if err := repairDest(mapping); err != nil {
+			slog.Error("repairing destination permissions failed", "mapping", mapping.Name,
+				"destination", mapping.Destination, "problem", problem, "error", err)
+			return nil
+		}
+		slog.Warn("destination permissions repaired", "mapping", mapping.Name, "destination", mapping.Destination,
+			"problem", problem)
+	case DestPermsAlert:
+		slog.Warn("destination permissions wrong", "mapping", mapping.Name, "destination", mapping.Destination,
+			"problem", problem)
+		notify("destination permissions wrong: "+mapping.Destination, "mapping "+mapping.Name+": "+problem)
+	case DestPermsRefuse:
+		if _, refused := refusedDests.LoadOrStore(mapping.Destination, true); !refused {
+			slog.Error("destination permissions wrong, not linking into it", "mapping", mapping.Name,
+				"destination", mapping.Destination, "problem", problem)
+			notify("destination refused: "+mapping.Destination, "mapping "+mapping.Name+": "+problem)
+		}
+		return errors.New("destination " + mapping.Destination + " refused: " + problem)
+	}
+	return nil
+}
+
+// destRefused reports whether links are not made into dest because of its
+// permissions
+func destRefused(dest string) bool {
+	_, refused := refusedDests.Load(dest)
+	return refused
+}
+
+// enforceDestPerms checks the destination permissions of the mapping whose
+// sources are dirs periodically until ctx is done
+func (m *Manager) enforceDestPerms(ctx context.Context, dirs []*Directory) {
+	ticker := time.NewTicker(destPermsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		m.checkDestPerms(dirs[0].Mapping)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+
+package lnsync
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// accessWrite is W_OK of access(2)
+const accessWrite = 0x2
+
+// writable reports why the daemon cannot create entries in dir, if so
+func writable(dir string) error {
+	return syscall.Access(dir, accessWrite)
+}
+
+func sameDevice(a, b string) bool {
+	var sa, sb syscall.Stat_t
+	if syscall.Stat(a, &sa) != nil || syscall.Stat(b, &sb) != nil {
+		return false
+	}
+	return sa.Dev == sb.Dev
+}
+
+// isMountpoint compares the device of dir with that of its parent, and
+// falls back to the mount table for bind mounts within one filesystem
+func isMountpoint(dir string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(dir, &st) != nil || syscall.Stat(filepath.Dir(dir), &parent) != nil {
+		return false
+	}
+	if st.Dev != parent.Dev || st.Ino == parent.Ino {
+		return true
+	}
+	for _, mp := range readMountpoints("/proc/self/mounts") {
+		if mp == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// crossDevice reports whether an operation failed because it would cross
+// a filesystem boundary
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// fileOwner returns the uid and gid owning a file
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// symlink creates newname pointing to target
+func symlink(target, newname string) error {
+	return os.Symlink(target, newname)
+}
@@ -0,0 +1,69 @@
+package lnsync
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Win32 errors not defined by package syscall
+const (
+	errorNotSameDevice    = syscall.Errno(17)
+	errorPrivilegeNotHeld = syscall.Errno(1314)
+)
+
+// writable reports why the daemon cannot create entries in dir, if so.
+// Windows has no access(2), a temporary file is created and removed.
+func writable(dir string) error {
+	f, err := os.CreateTemp(dir, tmpPrefix)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// sameDevice compares the volumes of two paths
+func sameDevice(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && strings.EqualFold(filepath.VolumeName(a), filepath.VolumeName(b))
+}
+
+// isMountpoint reports whether dir is the root of a volume, a drive or a
+// UNC share
+func isMountpoint(dir string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return false
+	}
+	return len(filepath.VolumeName(dir)) != 0 && filepath.Dir(dir) == dir
+}
+
+// crossDevice reports whether an operation failed because it would cross
+// a volume boundary
+func crossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice) || errors.Is(err, syscall.EXDEV)
+}
+
+// fileOwner is not available: NTFS owners are SIDs, not uids
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return -1, -1, false
+}
+
+// symlink creates the NTFS symlink newname pointing to target. It needs
+// the SeCreateSymbolicLinkPrivilege, held by administrators and by every
+// user in developer mode.
+func symlink(target, newname string) error {
+	err := os.Symlink(target, newname)
+	if errors.Is(err, errorPrivilegeNotHeld) {
+		return &os.LinkError{Op: "symlink", Old: target, New: newname,
+			Err: errors.New("creating symlinks needs administrator rights or developer mode, or use link mode hard")}
+	}
+	return err
+}
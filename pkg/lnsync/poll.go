@@ -0,0 +1,155 @@
+package lnsync
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// defaultPollInterval is the scan interval of the poll backend
+const defaultPollInterval = 10 * time.Second
+
+// fileStamp is what the poll backend compares to notice a changed file
+type fileStamp struct {
+	size  int64
+	mtime time.Time
+}
+
+// runPoller rescans the source every poll interval and sends the
+// differences to the previous scan as events, for filesystems which do not
+// deliver inotify events. It returns when a scan fails or the context of
+// the directory is cancelled.
+func (d *Directory) runPoller() error {
+	defer d.startOnce.Do(func() { close(d.Started) })
+	prev, err := d.snapshot()
+	if err != nil {
+		return err
+	}
+	d.watchLock.Lock()
+	d.watched = map[string]bool{d.Path: true}
+	d.watchLock.Unlock()
+	if atomic.CompareAndSwapInt32(&d.failed, 1, 0) {
+		slog.Info("file poller restarted", "source", d.Path, "mapping", d.Mapping.Name)
+		d.manager.rescanLater(d.Mapping.Name)
+	}
+	d.startOnce.Do(func() { close(d.Started) })
+
+	interval := d.Mapping.PollInterval.Duration
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return nil
+		}
+		if d.sourceMissing() {
+			return errSourceRemoved
+		}
+		cur, err := d.snapshot()
+		if err != nil {
+			return err
+		}
+		d.diff(prev, cur)
+		prev = cur
+	}
+}
+
+// snapshot records the files of the source, of the whole tree in
+// recursive mode
+func (d *Directory) snapshot() (map[string]fileStamp, error) {
+	files := make(map[string]fileStamp)
+	if !d.Mapping.Recursive {
+		entries, err := ioutil.ReadDir(d.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range entries {
+			if !info.IsDir() {
+				files[d.Path+"/"+info.Name()] = fileStamp{info.Size(), info.ModTime()}
+			} else if d.Mapping.LinkDirs {
+				// the contents of a linked directory are none of our business
+				files[d.Path+"/"+info.Name()] = fileStamp{}
+			}
+		}
+		return files, nil
+	}
+	err := filepath.Walk(d.Path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if name == d.Path {
+				return err
+			}
+			// vanished while walking, the next scan tells
+			return nil
+		}
+		if info.IsDir() && d.skipDir(name) {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() {
+			files[name] = fileStamp{info.Size(), info.ModTime()}
+		}
+		return d.ctx.Err()
+	})
+	return files, err
+}
+
+// listDir lists the files of one directory of the source, and its
+// subdirectories which are not skipped
+func (d *Directory) listDir(dir string) (map[string]fileStamp, []string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make(map[string]fileStamp)
+	subdirs := make([]string, 0)
+	for _, info := range entries {
+		name := dir + "/" + info.Name()
+		switch {
+		case !info.IsDir():
+			files[name] = fileStamp{info.Size(), info.ModTime()}
+		case d.Mapping.LinkDirs && !d.Mapping.Recursive:
+			files[name] = fileStamp{}
+		case !d.skipDir(name):
+			subdirs = append(subdirs, name)
+		}
+	}
+	return files, subdirs, nil
+}
+
+// diff sends removals before creations, so a file moved between sources
+// is not taken for a collision
+func (d *Directory) diff(prev, cur map[string]fileStamp) {
+	var removed, created, modified []string
+	for name := range prev {
+		if _, ok := cur[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	for name, stamp := range cur {
+		old, ok := prev[name]
+		switch {
+		case !ok:
+			created = append(created, name)
+		case old.size != stamp.size || !old.mtime.Equal(stamp.mtime):
+			modified = append(modified, name)
+		}
+	}
+	for _, batch := range []struct {
+		names []string
+		op    Op
+	}{{removed, OpRemove}, {created, OpCreate}, {modified, OpWrite}} {
+		sort.Strings(batch.names)
+		for _, name := range batch.names {
+			ev := &Event{Name: name, Op: batch.op}
+			slog.Debug("poller event", "event", eventName(ev), "source", name)
+			d.send(ev)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package lnsync
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of lnsync.proto are small and flat, so they are encoded by
+// hand with protowire instead of generated code. protoCodec only knows
+// these messages: the gRPC server is forced to use it, and it is
+// registered under a content-subtype of its own, so the default "proto"
+// codec of the process stays untouched.
+
+type protoMarshaler interface {
+	marshalProto(b []byte) []byte
+}
+
+type protoUnmarshaler interface {
+	unmarshalProto(b []byte) error
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string {
+	return "lnsync-proto"
+}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(protoMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return msg.marshalProto(nil), nil
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(protoUnmarshaler)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal %T", v)
+	}
+	return msg.unmarshalProto(data)
+}
+
+func init() {
+	encoding.RegisterCodec(protoCodec{})
+}
+
+type pbEmpty struct{}
+
+func (*pbEmpty) marshalProto(b []byte) []byte {
+	return b
+}
+
+func (*pbEmpty) unmarshalProto(b []byte) error {
+	return consumeStrings(b, func(protowire.Number, string) {})
+}
+
+// pbRequest carries the fields of SourceRequest, RescanRequest and
+// WatchRequest, which share their field numbers
+type pbRequest struct {
+	Mapping string
+	Path    string
+}
+
+func (r *pbRequest) unmarshalProto(b []byte) error {
+	return consumeStrings(b, func(num protowire.Number, value string) {
+		switch num {
+		case 1:
+			r.Mapping = value
+		case 2:
+			r.Path = value
+		}
+	})
+}
+
+type pbStatus struct {
+	*Status
+}
+
+func (st pbStatus) marshalProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(st.Pid))
+	b = appendInt(b, 2, st.Started.Unix())
+	b = appendInt(b, 3, int64(st.QueueDepth))
+	b = appendInt(b, 4, st.RetryDepth)
+	b = appendString(b, 5, st.LastError)
+	for _, ms := range st.Mappings {
+		var mb []byte
+		mb = appendString(mb, 1, ms.Name)
+		mb = appendString(mb, 2, ms.Destination)
+		mb = appendInt(mb, 3, int64(ms.Links))
+		for _, src := range ms.Sources {
+			var sb []byte
+			sb = appendString(sb, 1, src.Path)
+			if src.Active {
+				sb = appendInt(sb, 2, 1)
+			}
+			sb = appendInt(sb, 3, int64(src.Watched))
+			sb = appendInt(sb, 4, src.Files)
+			sb = appendInt(sb, 5, src.Events)
+			sb = appendInt(sb, 6, int64(src.Scanned))
+			mb = appendMessage(mb, 4, sb)
+		}
+		if ms.Degraded {
+			mb = appendInt(mb, 5, 1)
+		}
+		mb = appendInt(mb, 6, ms.Errors)
+		mb = appendString(mb, 7, ms.LastError)
+		b = appendMessage(b, 6, mb)
+	}
+	return b
+}
+
+type pbLinkEvent struct {
+	LinkEvent
+}
+
+func (ev pbLinkEvent) marshalProto(b []byte) []byte {
+	b = appendString(b, 1, ev.Type)
+	b = appendString(b, 2, ev.Mapping)
+	b = appendString(b, 3, ev.Link)
+	b = appendString(b, 4, ev.OldLink)
+	b = appendString(b, 5, ev.Source)
+	return appendInt(b, 6, ev.Time.UnixNano())
+}
+
+// appendString, appendInt and appendMessage follow proto3 and leave out
+// fields holding the zero value, except for embedded messages
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	if len(value) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendInt(b []byte, num protowire.Number, value int64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(value))
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// consumeStrings decodes a message of string fields, skipping fields of
+// other types
+func consumeStrings(b []byte, field func(num protowire.Number, value string)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ == protowire.BytesType {
+			value, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			field(num, value)
+			b = b[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
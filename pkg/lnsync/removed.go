@@ -0,0 +1,178 @@
+package lnsync
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Treatments of the links of a source directory which was removed
+const (
+	SourceRemovedRemove     = "remove"
+	SourceRemovedQuarantine = "quarantine"
+	SourceRemovedKeep       = "keep"
+)
+
+// defaultReattachInterval is how often a removed source is looked for
+// again by default
+const defaultReattachInterval = 5 * time.Second
+
+// sourceCheckInterval is how often a watched source is checked for having
+// been unmounted, which inotify does not report
+const sourceCheckInterval = 5 * time.Second
+
+// errSourceRemoved stops the watcher of a source directory which was
+// deleted or renamed away
+var errSourceRemoved = errors.New("source directory removed")
+
+// sourceMissing reports whether the source directory is gone: removed,
+// renamed away, unmounted if it was a mountpoint when first watched, or on
+// a dead network mount. A source which merely cannot be read, as after
+// dropping privileges or on an I/O error, is not gone: taking it for
+// removed would delete all its links.
+func (d *Directory) sourceMissing() bool {
+	_, err := os.Stat(d.Path)
+	switch {
+	case err == nil:
+		atomic.StoreInt32(&d.unreadable, 0)
+	case errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTCONN) || errors.Is(err, syscall.ESTALE):
+		return true
+	default:
+		if atomic.CompareAndSwapInt32(&d.unreadable, 0, 1) {
+			slog.Error("source not accessible, keeping its links", "source", d.Path, "mapping", d.Mapping.Name,
+				"error", err)
+		}
+		return false
+	}
+	return atomic.LoadInt32(&d.mountpoint) != 0 && !isMountpoint(d.Path)
+}
+
+// sourceLost returns a channel closed once the source goes missing. It is
+// checked until stop is closed.
+func (d *Directory) sourceLost(stop <-chan bool) <-chan bool {
+	lost := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(sourceCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			case <-d.ctx.Done():
+				return
+			}
+			if d.sourceMissing() {
+				close(lost)
+				return
+			}
+		}
+	}()
+	return lost
+}
+
+// sourceLinks lists the destination entries made for files of the source.
+// Hardlinks and copies are only known with a state file.
+func (d *Directory) sourceLinks() []string {
+	names, err := listTarget(d.Dist, d.Mapping.nested())
+	if err != nil {
+		slog.Error("listing destination failed", "destination", d.Dist, "mapping", d.Mapping.Name, "error", err)
+		return nil
+	}
+	links := make([]string, 0)
+	for _, name := range names {
+		link := d.Dist + "/" + name
+		if rec, ok := state.Record(link); ok {
+			if rec.Mapping == d.Mapping.Name && within(rec.Source, d.Path) {
+				links = append(links, link)
+			}
+			continue
+		}
+		if target, err := readLink(link); err == nil && within(target, d.Path) {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// sourceRemoved deals with the links of a removed source, in every
+// destination of its mapping, according to the mapping's policy
+func (d *Directory) sourceRemoved() {
+	atomic.StoreInt32(&d.missing, 1)
+	slog.Warn("source directory missing, watcher stopped", "source", d.Path, "mapping", d.Mapping.Name,
+		"links", d.Mapping.SourceRemoved)
+	notify("source directory missing, watcher stopped: "+d.Path, "mapping "+d.Mapping.Name)
+	for _, dir := range append([]*Directory{d}, d.replicas...) {
+		dir.names.Range(func(key, _ any) bool {
+			dir.names.Delete(key)
+			return true
+		})
+		dir.resolved.Range(func(key, _ any) bool {
+			dir.resolved.Delete(key)
+			return true
+		})
+		if dir.Mapping.SourceRemoved == SourceRemovedKeep {
+			continue
+		}
+		for _, link := range dir.sourceLinks() {
+			rec, _ := state.Record(link)
+			var err error
+			if dir.Mapping.SourceRemoved == SourceRemovedQuarantine {
+				err = dir.quarantine(link)
+			} else {
+				err = removeEntry(dir.Mapping, link)
+			}
+			if err != nil {
+				slog.Error("removing link of removed source failed", "destination", link, "mapping", dir.Mapping.Name,
+					"error", err)
+				continue
+			}
+			state.Remove(link)
+			linkRemoved(dir.Mapping.Name, link, rec.Source)
+			pruneDirs(link, dir.Dist)
+		}
+	}
+}
+
+// quarantine moves a link out of the destination into the quarantine
+// directory of the mapping, keeping its path below the destination
+func (d *Directory) quarantine(link string) error {
+	rel := strings.TrimPrefix(link, d.Dist+"/")
+	dest := filepath.Join(d.Mapping.QuarantineDir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(link, dest); err != nil {
+		return err
+	}
+	slog.Info("link quarantined", "destination", link, "quarantine", dest, "mapping", d.Mapping.Name)
+	return nil
+}
+
+// awaitSource waits for a removed source to be back and reports whether
+// it is, false once the watcher is stopped or if the mapping does not
+// re-attach sources
+func (d *Directory) awaitSource() bool {
+	interval := d.Mapping.Reattach.Duration
+	if interval < 0 {
+		return false
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for d.sourceMissing() {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return false
+		}
+	}
+	atomic.StoreInt32(&d.missing, 0)
+	slog.Info("source directory is back, watching it again", "source", d.Path, "mapping", d.Mapping.Name)
+	return true
+}
@@ -0,0 +1,75 @@
+package lnsync
+
+import (
+	"time"
+)
+
+// destinations lists every destination of the mapping, the first one
+// being Destination
+func (m *Mapping) destinations() []string {
+	if len(m.Destinations) == 0 {
+		return []string{m.Destination}
+	}
+	return m.Destinations
+}
+
+// replicas returns a copy of the mapping for each of its destinations but
+// the first. Each copy is reconciled, guarded and reported on its own, so a
+// broken destination does not hold up the others.
+func (m *Mapping) replicas() []*Mapping {
+	dests := m.destinations()
+	replicas := make([]*Mapping, 0, len(dests)-1)
+	for _, dest := range dests[1:] {
+		replica := *m
+		replica.Destination, replica.Destinations = dest, nil
+		replicas = append(replicas, &replica)
+	}
+	return replicas
+}
+
+// newReplica creates the unwatched directory applying the events of the
+// source dir to the destination of replica
+func (d *Directory) newReplica(replica *Mapping) *Directory {
+	return &Directory{
+		Path:    d.Path,
+		Dist:    replica.Destination,
+		Mapping: replica,
+		Update:  d.Update,
+		manager: d.manager,
+		origin:  d,
+		ctx:     d.ctx,
+		cancel:  d.cancel,
+	}
+}
+
+// fanOut returns a copy of a new update for every destination of its
+// mapping besides the first
+func (u *UpdateHeader) fanOut() []UpdateHeader {
+	if u.Attempt != 0 || len(u.Path.replicas) == 0 {
+		return nil
+	}
+	updates := make([]UpdateHeader, 0, len(u.Path.replicas))
+	for _, replica := range u.Path.replicas {
+		update := *u
+		update.Path = replica
+		updates = append(updates, update)
+	}
+	return updates
+}
+
+// recordError remembers the last failure applying an update to the
+// destination of the directory
+func (d *Directory) recordError(err error) {
+	d.errLock.Lock()
+	d.errCount++
+	d.lastErr, d.lastErrAt = err.Error(), time.Now()
+	d.errLock.Unlock()
+}
+
+// Errors returns the number of failed updates of the destination of the
+// directory and the last failure
+func (d *Directory) Errors() (int64, string, time.Time) {
+	d.errLock.Lock()
+	defer d.errLock.Unlock()
+	return d.errCount, d.lastErr, d.lastErrAt
+}
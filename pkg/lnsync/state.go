@@ -0,0 +1,189 @@
+package lnsync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateFlushInterval is how often a changed state is written to disk
+const stateFlushInterval = time.Second
+
+// State records every destination entry created by lnsync. It is kept in
+// memory and written to a JSON snapshot shortly after every change.
+type State struct {
+	lock  sync.Mutex
+	file  string
+	dirty bool
+	Links map[string]LinkRecord `json:"links"`
+}
+
+// LinkRecord describes one managed destination entry
+type LinkRecord struct {
+	Source  string    `json:"source"`
+	Mapping string    `json:"mapping"`
+	Created time.Time `json:"created"`
+}
+
+// state is nil unless a state file is configured; all methods accept a
+// nil receiver
+var state *State
+
+// SetState makes the package record its links in s, nil to stop recording
+func SetState(s *State) {
+	state = s
+}
+
+// LoadState reads the state file, which need not exist yet
+func LoadState(file string) (*State, error) {
+	s := &State{file: file, Links: make(map[string]LinkRecord)}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Links == nil {
+		s.Links = make(map[string]LinkRecord)
+	}
+	return s, nil
+}
+
+// Add records a link created for source by the given mapping
+func (s *State) Add(link, source, mapping string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.Links[link] = LinkRecord{Source: source, Mapping: mapping, Created: time.Now()}
+	s.dirty = true
+	s.lock.Unlock()
+}
+
+func (s *State) Remove(link string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if _, ok := s.Links[link]; ok {
+		delete(s.Links, link)
+		s.dirty = true
+	}
+	s.lock.Unlock()
+}
+
+// Owns reports whether the link was created by lnsync
+func (s *State) Owns(link string) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.Links[link]
+	return ok
+}
+
+// Record returns what is recorded about the link
+func (s *State) Record(link string) (LinkRecord, bool) {
+	if s == nil {
+		return LinkRecord{}, false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rec, ok := s.Links[link]
+	return rec, ok
+}
+
+// LinkOf returns the link recorded for source by the given mapping
+func (s *State) LinkOf(source, mapping string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for link, rec := range s.Links {
+		if rec.Source == source && rec.Mapping == mapping {
+			return link, true
+		}
+	}
+	return "", false
+}
+
+// Count is the number of links recorded for the mapping in the destination
+// dest, one of those of the mapping
+func (s *State) Count(mapping, dest string) int {
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	count := 0
+	for link, rec := range s.Links {
+		if rec.Mapping == mapping && within(link, dest) {
+			count++
+		}
+	}
+	return count
+}
+
+// Prune forgets links of the mapping which no longer exist, e.g. removed
+// while the daemon was not running
+func (s *State) Prune(mapping string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for link, rec := range s.Links {
+		if rec.Mapping != mapping {
+			continue
+		}
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			delete(s.Links, link)
+			s.dirty = true
+		}
+	}
+}
+
+// Save writes the snapshot under a temporary name and renames it into
+// place, so a crash never leaves a truncated state file
+func (s *State) Save() error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	data, err := json.MarshalIndent(s, "", "  ")
+	s.dirty = false
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(s.file), "."+filepath.Base(s.file)+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// FlushLoop saves the state whenever it changed
+func (s *State) FlushLoop() {
+	for range time.Tick(stateFlushInterval) {
+		s.lock.Lock()
+		dirty := s.dirty
+		s.lock.Unlock()
+		if !dirty {
+			continue
+		}
+		if err := s.Save(); err != nil {
+			slog.Error("save state failed", "file", s.file, "error", err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package lnsync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the daemon wide counters, updated atomically
+type Stats struct {
+	Events       int64
+	LinksCreated int64
+	LinksRemoved int64
+	Errors       int64
+	Dropped      int64
+	Overflows    int64
+	Tampered     int64
+	Swept        int64
+
+	errorLock   sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+}
+
+var stats Stats
+
+func countEvent(d *Directory) {
+	atomic.AddInt64(&stats.Events, 1)
+	atomic.AddInt64(&d.events, 1)
+}
+
+func countCreated() {
+	atomic.AddInt64(&stats.LinksCreated, 1)
+}
+
+func countRemoved() {
+	atomic.AddInt64(&stats.LinksRemoved, 1)
+}
+
+func countDropped() {
+	atomic.AddInt64(&stats.Dropped, 1)
+}
+
+func countSwept() {
+	atomic.AddInt64(&stats.Swept, 1)
+}
+
+func countTampered() {
+	atomic.AddInt64(&stats.Tampered, 1)
+}
+
+func countOverflow() {
+	atomic.AddInt64(&stats.Overflows, 1)
+}
+
+func countError(err error) {
+	atomic.AddInt64(&stats.Errors, 1)
+	stats.errorLock.Lock()
+	stats.lastError = err.Error()
+	stats.lastErrorAt = time.Now()
+	stats.errorLock.Unlock()
+}
+
+// LastError returns the most recent failure and when it happened
+func (s *Stats) LastError() (string, time.Time) {
+	s.errorLock.Lock()
+	defer s.errorLock.Unlock()
+	return s.lastError, s.lastErrorAt
+}
+
+// Dirs returns the watched directories ordered by mapping and path
+func (m *Manager) Dirs() []*Directory {
+	m.lock.Lock()
+	dirs := make([]*Directory, 0, len(m.dirs))
+	for _, dir := range m.dirs {
+		dirs = append(dirs, dir)
+	}
+	m.lock.Unlock()
+	sort.Slice(dirs, func(i, j int) bool {
+		if dirs[i].Mapping.Name != dirs[j].Mapping.Name {
+			return dirs[i].Mapping.Name < dirs[j].Mapping.Name
+		}
+		return dirs[i].Path < dirs[j].Path
+	})
+	return dirs
+}
+
+// QueueDepth is the number of updates waiting for a link worker
+func (m *Manager) QueueDepth() int {
+	depth := 0
+	for _, queue := range m.queues {
+		depth += len(queue)
+	}
+	return depth
+}
+
+// EventQueueDepth is the number of events waiting to be dispatched
+func (m *Manager) EventQueueDepth() int {
+	return len(m.update)
+}
+
+// RetryDepth is the number of failed updates waiting for a retry, and of
+// later updates of the same entries held back behind them
+func (m *Manager) RetryDepth() int64 {
+	return atomic.LoadInt64(&m.retrying)
+}
+
+// Watched is the number of directories watched for the source
+func (d *Directory) Watched() int {
+	if d.origin != nil {
+		return d.origin.Watched()
+	}
+	d.watchLock.Lock()
+	defer d.watchLock.Unlock()
+	return len(d.watched)
+}
+
+// Scanned is the number of directories a kqueue watcher scans every poll
+// interval because they are beyond its descriptor budget
+func (d *Directory) Scanned() int {
+	if d.origin != nil {
+		return d.origin.Scanned()
+	}
+	return int(atomic.LoadInt32(&d.degraded))
+}
+
+// Files is the number of source files known from the last scan and the
+// events since
+func (d *Directory) Files() int64 {
+	return atomic.LoadInt64(&d.files)
+}
+
+// Events is the number of events received for the source
+func (d *Directory) Events() int64 {
+	if d.origin != nil {
+		return d.origin.Events()
+	}
+	return atomic.LoadInt64(&d.events)
+}
+
+// Snapshot is a point in time copy of the daemon counters
+type Snapshot struct {
+	Events       int64            `json:"events"`
+	LinksCreated int64            `json:"links_created"`
+	LinksRemoved int64            `json:"links_removed"`
+	Errors       int64            `json:"errors"`
+	Dropped      int64            `json:"events_dropped"`
+	Overflows    int64            `json:"watcher_overflows"`
+	Tampered     int64            `json:"tampered"`
+	Swept        int64            `json:"dangling_removed"`
+	EventQueue   int              `json:"event_queue_depth"`
+	QueueDepth   int              `json:"queue_depth"`
+	RetryDepth   int64            `json:"retry_depth"`
+	Paused       bool             `json:"paused"`
+	Held         int              `json:"held"`
+	Goroutines   int              `json:"goroutines"`
+	Links        map[string]int   `json:"links"`
+	SourceEvents map[string]int64 `json:"source_events"`
+}
+
+func (m *Manager) Snapshot() *Snapshot {
+	snap := &Snapshot{
+		Events:       atomic.LoadInt64(&stats.Events),
+		LinksCreated: atomic.LoadInt64(&stats.LinksCreated),
+		LinksRemoved: atomic.LoadInt64(&stats.LinksRemoved),
+		Errors:       atomic.LoadInt64(&stats.Errors),
+		Dropped:      atomic.LoadInt64(&stats.Dropped),
+		Overflows:    atomic.LoadInt64(&stats.Overflows),
+		Tampered:     atomic.LoadInt64(&stats.Tampered),
+		Swept:        atomic.LoadInt64(&stats.Swept),
+		EventQueue:   m.EventQueueDepth(),
+		QueueDepth:   m.QueueDepth(),
+		RetryDepth:   m.RetryDepth(),
+		Goroutines:   runtime.NumGoroutine(),
+		Links:        make(map[string]int),
+		SourceEvents: make(map[string]int64),
+	}
+	snap.Paused, snap.Held = m.Paused()
+	for _, dir := range m.Dirs() {
+		snap.SourceEvents[dir.Mapping.Name+":"+dir.Path] = dir.Events()
+		if _, ok := snap.Links[dir.Mapping.Name]; !ok {
+			snap.Links[dir.Mapping.Name] = countLinks(dir.Mapping)
+		}
+	}
+	return snap
+}
+
+// DumpStats writes a snapshot of the counters to file as JSON, or to the
+// log when file is empty
+func DumpStats(m *Manager, file string) {
+	snap := m.Snapshot()
+	if len(file) != 0 {
+		data, err := json.MarshalIndent(snap, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(file, append(data, '\n'), 0644)
+		}
+		if err != nil {
+			slog.Error("write statistics failed", "file", file, "error", err)
+		}
+		return
+	}
+	slog.Info("statistics", "events", snap.Events, "links_created", snap.LinksCreated,
+		"links_removed", snap.LinksRemoved, "errors", snap.Errors, "events_dropped", snap.Dropped,
+		"watcher_overflows", snap.Overflows, "tampered", snap.Tampered, "dangling_removed", snap.Swept,
+		"event_queue_depth", snap.EventQueue, "queue_depth", snap.QueueDepth,
+		"retry_depth", snap.RetryDepth, "paused", snap.Paused, "held", snap.Held,
+		"goroutines", snap.Goroutines)
+	for mapping, links := range snap.Links {
+		slog.Info("statistics", "mapping", mapping, "links", links)
+	}
+	for source, events := range snap.SourceEvents {
+		slog.Info("statistics", "source", source, "events", events)
+	}
+}
@@ -0,0 +1,253 @@
+package lnsync
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultStatsdInterval is how often the counters are sent to statsd
+const defaultStatsdInterval = 10 * time.Second
+
+// statsdPacket is the size up to which metric lines share one datagram
+const statsdPacket = 1432
+
+// maxStatsdTimings bounds the update durations kept between two flushes
+const maxStatsdTimings = 10000
+
+// Statsd sends counters, queue depths and update durations to a StatsD or
+// DogStatsD server
+type Statsd struct {
+	Address string `toml:"address" json:"address"`
+	Prefix  string `toml:"prefix" json:"prefix"`
+	// DogStatsD appends the tags to every metric. Plain StatsD has no tags:
+	// the mapping goes into the metric name and the tags are dropped.
+	DogStatsD bool              `toml:"dogstatsd" json:"dogstatsd"`
+	Tags      map[string]string `toml:"tags" json:"tags,omitempty"`
+	Interval  Duration          `toml:"interval" json:"interval"`
+}
+
+func (s *Statsd) check() error {
+	if len(s.Address) == 0 {
+		return errors.New("statsd: no address defined")
+	}
+	if len(s.Prefix) == 0 {
+		s.Prefix = "lnsync"
+	}
+	if s.Interval.Duration <= 0 {
+		s.Interval.Duration = defaultStatsdInterval
+	}
+	return nil
+}
+
+// statsdSink flushes the metrics of a manager to one server
+type statsdSink struct {
+	conf    *Statsd
+	conn    net.Conn
+	manager *Manager
+	quit    chan bool
+	lock    sync.Mutex
+	timings []statsdTiming
+	sent    map[string]int64
+}
+
+type statsdTiming struct {
+	mapping *Mapping
+	elapsed time.Duration
+}
+
+var (
+	statsdLock    sync.Mutex
+	statsdRunning *statsdSink
+)
+
+// StartStatsd replaces the running statsd sink by one sending the metrics
+// of m as conf says, none when conf is nil
+func StartStatsd(m *Manager, conf *Statsd) {
+	statsdLock.Lock()
+	defer statsdLock.Unlock()
+	if statsdRunning != nil {
+		close(statsdRunning.quit)
+		statsdRunning = nil
+	}
+	if conf == nil || m == nil {
+		return
+	}
+	interval := conf.Interval.Duration
+	if interval <= 0 {
+		interval = defaultStatsdInterval
+	}
+	conn, err := net.Dial("udp", conf.Address)
+	if err != nil {
+		slog.Error("statsd sink failed", "address", conf.Address, "error", err)
+		return
+	}
+	sink := &statsdSink{conf: conf, conn: conn, manager: m, quit: make(chan bool), sent: make(map[string]int64)}
+	statsdRunning = sink
+	go sink.run(interval)
+}
+
+// observeUpdate records how long applying an update of the mapping took
+func observeUpdate(mapping *Mapping, elapsed time.Duration) {
+	statsdLock.Lock()
+	sink := statsdRunning
+	statsdLock.Unlock()
+	if sink == nil {
+		return
+	}
+	sink.lock.Lock()
+	if len(sink.timings) < maxStatsdTimings {
+		sink.timings = append(sink.timings, statsdTiming{mapping, elapsed})
+	}
+	sink.lock.Unlock()
+}
+
+func (s *statsdSink) run(interval time.Duration) {
+	defer s.conn.Close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.quit:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush sends the counter increments since the previous flush, the queue
+// depths and link counts as gauges, and the update durations as timers
+func (s *statsdSink) flush() {
+	lines := make([]string, 0)
+	counter := func(metric string, mapping *Mapping, value int64) {
+		key := metric
+		if mapping != nil {
+			key = mapping.Name + "/" + metric
+		}
+		delta := value - s.sent[key]
+		if delta < 0 {
+			// the directories of the mapping were replaced by a reload
+			delta = value
+		}
+		s.sent[key] = value
+		if delta > 0 {
+			lines = append(lines, s.line(metric, mapping, strconv.FormatInt(delta, 10), "c"))
+		}
+	}
+	gauge := func(metric string, mapping *Mapping, value int64) {
+		lines = append(lines, s.line(metric, mapping, strconv.FormatInt(value, 10), "g"))
+	}
+	counter("events", nil, atomic.LoadInt64(&stats.Events))
+	counter("links_created", nil, atomic.LoadInt64(&stats.LinksCreated))
+	counter("links_removed", nil, atomic.LoadInt64(&stats.LinksRemoved))
+	counter("errors", nil, atomic.LoadInt64(&stats.Errors))
+	counter("events_dropped", nil, atomic.LoadInt64(&stats.Dropped))
+	counter("queue_overflows", nil, atomic.LoadInt64(&stats.Overflows))
+	gauge("event_queue", nil, int64(s.manager.EventQueueDepth()))
+	gauge("queue_depth", nil, int64(s.manager.QueueDepth()))
+	gauge("retry_depth", nil, s.manager.RetryDepth())
+
+	s.manager.lock.Lock()
+	mappings := s.manager.mappings
+	s.manager.lock.Unlock()
+	for _, dirs := range mappings {
+		if len(dirs) == 0 {
+			continue
+		}
+		mapping := dirs[0].Mapping
+		var events, errs, files int64
+		for _, dir := range dirs {
+			count, _, _ := dir.Errors()
+			events += dir.Events()
+			errs += count
+			files += dir.Files()
+		}
+		counter("events", mapping, events)
+		counter("errors", mapping, errs)
+		gauge("files", mapping, files)
+		gauge("links", mapping, int64(countLinks(mapping)))
+	}
+
+	s.lock.Lock()
+	timings := s.timings
+	s.timings = nil
+	s.lock.Unlock()
+	for _, t := range timings {
+		ms := strconv.FormatFloat(float64(t.elapsed)/float64(time.Millisecond), 'f', 3, 64)
+		lines = append(lines, s.line("update_duration", t.mapping, ms, "ms"))
+	}
+	s.send(lines)
+}
+
+// line formats one metric. Metrics of a mapping carry its name as the
+// mapping tag and its statsd_tags, or with plain StatsD within the name.
+func (s *statsdSink) line(metric string, mapping *Mapping, value, kind string) string {
+	name := metric
+	if mapping != nil && !s.conf.DogStatsD {
+		name = "mapping." + statsdName(mapping.Name) + "." + metric
+	}
+	if len(s.conf.Prefix) != 0 {
+		name = s.conf.Prefix + "." + name
+	}
+	line := name + ":" + value + "|" + kind
+	if !s.conf.DogStatsD {
+		return line
+	}
+	tags := make(map[string]string, len(s.conf.Tags))
+	for k, v := range s.conf.Tags {
+		tags[k] = v
+	}
+	if mapping != nil {
+		tags["mapping"] = mapping.Name
+		for k, v := range mapping.StatsdTags {
+			tags[k] = v
+		}
+	}
+	if len(tags) == 0 {
+		return line
+	}
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+":"+v)
+	}
+	sort.Strings(pairs)
+	return line + "|#" + strings.Join(pairs, ",")
+}
+
+// send writes the lines in as few datagrams as fit them. A lost datagram
+// is not retried, statsd is best effort.
+func (s *statsdSink) send(lines []string) {
+	var packet strings.Builder
+	for _, line := range lines {
+		if packet.Len() != 0 && packet.Len()+1+len(line) > statsdPacket {
+			s.conn.Write([]byte(packet.String()))
+			packet.Reset()
+		}
+		if packet.Len() != 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() != 0 {
+		s.conn.Write([]byte(packet.String()))
+	}
+}
+
+// statsdName makes a mapping name usable within a metric name
+func statsdName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', '/', ' ':
+			return '_'
+		}
+		return r
+	}, strings.Trim(name, "/"))
+}
@@ -0,0 +1,153 @@
+package lnsync
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// Status is the state of a running daemon as reported by `lnsync status`
+type Status struct {
+	Pid         int             `json:"pid"`
+	Started     time.Time       `json:"started"`
+	Uptime      string          `json:"uptime"`
+	EventQueue  int             `json:"event_queue_depth"`
+	QueueDepth  int             `json:"queue_depth"`
+	RetryDepth  int64           `json:"retry_depth"`
+	Paused      bool            `json:"paused"`
+	Held        int             `json:"held"`
+	LastError   string          `json:"last_error,omitempty"`
+	LastErrorAt *time.Time      `json:"last_error_at,omitempty"`
+	Mappings    []MappingStatus `json:"mappings"`
+}
+
+// MappingStatus is degraded while the watcher of one of its sources is
+// down and waiting to be restarted, or scans directories beyond its kqueue
+// descriptor budget. A mapping with several destinations is
+// reported once for each, with the failures of that destination.
+type MappingStatus struct {
+	Name        string         `json:"name"`
+	Destination string         `json:"destination"`
+	Links       int            `json:"links"`
+	Degraded    bool           `json:"degraded"`
+	Errors      int64          `json:"errors"`
+	LastError   string         `json:"last_error,omitempty"`
+	Sources     []SourceStatus `json:"sources"`
+}
+
+type SourceStatus struct {
+	Path    string `json:"path"`
+	Active  bool   `json:"active"`
+	Watched int    `json:"watched_directories"`
+	Files   int64  `json:"files"`
+	Events  int64  `json:"events"`
+	Scanned int    `json:"scanned_directories,omitempty"`
+}
+
+func (m *Manager) Status() *Status {
+	st := &Status{
+		Pid:        os.Getpid(),
+		Started:    m.started,
+		Uptime:     time.Since(m.started).Round(time.Second).String(),
+		EventQueue: m.EventQueueDepth(),
+		QueueDepth: m.QueueDepth(),
+		RetryDepth: m.RetryDepth(),
+		Mappings:   make([]MappingStatus, 0),
+	}
+	st.Paused, st.Held = m.Paused()
+	if msg, at := stats.LastError(); len(msg) != 0 {
+		st.LastError, st.LastErrorAt = msg, &at
+	}
+	m.lock.Lock()
+	mappings := m.mappings
+	m.lock.Unlock()
+	for _, dirs := range mappings {
+		if len(dirs) == 0 {
+			continue
+		}
+		mapping := dirs[0].Mapping
+		ms := MappingStatus{
+			Name:        mapping.Name,
+			Destination: mapping.Destination,
+			Links:       countLinks(mapping),
+			Sources:     make([]SourceStatus, 0, len(dirs)),
+		}
+		var lastAt time.Time
+		for _, dir := range dirs {
+			count, last, at := dir.Errors()
+			ms.Errors += count
+			if at.After(lastAt) {
+				ms.LastError, lastAt = last, at
+			}
+			ms.Sources = append(ms.Sources, SourceStatus{
+				Path:    dir.Path,
+				Active:  dir.Active(),
+				Watched: dir.Watched(),
+				Files:   dir.Files(),
+				Events:  dir.Events(),
+				Scanned: dir.Scanned(),
+			})
+			ms.Degraded = ms.Degraded || !dir.Active() || dir.Scanned() != 0
+		}
+		st.Mappings = append(st.Mappings, ms)
+	}
+	return st
+}
+
+// countLinks is the number of managed links of the mapping: the recorded
+// ones with a state file, otherwise every entry of the destination
+func countLinks(mapping *Mapping) int {
+	if state != nil {
+		return state.Count(mapping.Name, mapping.Destination)
+	}
+	names, err := listTarget(mapping.Destination, mapping.nested())
+	if err != nil {
+		return -1
+	}
+	return len(names)
+}
+
+// LinkStatus is a destination entry as reported by `lnsync ctl list-links`
+type LinkStatus struct {
+	Mapping string `json:"mapping"`
+	Link    string `json:"link"`
+	Source  string `json:"source,omitempty"`
+}
+
+// Links lists the managed destination entries of the named mapping, or of
+// every mapping when name is empty
+func (m *Manager) Links(name string) ([]LinkStatus, error) {
+	m.lock.Lock()
+	mappings := m.mappings
+	m.lock.Unlock()
+	links := make([]LinkStatus, 0)
+	found := false
+	for _, dirs := range mappings {
+		if len(dirs) == 0 || (len(name) != 0 && dirs[0].Mapping.Name != name) {
+			continue
+		}
+		found = true
+		mapping := dirs[0].Mapping
+		names, err := listTarget(mapping.Destination, mapping.nested())
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range names {
+			link := mapping.Destination + "/" + entry
+			if state != nil && !state.Owns(link) {
+				continue
+			}
+			ls := LinkStatus{Mapping: mapping.Name, Link: link}
+			if target, err := readLink(link); err == nil {
+				ls.Source = target
+			} else if rec, ok := state.Record(link); ok {
+				ls.Source = rec.Source
+			}
+			links = append(links, ls)
+		}
+	}
+	if !found && len(name) != 0 {
+		return nil, errors.New("unknown mapping " + name)
+	}
+	return links, nil
+}
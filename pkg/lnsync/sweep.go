@@ -0,0 +1,78 @@
+package lnsync
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SweepEvery runs Sweep periodically. A sweep only reads the destinations,
+// which makes it much cheaper than a resync on large sources.
+func (m *Manager) SweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			return
+		}
+		if paused, _ := m.Paused(); paused {
+			continue
+		}
+		if removed, err := m.Sweep(); err != nil {
+			slog.Error("dangling link sweep failed", "removed", removed, "error", err)
+		} else if removed != 0 {
+			slog.Info("dangling links removed", "removed", removed)
+		}
+	}
+}
+
+// Sweep removes the managed symlinks of every destination whose target is
+// gone and returns how many it removed
+func (m *Manager) Sweep() (removed int, err error) {
+	m.lock.Lock()
+	mappings := m.mappings
+	m.lock.Unlock()
+	m.syncLock.Lock()
+	defer m.syncLock.Unlock()
+	for _, dirs := range mappings {
+		if len(dirs) == 0 {
+			continue
+		}
+		mapping := dirs[0].Mapping
+		names, lerr := listTarget(mapping.Destination, mapping.nested())
+		if lerr != nil {
+			err = lerr
+			continue
+		}
+		for _, name := range names {
+			if m.ctx.Err() != nil {
+				return removed, m.ctx.Err()
+			}
+			link := mapping.Destination + "/" + name
+			info, lerr := os.Lstat(link)
+			if lerr != nil || info.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			if _, lerr = filepath.EvalSymlinks(link); lerr == nil || !ownsLink(link, "", mapping) ||
+				mirroredBroken(mapping, link) {
+				continue
+			}
+			slog.Info("unresolved link, deleting", "mapping", mapping.Name, "destination", link)
+			if lerr = removeEntry(mapping, link); lerr != nil {
+				err = lerr
+				continue
+			}
+			state.Remove(link)
+			linkRemoved(mapping.Name, link, "")
+			countSwept()
+			removed++
+			if mapping.nested() {
+				pruneDirs(link, mapping.Destination)
+			}
+		}
+	}
+	return removed, err
+}
@@ -0,0 +1,170 @@
+package lnsync
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Treatment of source entries which are symlinks themselves
+const (
+	SourceLinksKeep    = "link"
+	SourceLinksResolve = "resolve"
+)
+
+// Policies for source symlinks whose target does not exist
+const (
+	BrokenSkip    = "skip"
+	BrokenMirror  = "mirror"
+	BrokenRecheck = "recheck"
+)
+
+// brokenRecheckInterval is how often skipped broken source symlinks are
+// looked at again under the recheck policy
+const brokenRecheckInterval = 30 * time.Second
+
+// linkTarget returns what the destination entry of file refers to: file
+// itself, or with resolved source symlinks the final target of file. A
+// symlink loop is an error.
+func (m *Mapping) linkTarget(file string) (string, error) {
+	if m.SourceLinks != SourceLinksResolve {
+		return file, nil
+	}
+	target, err := filepath.EvalSymlinks(file)
+	if os.IsNotExist(err) && m.BrokenLinks == BrokenMirror && isBroken(file) {
+		return file, nil
+	}
+	if err != nil {
+		if errors.Is(err, syscall.ELOOP) || errors.Is(err, syscall.EMLINK) {
+			return "", &os.PathError{Op: "resolve", Path: file, Err: errors.New("symlink loop")}
+		}
+		return "", err
+	}
+	return filepath.Abs(target)
+}
+
+// pointsTo reports whether a symlink target refers to file the way the
+// mapping links it
+func (m *Mapping) pointsTo(target, file string) bool {
+	if samePath(target, file) {
+		return true
+	}
+	resolved, err := m.linkTarget(file)
+	return err == nil && samePath(target, resolved)
+}
+
+// rememberTarget records the resolved target of file linked by the source,
+// so the link is recognized as ours when file is gone and can no longer
+// be resolved
+func (d *Directory) rememberTarget(file string) {
+	if d.Mapping.SourceLinks != SourceLinksResolve {
+		return
+	}
+	if target, err := d.Mapping.linkTarget(file); err == nil {
+		d.resolved.Store(file, target)
+	}
+}
+
+// ownTarget reports whether the symlink target of the destination entry
+// of file was created for file
+func (d *Directory) ownTarget(link, target, file string) bool {
+	if d.Mapping.pointsTo(target, file) {
+		return true
+	}
+	if d.Mapping.SourceLinks != SourceLinksResolve {
+		return false
+	}
+	if resolved, ok := d.resolved.Load(file); ok && samePath(target, resolved.(string)) {
+		return true
+	}
+	rec, ok := state.Record(link)
+	if ok && samePath(rec.Source, file) {
+		return true
+	}
+	slog.Debug("resolved target of removed file unknown", "source", file, "destination", link)
+	return false
+}
+
+// isBroken reports whether file is a symlink whose target does not exist
+func isBroken(file string) bool {
+	info, err := os.Lstat(file)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	_, err = os.Stat(file)
+	return os.IsNotExist(err)
+}
+
+// mirroredBroken reports whether the dangling destination symlink link
+// mirrors a broken source symlink on purpose
+func mirroredBroken(m *Mapping, link string) bool {
+	if m.BrokenLinks != BrokenMirror {
+		return false
+	}
+	target, err := readLink(link)
+	return err == nil && isBroken(target)
+}
+
+// admits applies the broken symlink policy of the mapping and then its
+// filters to a file of the source
+func (d *Directory) admits(file string) bool {
+	if !isBroken(file) {
+		return d.Mapping.admits(file)
+	}
+	switch d.Mapping.BrokenLinks {
+	case BrokenMirror:
+		slog.Debug("broken symlink in source, mirroring it", "source", file)
+		return true
+	case BrokenRecheck:
+		slog.Debug("broken symlink in source, checking it again later", "source", file)
+		d.brokenLock.Lock()
+		if d.broken == nil {
+			d.broken = make(map[string]bool)
+		}
+		d.broken[file] = true
+		d.brokenLock.Unlock()
+		d.brokenOnce.Do(func() {
+			if d.manager != nil && d.origin == nil {
+				go d.recheckBroken()
+			}
+		})
+		return false
+	}
+	slog.Debug("broken symlink in source, skipping it", "source", file)
+	return false
+}
+
+// recheckBroken links the broken source symlinks held back by the recheck
+// policy once their targets appear
+func (d *Directory) recheckBroken() {
+	ticker := time.NewTicker(brokenRecheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+		d.brokenLock.Lock()
+		files := make([]string, 0, len(d.broken))
+		for file := range d.broken {
+			files = append(files, file)
+		}
+		d.brokenLock.Unlock()
+		for _, file := range files {
+			if isBroken(file) {
+				continue
+			}
+			d.brokenLock.Lock()
+			delete(d.broken, file)
+			d.brokenLock.Unlock()
+			if _, err := os.Lstat(file); err == nil {
+				slog.Info("target of source symlink appeared, linking it", "source", file)
+				d.send(&Event{Name: file, Op: OpCreate})
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package lnsync
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Syncer is the sync engine for embedding lnsync into another program. It
+// owns a Manager and the webhooks and hooks of its configuration.
+//
+// The link state, counters and event subscribers are shared by the
+// package, so a process runs a single Syncer.
+type Syncer struct {
+	Workers        int
+	QueueSize      int
+	Retries        int
+	RetryDelay     time.Duration
+	OpTimeout      time.Duration
+	Overflow       string
+	ResyncInterval time.Duration
+	SweepInterval  time.Duration
+	GlobInterval   time.Duration
+
+	lock    sync.Mutex
+	conf    *Config
+	manager *Manager
+	events  chan LinkEvent
+	stop    sync.Once
+}
+
+// NewSyncer returns a Syncer serving conf, which may be nil to start
+// without mappings, with the defaults of the lnsync daemon
+func NewSyncer(conf *Config) *Syncer {
+	if conf == nil {
+		conf = &Config{}
+	}
+	return &Syncer{
+		Workers:      4,
+		QueueSize:    1024,
+		Retries:      5,
+		RetryDelay:   time.Second,
+		Overflow:     OverflowBlock,
+		GlobInterval: 30 * time.Second,
+		conf:         conf,
+	}
+}
+
+// AddMapping adds a mapping, which is served right away once the Syncer
+// is started
+func (s *Syncer) AddMapping(mapping Mapping) error {
+	s.lock.Lock()
+	m := s.manager
+	if m == nil {
+		defer s.lock.Unlock()
+		if err := mapping.Check(); err != nil {
+			return err
+		}
+		conf := copyConfig(s.conf)
+		conf.Mappings = append(conf.Mappings, mapping)
+		if err := conf.CheckLoops(); err != nil {
+			return err
+		}
+		s.conf = conf
+		return nil
+	}
+	s.lock.Unlock()
+	return m.AddMapping(mapping)
+}
+
+// Reload replaces the configuration being served, see Manager.Apply
+func (s *Syncer) Reload(conf *Config) error {
+	s.lock.Lock()
+	s.conf = conf
+	m := s.manager
+	s.lock.Unlock()
+	if m == nil {
+		return nil
+	}
+	StartWebhooks(conf.Webhooks)
+	StartHooks(conf.Hooks)
+	StartStatsd(m, conf.Statsd)
+	StartNotifiers(conf.Notifiers)
+	StartAlerts(m, conf.Alert)
+	return m.Apply(conf)
+}
+
+// Start watches the sources and reconciles every mapping. The Syncer stops
+// when ctx is done. An error of the initial reconciliation is returned,
+// but the Syncer keeps running.
+func (s *Syncer) Start(ctx context.Context) error {
+	switch s.Overflow {
+	case OverflowBlock, OverflowDropOldest, OverflowRescan:
+	default:
+		return errors.New("unknown overflow policy " + s.Overflow)
+	}
+	s.lock.Lock()
+	if s.manager != nil {
+		s.lock.Unlock()
+		return errors.New("syncer already started")
+	}
+	m := NewManager(ctx, s.Workers, s.QueueSize)
+	m.Retries = s.Retries
+	m.RetryDelay = s.RetryDelay
+	m.OpTimeout = s.OpTimeout
+	m.Overflow = s.Overflow
+	s.manager = m
+	conf := s.conf
+	s.lock.Unlock()
+
+	StartWebhooks(conf.Webhooks)
+	StartHooks(conf.Hooks)
+	StartStatsd(m, conf.Statsd)
+	StartNotifiers(conf.Notifiers)
+	StartAlerts(m, conf.Alert)
+	go m.Run()
+	err := m.Apply(conf)
+	if s.ResyncInterval > 0 {
+		go m.ResyncEvery(s.ResyncInterval)
+	}
+	if s.SweepInterval > 0 {
+		go m.SweepEvery(s.SweepInterval)
+	}
+	if s.GlobInterval > 0 {
+		go m.ExpandEvery(s.GlobInterval)
+	}
+	go func() {
+		<-ctx.Done()
+		s.Stop()
+	}()
+	return err
+}
+
+// Stop shuts the watchers, webhooks and hooks down and closes the events
+// channel. Updates not yet applied are dropped.
+func (s *Syncer) Stop() {
+	s.shutdown(func(m *Manager) error {
+		m.Stop()
+		return nil
+	})
+}
+
+// Shutdown is Stop, but first applies the updates already received,
+// waiting at most timeout for them
+func (s *Syncer) Shutdown(timeout time.Duration) error {
+	return s.shutdown(func(m *Manager) error {
+		return m.Shutdown(timeout)
+	})
+}
+
+func (s *Syncer) shutdown(stop func(m *Manager) error) (err error) {
+	s.stop.Do(func() {
+		s.lock.Lock()
+		m, events := s.manager, s.events
+		s.lock.Unlock()
+		if m != nil {
+			err = stop(m)
+		}
+		StartWebhooks(nil)
+		StartHooks(nil)
+		StartStatsd(nil, nil)
+		StartNotifiers(nil)
+		StartAlerts(nil, nil)
+		if events != nil {
+			unsubscribe(events)
+			close(events)
+		}
+	})
+	return err
+}
+
+// Events returns the channel receiving every link created, removed or
+// renamed. Events are dropped while the receiver lags far behind.
+func (s *Syncer) Events() <-chan LinkEvent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.events == nil {
+		s.events = subscribe()
+	}
+	return s.events
+}
+
+// Manager returns the manager of a started Syncer, nil before Start
+func (s *Syncer) Manager() *Manager {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.manager
+}
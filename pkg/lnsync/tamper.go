@@ -0,0 +1,158 @@
+package lnsync
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/howeyc/fsnotify"
+)
+
+// Policies for destination entries changed behind the back of lnsync
+const (
+	TamperRepair = "repair"
+	TamperAlert  = "alert"
+)
+
+// tamperDelay collects destination events before checking them, so the
+// link operations of lnsync itself, which take several steps, settle first
+const tamperDelay = 500 * time.Millisecond
+
+// guardDestination watches the destination of the mapping whose sources
+// are dirs until ctx is done. Entries deleted, overwritten or repointed by
+// someone else are recreated from their source, or reported, according
+// to the tamper policy of the mapping.
+func (m *Manager) guardDestination(ctx context.Context, dirs []*Directory) {
+	mapping := dirs[0].Mapping
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("failed to watch destination", "mapping", mapping.Name, "destination", mapping.Destination,
+			"error", err)
+		return
+	}
+	defer watcher.Close()
+	watch := func(dir string) {
+		filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			if werr := watcher.Watch(name); werr != nil {
+				slog.Error("add watch failed", "destination", name, "error", werr)
+			}
+			if !mapping.nested() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	}
+	watch(mapping.Destination)
+
+	changed := make(map[string]bool)
+	var check <-chan time.Time
+	for {
+		select {
+		case raw, ok := <-watcher.Event:
+			if !ok {
+				return
+			}
+			if len(raw.Name) == 0 || isTemp(raw.Name) || isManifest(raw.Name) {
+				continue
+			}
+			ev := newEvent(raw)
+			if ev.IsCreate() && mapping.nested() {
+				if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+					watch(ev.Name)
+					continue
+				}
+			}
+			changed[ev.Name] = true
+			if check == nil {
+				check = time.After(tamperDelay)
+			}
+		case <-check:
+			m.checkTampered(ctx, dirs, changed)
+			changed, check = make(map[string]bool), nil
+		case err, ok := <-watcher.Error:
+			if !ok {
+				return
+			}
+			slog.Warn("destination watcher error", "mapping", mapping.Name, "destination", mapping.Destination,
+				"error", err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkTampered compares the changed destination entries with what the
+// sources call for. Entries lnsync does not manage, and entries without a
+// source, are none of its business.
+func (m *Manager) checkTampered(ctx context.Context, dirs []*Directory, changed map[string]bool) {
+	if m.postpone() {
+		return
+	}
+	m.syncLock.Lock()
+	defer m.syncLock.Unlock()
+	mapping := dirs[0].Mapping
+	expected, err := expectedLinks(dirs)
+	if err != nil {
+		slog.Error("check destination failed", "mapping", mapping.Name, "error", err)
+		return
+	}
+	for link := range changed {
+		file, ok := expected[strings.TrimPrefix(link, mapping.Destination+"/")]
+		if !ok || (state != nil && !state.Owns(link)) || linkIntact(dirs, link, file) {
+			continue
+		}
+		countTampered()
+		if mapping.Tamper == TamperAlert {
+			slog.Error("destination entry tampered with", "mapping", mapping.Name, "source", file,
+				"destination", link)
+			continue
+		}
+		slog.Warn("destination entry tampered with, repairing", "mapping", mapping.Name, "source", file,
+			"destination", link)
+		if err := replaceLink(ctx, mapping, file, link); err != nil {
+			countError(err)
+			slog.Error("repair link failed", "source", file, "destination", link, "error", err)
+			continue
+		}
+		state.Add(link, file, mapping.Name)
+		linkCreated(mapping.Name, link, file)
+	}
+}
+
+// linkIntact reports whether the destination entry link still is what
+// lnsync made of file. A symlink to an equally named file of another
+// source may be the result of the collision policy and counts as intact.
+func linkIntact(dirs []*Directory, link, file string) bool {
+	mapping := dirs[0].Mapping
+	info, err := os.Lstat(link)
+	if err != nil {
+		return false
+	}
+	// hardlinks across filesystems fall back to symlinks
+	if mapping.LinkMode != LinkSymbolic && info.Mode()&os.ModeSymlink == 0 {
+		return isManagedFile(mapping.LinkMode, info, file)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	target, err := readLink(link)
+	if err != nil {
+		return false
+	}
+	if mapping.pointsTo(target, file) {
+		return true
+	}
+	for _, dir := range dirs {
+		if strings.HasPrefix(target, dir.Path+"/") {
+			_, err := os.Stat(target)
+			return err == nil
+		}
+	}
+	return false
+}
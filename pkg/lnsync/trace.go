@@ -0,0 +1,68 @@
+package lnsync
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the event pipeline: one for the arrival of
+// an event, one per attempt at applying it, from the arrival through the
+// debounce window and the queues to the filesystem operations, and one
+// per filesystem operation. Unless the program sets up a tracer provider
+// they cost next to nothing.
+var tracer = otel.Tracer("github.com/svagner/lnsync")
+
+// traceEvent records the arrival of an event in a span of its own, the
+// parent of the spans applying it
+func traceEvent(update *UpdateHeader) {
+	update.received = time.Now()
+	_, span := tracer.Start(context.Background(), "lnsync.event", trace.WithAttributes(
+		attribute.String("lnsync.event", eventName(&update.Event)),
+		attribute.String("lnsync.source", update.Event.Name),
+		attribute.String("lnsync.mapping", update.Path.Mapping.Name)))
+	update.span = span.SpanContext()
+	span.End()
+}
+
+// traceUpdate starts the span of one attempt at applying an update. The
+// first attempt starts when the event arrived, so the span covers the
+// time spent in the debounce window and the queues, until the dequeued
+// event.
+func traceUpdate(ctx context.Context, update *UpdateHeader) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithAttributes(
+		attribute.String("lnsync.event", eventName(&update.Event)),
+		attribute.String("lnsync.source", update.Event.Name),
+		attribute.String("lnsync.destination", update.Path.Dist),
+		attribute.Int("lnsync.attempt", update.Attempt))}
+	if update.Attempt == 0 && !update.received.IsZero() {
+		opts = append(opts, trace.WithTimestamp(update.received))
+	}
+	ctx, span := tracer.Start(trace.ContextWithSpanContext(ctx, update.span), "lnsync.update", opts...)
+	if update.Attempt == 0 && !update.received.IsZero() {
+		span.AddEvent("dequeued", trace.WithAttributes(
+			attribute.Int64("lnsync.queue_wait_ms", time.Since(update.received).Milliseconds())))
+	}
+	return ctx, span
+}
+
+// traceOp starts the span of a filesystem operation on a destination
+// entry
+func traceOp(ctx context.Context, name, source, entry string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("lnsync.source", source),
+		attribute.String("lnsync.destination", entry)))
+}
+
+// endSpan records the outcome of the work of a span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
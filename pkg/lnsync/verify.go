@@ -0,0 +1,107 @@
+package lnsync
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// Split returns the mapping narrowed to each of its destinations,
+// Destination first
+func (m *Mapping) Split() []*Mapping {
+	single := *m
+	single.Destinations = nil
+	return append([]*Mapping{&single}, m.replicas()...)
+}
+
+// Reconcile performs a single pass over every destination of mapping
+// without watching it: missing links are created and dangling ones
+// removed. A failing destination does not stop the others.
+func Reconcile(ctx context.Context, mapping *Mapping) error {
+	var errs []error
+	for _, dest := range mapping.Split() {
+		errs = append(errs, destError(dest, cleanDirs(ctx, mappingDirs(dest), dest.Destination)))
+	}
+	return errors.Join(errs...)
+}
+
+// Verify lists the entries of every destination of mapping which do not
+// match its sources: missing, dangling, stale or pointing elsewhere.
+// Nothing is changed.
+func Verify(mapping *Mapping) ([]string, error) {
+	drift := make([]string, 0)
+	var errs []error
+	for _, dest := range mapping.Split() {
+		found, err := verifyDest(dest)
+		errs = append(errs, destError(dest, err))
+		drift = append(drift, found...)
+	}
+	return drift, errors.Join(errs...)
+}
+
+// destError names the destination of mapping in err
+func destError(mapping *Mapping, err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New("destination " + mapping.Destination + ": " + err.Error())
+}
+
+// verifyDest is Verify for the single destination of mapping
+func verifyDest(mapping *Mapping) ([]string, error) {
+	filenames, err := expectedLinks(mappingDirs(mapping))
+	if err != nil {
+		return nil, err
+	}
+	files, err := listTarget(mapping.Destination, mapping.nested())
+	if err != nil {
+		return nil, err
+	}
+	drift := make([]string, 0)
+	present := make(map[string]bool)
+	for _, name := range files {
+		link := mapping.Destination + "/" + name
+		present[name] = true
+		if state != nil && !state.Owns(link) && !mapping.AdoptExisting {
+			continue
+		}
+		info, err := os.Lstat(link)
+		if err != nil {
+			return nil, err
+		}
+		file, ok := filenames[name]
+		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+			if state == nil && !mapping.AdoptExisting && !mapping.madeFor(link, file, info) {
+				// a symlink of another tool
+				continue
+			}
+			target, err := readLink(link)
+			if _, serr := os.Stat(link); err != nil || serr != nil {
+				drift = append(drift, "dangling "+link)
+			} else if !ok {
+				drift = append(drift, "stale "+link+" -> "+target)
+			} else if !mapping.pointsTo(target, file) {
+				drift = append(drift, "wrong target "+link+" -> "+target+", want "+file)
+			}
+		} else if !isManagedFile(mapping.LinkMode, info, file) {
+			drift = append(drift, "unmanaged "+link)
+		}
+	}
+	for name, file := range filenames {
+		if !present[name] {
+			drift = append(drift, "missing "+mapping.Destination+"/"+name+" -> "+file)
+		}
+	}
+	return drift, nil
+}
+
+// mappingDirs builds unwatched directories for a one-shot pass over the
+// sources of mapping
+func mappingDirs(mapping *Mapping) []*Directory {
+	dirs := make([]*Directory, 0)
+	mapping = mapping.expanded()
+	for _, src := range mapping.Sources {
+		dirs = append(dirs, &Directory{Path: src, Dist: mapping.Destination, Mapping: mapping})
+	}
+	return dirs
+}
@@ -0,0 +1,190 @@
+package lnsync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// webhookBacklog is how many batches may wait for delivery before new ones
+// are dropped
+const webhookBacklog = 64
+
+// Webhook posts link events to an URL
+type Webhook struct {
+	URL string `toml:"url" json:"url"`
+	// Secret signs the body with HMAC-SHA256, sent hex encoded in the
+	// X-Lnsync-Signature header as "sha256=<digest>"
+	Secret string `toml:"secret" json:"-"`
+	// Mappings limits the events to these mappings, all when empty
+	Mappings []string `toml:"mappings" json:"mappings,omitempty"`
+	// Batch collects the events of this window into one request
+	Batch Duration `toml:"batch" json:"batch"`
+	// Retries of a failed request, 3 when left out; 0 sends only once
+	Retries *int     `toml:"retries" json:"retries"`
+	Timeout Duration `toml:"timeout" json:"timeout"`
+}
+
+// WebhookPayload is the JSON body of a webhook request
+type WebhookPayload struct {
+	Events []LinkEvent `json:"events"`
+}
+
+func (w *Webhook) check() error {
+	if len(w.URL) == 0 {
+		return errors.New("webhook: no url defined")
+	}
+	if w.Retries == nil {
+		retries := 3
+		w.Retries = &retries
+	} else if *w.Retries < 0 {
+		return errors.New("webhook " + w.URL + ": retries must not be negative")
+	}
+	if w.Timeout.Duration <= 0 {
+		w.Timeout.Duration = 10 * time.Second
+	}
+	return nil
+}
+
+func (w *Webhook) accept(ev LinkEvent) bool {
+	if len(w.Mappings) == 0 {
+		return true
+	}
+	for _, name := range w.Mappings {
+		if name == ev.Mapping {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	webhookLock sync.Mutex
+	webhookQuit chan bool
+)
+
+// StartWebhooks replaces the running webhooks with the configured ones
+func StartWebhooks(hooks []Webhook) {
+	webhookLock.Lock()
+	defer webhookLock.Unlock()
+	if webhookQuit != nil {
+		close(webhookQuit)
+		webhookQuit = nil
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	webhookQuit = make(chan bool)
+	for idx := range hooks {
+		hook := hooks[idx]
+		go hook.run(webhookQuit)
+	}
+}
+
+// run collects the events accepted by the webhook into batches and hands
+// them to the sender until quit is closed
+func (w *Webhook) run(quit chan bool) {
+	events := subscribe()
+	defer unsubscribe(events)
+	batches := make(chan []LinkEvent, webhookBacklog)
+	defer close(batches)
+	go w.deliver(batches, quit)
+
+	var batch []LinkEvent
+	var flush <-chan time.Time
+	send := func() {
+		select {
+		case batches <- batch:
+		default:
+			slog.Error("webhook backlog full, dropping events", "url", w.URL, "events", len(batch))
+		}
+		batch, flush = nil, nil
+	}
+	for {
+		select {
+		case ev := <-events:
+			if !w.accept(ev) {
+				continue
+			}
+			batch = append(batch, ev)
+			if w.Batch.Duration <= 0 {
+				send()
+			} else if flush == nil {
+				flush = time.After(w.Batch.Duration)
+			}
+		case <-flush:
+			send()
+		case <-quit:
+			if len(batch) != 0 {
+				send()
+			}
+			return
+		}
+	}
+}
+
+func (w *Webhook) deliver(batches chan []LinkEvent, quit chan bool) {
+	client := &http.Client{Timeout: w.Timeout.Duration}
+	for batch := range batches {
+		body, err := json.Marshal(WebhookPayload{Events: batch})
+		if err != nil {
+			slog.Error("webhook payload failed", "url", w.URL, "error", err)
+			continue
+		}
+		delay := time.Second
+		for attempt := 0; ; attempt++ {
+			err = w.post(client, body)
+			if err == nil {
+				break
+			}
+			if attempt >= *w.Retries {
+				slog.Error("giving up on webhook", "url", w.URL, "events", len(batch),
+					"attempts", attempt+1, "error", err)
+				countError(err)
+				break
+			}
+			slog.Warn("retrying webhook", "url", w.URL, "attempt", attempt+1, "delay", delay, "error", err)
+			select {
+			case <-time.After(delay):
+			case <-quit:
+				slog.Error("webhook stopped, dropping events", "url", w.URL, "events", len(batch), "error", err)
+				countError(err)
+				return
+			}
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+	}
+}
+
+func (w *Webhook) post(client *http.Client, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "lnsync")
+	if len(w.Secret) != 0 {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Lnsync-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("webhook " + w.URL + ": status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}